@@ -1,12 +1,20 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"os"
+
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/caching"
 	"github.com/maxroll-media-group/meilisearch-proxy/pkg/config"
 	"github.com/maxroll-media-group/meilisearch-proxy/pkg/logger"
 	"github.com/maxroll-media-group/meilisearch-proxy/pkg/proxy"
 )
 
 func main() {
+	warmIndex := flag.String("warm-index", "", "warm the cache of this index and exit")
+	warmFile := flag.String("warm-file", "", "JSONL file with one search body per line, used with -warm-index")
+	flag.Parse()
 
 	logger := logger.GetLogger()
 	config, err := config.LoadConfig(false)
@@ -15,7 +23,47 @@ func main() {
 		logger.Fatal().Msgf("Error loading config: %s", err)
 	}
 
+	if *warmIndex != "" {
+		if *warmFile == "" {
+			logger.Fatal().Msg("-warm-file is required when using -warm-index")
+		}
+
+		// a memory cache would be gone once the process exits
+		if config.CacheConfig.Engine != "redis" {
+			logger.Fatal().Msg("-warm-index requires the redis cache engine")
+		}
+		if err := caching.Ping(context.Background(), config.CacheConfig); err != nil {
+			logger.Fatal().Msgf("Error reaching the Redis cache: %s", err)
+		}
+
+		file, err := os.Open(*warmFile)
+		if err != nil {
+			logger.Fatal().Msgf("Error opening warm file: %s", err)
+		}
+		defer file.Close()
+
+		// no load balancer routes to a warming run, exit without waiting
+		config.ShutdownDelay = 0
+		proxy := proxy.NewProxy(config)
+
+		warmed, err := proxy.WarmFromReader(proxy.Context, *warmIndex, file)
+
+		// flush the analytics and traces of the replayed searches
+		if shutdownErr := proxy.Shutdown(context.Background()); shutdownErr != nil {
+			logger.Error().Msgf("Error shutting down: %s", shutdownErr)
+		}
+
+		if err != nil {
+			logger.Fatal().Msgf("Error warming cache: %s", err)
+		}
+
+		logger.Info().Msgf("Warmed %d queries for index %s", warmed, *warmIndex)
+		return
+	}
+
 	proxy := proxy.NewProxy(config)
 
-	proxy.Listen()
+	if err := proxy.Listen(); err != nil {
+		logger.Fatal().Msgf("Error running proxy: %s", err)
+	}
 }
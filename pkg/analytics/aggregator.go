@@ -0,0 +1,160 @@
+package analytics
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// maxQueries bounds the distinct queries counted per index, the least counted
+// query is evicted to make room for a new one
+const maxQueries = 1000
+
+type QueryCount struct {
+	Query string `json:"q"`
+	Count int64  `json:"count"`
+}
+
+// IndexSummary aggregates the searches of an index
+type IndexSummary struct {
+	Searches            int64   `json:"searches"`
+	ZeroResults         int64   `json:"zeroResults"`
+	CacheHits           int64   `json:"cacheHits"`
+	AvgDurationMs       float64 `json:"avgDurationMs"`
+	AvgProcessingTimeMs float64 `json:"avgProcessingTimeMs"`
+}
+
+// IndexReport is the summary of an index with its top queries
+type IndexReport struct {
+	Index string `json:"index"`
+	IndexSummary
+	TopQueries           []QueryCount `json:"topQueries"`
+	TopZeroResultQueries []QueryCount `json:"topZeroResultQueries"`
+}
+
+type indexStats struct {
+	summary          IndexSummary
+	durationMs       float64
+	processingTimeMs float64
+	processed        int64
+	queries          map[string]int64
+	zeroQueries      map[string]int64
+}
+
+// Aggregator keeps in memory counts of the searches of each index since startup
+type Aggregator struct {
+	mu      sync.Mutex
+	indexes map[string]*indexStats
+}
+
+func NewAggregator() *Aggregator {
+	return &Aggregator{indexes: make(map[string]*indexStats)}
+}
+
+func count(queries map[string]int64, query string) {
+	if _, ok := queries[query]; !ok && len(queries) >= maxQueries {
+		evict := ""
+		min := int64(-1)
+		for q, n := range queries {
+			if min < 0 || n < min {
+				evict, min = q, n
+			}
+		}
+		delete(queries, evict)
+	}
+
+	queries[query]++
+}
+
+func (a *Aggregator) Add(event Event) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	stats, ok := a.indexes[event.Index]
+	if !ok {
+		stats = &indexStats{queries: make(map[string]int64), zeroQueries: make(map[string]int64)}
+		a.indexes[event.Index] = stats
+	}
+
+	// queries are counted case and whitespace insensitively
+	query := strings.ToLower(strings.Join(strings.Fields(event.Query), " "))
+
+	stats.summary.Searches++
+	stats.durationMs += event.DurationMs
+	if event.Cache == "hit" {
+		stats.summary.CacheHits++
+	}
+	if event.ProcessingTimeMs != nil {
+		stats.processed++
+		stats.processingTimeMs += float64(*event.ProcessingTimeMs)
+	}
+
+	count(stats.queries, query)
+	if event.TotalHits != nil && *event.TotalHits == 0 {
+		stats.summary.ZeroResults++
+		count(stats.zeroQueries, query)
+	}
+}
+
+func (s *indexStats) snapshot() IndexSummary {
+	summary := s.summary
+	if summary.Searches > 0 {
+		summary.AvgDurationMs = s.durationMs / float64(summary.Searches)
+	}
+	if s.processed > 0 {
+		summary.AvgProcessingTimeMs = s.processingTimeMs / float64(s.processed)
+	}
+
+	return summary
+}
+
+// Summary returns the summary of every index
+func (a *Aggregator) Summary() map[string]IndexSummary {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	summary := make(map[string]IndexSummary, len(a.indexes))
+	for index, stats := range a.indexes {
+		summary[index] = stats.snapshot()
+	}
+
+	return summary
+}
+
+func top(queries map[string]int64, limit int) []QueryCount {
+	counts := make([]QueryCount, 0, len(queries))
+	for q, n := range queries {
+		counts = append(counts, QueryCount{Query: q, Count: n})
+	}
+
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count == counts[j].Count {
+			return counts[i].Query < counts[j].Query
+		}
+		return counts[i].Count > counts[j].Count
+	})
+
+	if len(counts) > limit {
+		counts = counts[:limit]
+	}
+
+	return counts
+}
+
+// Report returns the summary of an index with its limit top queries and zero-result queries
+func (a *Aggregator) Report(index string, limit int) (IndexReport, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	stats, ok := a.indexes[index]
+	if !ok {
+		return IndexReport{}, false
+	}
+
+	return IndexReport{
+		Index:                index,
+		IndexSummary:         stats.snapshot(),
+		TopQueries:           top(stats.queries, limit),
+		TopZeroResultQueries: top(stats.zeroQueries, limit),
+	}, true
+}
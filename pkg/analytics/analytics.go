@@ -0,0 +1,221 @@
+package analytics
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Search is what the proxy knows of a search once it has been answered. It is turned
+// into an Event by the recorder, off the request path.
+type Search struct {
+	Time      time.Time
+	Index     string
+	Method    string
+	Body      []byte
+	Query     url.Values
+	Response  string
+	Cache     string
+	ClientKey string
+	Status    int
+	Duration  time.Duration
+}
+
+// Event is the record of a search sent to the sinks
+type Event struct {
+	Time             time.Time       `json:"time"`
+	Index            string          `json:"index"`
+	Query            string          `json:"q"`
+	Filter           json.RawMessage `json:"filter,omitempty"`
+	TotalHits        *int64          `json:"totalHits,omitempty"`
+	ProcessingTimeMs *int64          `json:"processingTimeMs,omitempty"`
+	Cache            string          `json:"cache"`
+	ClientKey        string          `json:"clientKey,omitempty"`
+	Status           int             `json:"status"`
+	DurationMs       float64         `json:"durationMs"`
+}
+
+type searchParams struct {
+	Query  string          `json:"q"`
+	Filter json.RawMessage `json:"filter"`
+}
+
+type searchResult struct {
+	EstimatedTotalHits *int64 `json:"estimatedTotalHits"`
+	TotalHits          *int64 `json:"totalHits"`
+	ProcessingTimeMs   *int64 `json:"processingTimeMs"`
+}
+
+// NewEvent parses the parameters and the response of a search
+func NewEvent(s Search) Event {
+	event := Event{
+		Time:       s.Time,
+		Index:      s.Index,
+		Cache:      s.Cache,
+		ClientKey:  s.ClientKey,
+		Status:     s.Status,
+		DurationMs: float64(s.Duration.Microseconds()) / 1000,
+	}
+
+	if len(s.Body) > 0 {
+		var params searchParams
+		if json.Unmarshal(s.Body, &params) == nil {
+			event.Query = params.Query
+			if string(params.Filter) != "null" {
+				event.Filter = params.Filter
+			}
+		}
+	} else if s.Query != nil {
+		event.Query = s.Query.Get("q")
+		if filter := s.Query.Get("filter"); filter != "" {
+			event.Filter, _ = json.Marshal(filter)
+		}
+	}
+
+	if s.Response != "" {
+		var result searchResult
+		if json.Unmarshal([]byte(s.Response), &result) == nil {
+			// paginated searches return totalHits instead of estimatedTotalHits
+			event.TotalHits = result.EstimatedTotalHits
+			if result.TotalHits != nil {
+				event.TotalHits = result.TotalHits
+			}
+			event.ProcessingTimeMs = result.ProcessingTimeMs
+		}
+	}
+
+	return event
+}
+
+// Sink receives batches of events
+type Sink interface {
+	Write(ctx context.Context, events []Event) error
+	Close() error
+}
+
+// Recorder turns searches into events in the background and sends them in batches to
+// the sinks and the aggregator. Searches are dropped when it can't keep up.
+type Recorder struct {
+	searches   chan Search
+	sinks      []Sink
+	aggregator *Aggregator
+	batchSize  int
+	interval   time.Duration
+	dropped    atomic.Int64
+	logger     zerolog.Logger
+	done       chan struct{}
+
+	// mu guards searches from being written to once closed
+	mu     sync.RWMutex
+	closed bool
+}
+
+func NewRecorder(sinks []Sink, aggregator *Aggregator, bufferSize int, batchSize int, interval time.Duration, logger zerolog.Logger) *Recorder {
+	r := &Recorder{
+		searches:   make(chan Search, bufferSize),
+		sinks:      sinks,
+		aggregator: aggregator,
+		batchSize:  batchSize,
+		interval:   interval,
+		logger:     logger,
+		done:       make(chan struct{}),
+	}
+
+	go r.run()
+
+	return r
+}
+
+// Record queues a search without blocking
+func (r *Recorder) Record(s Search) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.closed {
+		return
+	}
+
+	select {
+	case r.searches <- s:
+	default:
+		if r.dropped.Add(1)%1000 == 1 {
+			r.logger.Warn().Msgf("Analytics buffer is full, %d searches dropped so far", r.dropped.Load())
+		}
+	}
+}
+
+// Dropped returns the number of searches dropped because the buffer was full
+func (r *Recorder) Dropped() int64 {
+	return r.dropped.Load()
+}
+
+func (r *Recorder) run() {
+	defer close(r.done)
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	batch := make([]Event, 0, r.batchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+
+		for _, sink := range r.sinks {
+			if err := sink.Write(context.Background(), batch); err != nil {
+				r.logger.Error().Msgf("Error writing %d analytics events: %s", len(batch), err)
+			}
+		}
+		batch = make([]Event, 0, r.batchSize)
+	}
+
+	for {
+		select {
+		case s, ok := <-r.searches:
+			if !ok {
+				flush()
+				return
+			}
+
+			event := NewEvent(s)
+			if r.aggregator != nil {
+				r.aggregator.Add(event)
+			}
+
+			batch = append(batch, event)
+			if len(batch) >= r.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// Close flushes the queued searches and closes the sinks, searches recorded afterwards are ignored
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	close(r.searches)
+	r.mu.Unlock()
+
+	<-r.done
+
+	var err error
+	for _, sink := range r.sinks {
+		if closeErr := sink.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,185 @@
+package analytics_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
+
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/analytics"
+)
+
+// memorySink keeps the batches it receives
+type memorySink struct {
+	mu      sync.Mutex
+	batches [][]analytics.Event
+	closed  bool
+}
+
+func (s *memorySink) Write(ctx context.Context, events []analytics.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.batches = append(s.batches, events)
+	return nil
+}
+
+func (s *memorySink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+func (s *memorySink) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for _, batch := range s.batches {
+		n += len(batch)
+	}
+	return n
+}
+
+var _ = Describe("Analytics", func() {
+
+	Context("NewEvent", func() {
+		It("should read the query, filter and totals of a POST search", func() {
+			event := analytics.NewEvent(analytics.Search{
+				Index:    "products",
+				Body:     []byte(`{"q":"shoes","filter":"color = red"}`),
+				Response: `{"hits":[],"estimatedTotalHits":0,"processingTimeMs":3}`,
+				Cache:    "miss",
+				Status:   http.StatusOK,
+				Duration: 5 * time.Millisecond,
+			})
+
+			Expect(event.Query).To(Equal("shoes"))
+			Expect(event.Filter).To(MatchJSON(`"color = red"`))
+			Expect(*event.TotalHits).To(Equal(int64(0)))
+			Expect(*event.ProcessingTimeMs).To(Equal(int64(3)))
+			Expect(event.DurationMs).To(Equal(5.0))
+		})
+
+		It("should read GET searches and the totalHits of paginated searches", func() {
+			event := analytics.NewEvent(analytics.Search{
+				Query:    url.Values{"q": {"shoes"}},
+				Response: `{"hits":[],"totalHits":12,"page":1}`,
+			})
+
+			Expect(event.Query).To(Equal("shoes"))
+			Expect(event.Filter).To(BeNil())
+			Expect(*event.TotalHits).To(Equal(int64(12)))
+		})
+	})
+
+	Context("Recorder", func() {
+		It("should send batches to the sinks and flush on close", func() {
+			sink := &memorySink{}
+			aggregator := analytics.NewAggregator()
+			recorder := analytics.NewRecorder([]analytics.Sink{sink}, aggregator, 100, 2, time.Hour, zerolog.Nop())
+
+			for i := 0; i < 3; i++ {
+				recorder.Record(analytics.Search{Index: "products", Body: []byte(`{"q":"shoes"}`)})
+			}
+
+			Eventually(sink.count).Should(Equal(2))
+
+			Expect(recorder.Close()).To(Succeed())
+			Expect(sink.count()).To(Equal(3))
+			Expect(sink.closed).To(BeTrue())
+
+			// searches recorded after closing are ignored
+			recorder.Record(analytics.Search{Index: "products"})
+			Expect(aggregator.Summary()["products"].Searches).To(Equal(int64(3)))
+		})
+	})
+
+	Context("Aggregator", func() {
+		It("should count top queries and zero-result queries per index", func() {
+			aggregator := analytics.NewAggregator()
+			zero, some := int64(0), int64(4)
+
+			aggregator.Add(analytics.Event{Index: "products", Query: "Red  Shoes", TotalHits: &some, Cache: "miss", DurationMs: 10})
+			aggregator.Add(analytics.Event{Index: "products", Query: "red shoes", TotalHits: &some, Cache: "hit", DurationMs: 2})
+			aggregator.Add(analytics.Event{Index: "products", Query: "unicorn", TotalHits: &zero, Cache: "miss", DurationMs: 6})
+
+			report, ok := aggregator.Report("products", 10)
+			Expect(ok).To(BeTrue())
+			Expect(report.Searches).To(Equal(int64(3)))
+			Expect(report.ZeroResults).To(Equal(int64(1)))
+			Expect(report.CacheHits).To(Equal(int64(1)))
+			Expect(report.AvgDurationMs).To(Equal(6.0))
+			Expect(report.TopQueries).To(Equal([]analytics.QueryCount{{Query: "red shoes", Count: 2}, {Query: "unicorn", Count: 1}}))
+			Expect(report.TopZeroResultQueries).To(Equal([]analytics.QueryCount{{Query: "unicorn", Count: 1}}))
+
+			_, ok = aggregator.Report("users", 10)
+			Expect(ok).To(BeFalse())
+		})
+	})
+
+	Context("Sinks", func() {
+		events := []analytics.Event{{Index: "products", Query: "shoes", Cache: "hit", Status: 200}}
+
+		It("should write JSON lines to a writer or a file", func() {
+			var buf bytes.Buffer
+			Expect(analytics.NewWriterSink(&buf).Write(context.Background(), events)).To(Succeed())
+			Expect(strings.Count(buf.String(), "\n")).To(Equal(1))
+
+			path := filepath.Join(GinkgoT().TempDir(), "analytics.jsonl")
+			sink, err := analytics.NewFileSink(path)
+			Expect(err).To(BeNil())
+			Expect(sink.Write(context.Background(), events)).To(Succeed())
+			Expect(sink.Write(context.Background(), events)).To(Succeed())
+			Expect(sink.Close()).To(Succeed())
+
+			data, err := os.ReadFile(path)
+			Expect(err).To(BeNil())
+			lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+			Expect(lines).To(HaveLen(2))
+			Expect(lines[0]).To(ContainSubstring(`"q":"shoes"`))
+		})
+
+		It("should add events to a Redis stream", func() {
+			server := miniredis.RunT(GinkgoT())
+			client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+
+			sink := analytics.NewRedisStreamSink(client, "analytics", 1000)
+			Expect(sink.Write(context.Background(), events)).To(Succeed())
+
+			messages, err := client.XRange(context.Background(), "analytics", "-", "+").Result()
+			Expect(err).To(BeNil())
+			Expect(messages).To(HaveLen(1))
+			Expect(messages[0].Values["event"]).To(ContainSubstring(`"index":"products"`))
+			Expect(sink.Close()).To(Succeed())
+		})
+
+		It("should post batches to a webhook", func() {
+			received := make(chan []analytics.Event, 1)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				var batch []analytics.Event
+				Expect(json.Unmarshal(body, &batch)).To(Succeed())
+				received <- batch
+			}))
+			defer server.Close()
+
+			Expect(analytics.NewWebhookSink(server.URL).Write(context.Background(), events)).To(Succeed())
+			Eventually(received).Should(Receive(HaveLen(1)))
+		})
+	})
+})
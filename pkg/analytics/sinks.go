@@ -0,0 +1,141 @@
+package analytics
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// WriterSink writes events as JSON lines, to stdout or a file
+type WriterSink struct {
+	mu     sync.Mutex
+	writer *bufio.Writer
+	closer io.Closer
+}
+
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{writer: bufio.NewWriter(w)}
+}
+
+// NewFileSink appends events to a JSONL file
+func NewFileSink(path string) (*WriterSink, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &WriterSink{writer: bufio.NewWriter(file), closer: file}, nil
+}
+
+func (s *WriterSink) Write(ctx context.Context, events []Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	encoder := json.NewEncoder(s.writer)
+	for _, event := range events {
+		if err := encoder.Encode(event); err != nil {
+			return err
+		}
+	}
+
+	return s.writer.Flush()
+}
+
+func (s *WriterSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.writer.Flush()
+	if s.closer != nil {
+		if closeErr := s.closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	return err
+}
+
+// RedisStreamSink adds events to a Redis stream, trimmed to about maxLen events
+type RedisStreamSink struct {
+	client *redis.Client
+	stream string
+	maxLen int64
+}
+
+func NewRedisStreamSink(client *redis.Client, stream string, maxLen int64) *RedisStreamSink {
+	return &RedisStreamSink{client: client, stream: stream, maxLen: maxLen}
+}
+
+func (s *RedisStreamSink) Write(ctx context.Context, events []Event) error {
+	pipe := s.client.Pipeline()
+	for _, event := range events {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+
+		pipe.XAdd(ctx, &redis.XAddArgs{
+			Stream: s.stream,
+			MaxLen: s.maxLen,
+			Approx: true,
+			Values: map[string]interface{}{"event": data},
+		})
+	}
+
+	_, err := pipe.Exec(ctx)
+
+	return err
+}
+
+func (s *RedisStreamSink) Close() error {
+	return s.client.Close()
+}
+
+// WebhookSink posts each batch of events as a JSON array
+type WebhookSink struct {
+	url    string
+	client *http.Client
+}
+
+func NewWebhookSink(url string) *WebhookSink {
+	return &WebhookSink{url: url, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (s *WebhookSink) Write(ctx context.Context, events []Event) error {
+	body, err := json.Marshal(events)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+func (s *WebhookSink) Close() error {
+	return nil
+}
@@ -2,6 +2,7 @@ package caching
 
 import (
 	"context"
+	"sync/atomic"
 	"time"
 
 	"github.com/dgraph-io/ristretto"
@@ -16,12 +17,32 @@ import (
 )
 
 func GetMemoryCache(config *config.CacheConfig) *cache.Cache[string] {
+	cacheManager, _ := openMemoryCache(config, nil)
 
-	ristrettoCache, err := ristretto.NewCache(&ristretto.Config{
+	return cacheManager
+}
+
+// openMemoryCache creates a memory cache, whose evictions are forgotten by the registry if any
+func openMemoryCache(config *config.CacheConfig, registry *Registry) (*cache.Cache[string], func() error) {
+
+	ristrettoConfig := &ristretto.Config{
 		NumCounters: 1000,
 		MaxCost:     100,
 		BufferItems: 64,
-	})
+	}
+	// closing evicts every entry, which may have been stored again in the next cache
+	var closed atomic.Bool
+	if registry != nil {
+		// rejected entries were never stored
+		ristrettoConfig.OnEvict = func(item *ristretto.Item) {
+			if !closed.Load() {
+				registry.Evict(item.Key, item.Conflict)
+			}
+		}
+		ristrettoConfig.OnReject = ristrettoConfig.OnEvict
+	}
+
+	ristrettoCache, err := ristretto.NewCache(ristrettoConfig)
 	if err != nil {
 		panic(err)
 	}
@@ -29,17 +50,44 @@ func GetMemoryCache(config *config.CacheConfig) *cache.Cache[string] {
 
 	cacheManager := cache.New[string](ristrettoStore)
 
-	return cacheManager
+	return cacheManager, func() error {
+		closed.Store(true)
+		ristrettoCache.Close()
+		return nil
+	}
+}
+
+// Ping checks that the Redis server of a redis cache is reachable, unlike Open which
+// falls back to the memory engine
+func Ping(ctx context.Context, config *config.CacheConfig) error {
+	opts, err := redis.ParseURL(config.Url)
+	if err != nil {
+		return err
+	}
+
+	client := redis.NewClient(opts)
+	defer client.Close()
+
+	return client.Ping(ctx).Err()
 }
 
 func NewCache(ctx context.Context, config *config.CacheConfig) *cache.Cache[string] {
+	cacheManager, _ := Open(ctx, config, nil)
+
+	return cacheManager
+}
+
+// Open creates a cache like NewCache, and also returns a function releasing the
+// resources of the cache engine (goroutines, connections) once it is no longer used.
+// The registry, if any, forgets the entries evicted by the memory engine.
+func Open(ctx context.Context, config *config.CacheConfig, registry *Registry) (*cache.Cache[string], func() error) {
 	logger := logger.GetLogger()
 
 	logger.Info().Msgf("Creating cache with engine: %s, expiration: %d seconds", config.Engine, config.TTL)
 
 	if config.Engine == "memory" {
 		logger.Info().Msg("Using memory cache")
-		return GetMemoryCache(config)
+		return openMemoryCache(config, registry)
 	} else if config.Engine == "redis" {
 
 		opts, err := redis.ParseURL(config.Url)
@@ -47,7 +95,7 @@ func NewCache(ctx context.Context, config *config.CacheConfig) *cache.Cache[stri
 			logger.Fatal().Msgf("Error parsing Redis URL: %s", err)
 		}
 
-		logger.Info().Msgf("Using Redis cache with URL: %s", config.Url)
+		logger.Info().Msgf("Using Redis cache at %s, database %d", opts.Addr, opts.DB)
 
 		redis := redis.NewClient(opts)
 		redisStore := redis_store.NewRedis(redis, store.WithExpiration(config.TTL*time.Second))
@@ -57,12 +105,13 @@ func NewCache(ctx context.Context, config *config.CacheConfig) *cache.Cache[stri
 		if status.Err() != nil {
 
 			logger.Error().Msg("Redis not available, falling back to memory cache")
-			return GetMemoryCache(config)
+			redis.Close()
+			return openMemoryCache(config, registry)
 		}
 
 		cacheManager := cache.New[string](redisStore)
 
-		return cacheManager
+		return cacheManager, redis.Close
 	}
 
 	panic("Unknown cache engine")
@@ -2,8 +2,11 @@ package caching_test
 
 import (
 	"context"
+	"fmt"
+	"time"
 
 	"github.com/alicebob/miniredis/v2"
+	"github.com/eko/gocache/lib/v4/store"
 	"github.com/maxroll-media-group/meilisearch-proxy/pkg/caching"
 	"github.com/maxroll-media-group/meilisearch-proxy/pkg/config"
 	. "github.com/onsi/ginkgo/v2"
@@ -91,4 +94,86 @@ var _ = Describe("Caching", func() {
 			}).To(Panic())
 		})
 	})
+
+	Describe("Registry", func() {
+		It("should keep track of entries per index", func() {
+			registry := caching.NewRegistry(caching.DefaultMaxEntries)
+			expiresAt := time.Now().Add(time.Minute)
+
+			registry.Add(caching.Entry{Key: "a", Index: "products", Size: 10, ExpiresAt: expiresAt})
+			registry.Add(caching.Entry{Key: "b", Index: "products", Size: 5, ExpiresAt: expiresAt})
+			registry.Add(caching.Entry{Key: "c", Index: "profiles", Size: 1, ExpiresAt: expiresAt})
+			registry.Hit("b")
+
+			Expect(registry.Stats()).To(Equal(map[string]caching.IndexStats{
+				"products": {Entries: 2, Bytes: 15},
+				"profiles": {Entries: 1, Bytes: 1},
+			}))
+
+			entries := registry.Entries("products")
+			Expect(entries).To(HaveLen(2))
+			Expect(entries[0].Key).To(Equal("b"))
+			Expect(entries[0].Hits).To(Equal(int64(1)))
+
+			registry.RemoveIndex("products")
+			Expect(registry.Entries("")).To(HaveLen(1))
+		})
+
+		It("should find and remove entries cached through an alias", func() {
+			registry := caching.NewRegistry(caching.DefaultMaxEntries)
+			expires := time.Now().Add(time.Minute)
+
+			registry.Add(caching.Entry{Key: "a", Index: "products_v1", Alias: "products", ExpiresAt: expires})
+			registry.Add(caching.Entry{Key: "b", Index: "products_v1", ExpiresAt: expires})
+
+			Expect(registry.Entries("products")).To(HaveLen(1))
+			Expect(registry.Entries("products_v1")).To(HaveLen(2))
+
+			registry.RemoveIndex("products")
+			Expect(registry.Entries("products_v1")).To(HaveLen(1))
+		})
+
+		It("should forget the least recently used entries beyond its size", func() {
+			registry := caching.NewRegistry(2)
+			expires := time.Now().Add(time.Minute)
+
+			registry.Add(caching.Entry{Key: "a", Index: "products", ExpiresAt: expires})
+			registry.Add(caching.Entry{Key: "b", Index: "products", ExpiresAt: expires})
+			registry.Hit("a")
+			registry.Add(caching.Entry{Key: "c", Index: "products", ExpiresAt: expires})
+
+			_, ok := registry.Get("b")
+			Expect(ok).To(BeFalse())
+			Expect(registry.Entries("products")).To(HaveLen(2))
+		})
+
+		It("should forget the entries evicted by the memory engine", func() {
+			registry := caching.NewRegistry(caching.DefaultMaxEntries)
+			cacheMgr, closeCache := caching.Open(ctx, &config.CacheConfig{Engine: "memory", TTL: 300}, registry)
+			defer closeCache()
+
+			registry.Add(caching.Entry{Key: "a", Index: "products", ExpiresAt: time.Now().Add(time.Minute)})
+			Expect(cacheMgr.Set(ctx, "a", "response", store.WithCost(1), store.WithSynchronousSet())).To(Succeed())
+
+			// the memory engine holds 100 entries at most
+			for i := 0; i < 1000; i++ {
+				cacheMgr.Set(ctx, fmt.Sprintf("other-%d", i), "response", store.WithCost(1), store.WithSynchronousSet())
+			}
+
+			Eventually(func() bool {
+				_, ok := registry.Get("a")
+				return ok
+			}).Should(BeFalse())
+		})
+
+		It("should drop expired entries", func() {
+			registry := caching.NewRegistry(caching.DefaultMaxEntries)
+
+			registry.Add(caching.Entry{Key: "expired", Index: "products", ExpiresAt: time.Now().Add(-time.Second)})
+
+			_, ok := registry.Get("expired")
+			Expect(ok).To(BeFalse())
+			Expect(registry.Stats()).To(BeEmpty())
+		})
+	})
 })
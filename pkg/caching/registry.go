@@ -0,0 +1,227 @@
+package caching
+
+import (
+	"container/list"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/ristretto/z"
+)
+
+// Entry describes a cached search response. The cache engines only store the
+// response itself, the registry keeps track of where it came from.
+type Entry struct {
+	Key       string          `json:"key"`
+	Index     string          `json:"index"`
+	Alias     string          `json:"alias,omitempty"`
+	Method    string          `json:"method"`
+	Path      string          `json:"path"`
+	Body      json.RawMessage `json:"body,omitempty"`
+	Size      int             `json:"size"`
+	CreatedAt time.Time       `json:"createdAt"`
+	ExpiresAt time.Time       `json:"expiresAt"`
+	Hits      int64           `json:"hits"`
+}
+
+// TTL returns the time left before the entry expires
+func (e Entry) TTL() time.Duration {
+	return time.Until(e.ExpiresAt)
+}
+
+type IndexStats struct {
+	Entries int `json:"entries"`
+	Bytes   int `json:"bytes"`
+}
+
+// DefaultMaxEntries is the number of entries a registry keeps track of by default
+const DefaultMaxEntries = 100000
+
+// Registry holds the metadata of the entries stored by this proxy instance.
+// With a shared Redis cache, entries stored by other replicas are not listed.
+// It keeps at most maxEntries entries, forgetting the least recently used ones.
+type Registry struct {
+	mu         sync.RWMutex
+	entries    map[string]*list.Element
+	recent     *list.List
+	hashes     map[uint64]string
+	maxEntries int
+	adds       int
+}
+
+func NewRegistry(maxEntries int) *Registry {
+	return &Registry{
+		entries:    make(map[string]*list.Element),
+		recent:     list.New(),
+		hashes:     make(map[uint64]string),
+		maxEntries: maxEntries,
+	}
+}
+
+// Add registers an entry, replacing any previous entry with the same key
+func (r *Registry) Add(entry Entry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if element, ok := r.entries[entry.Key]; ok {
+		element.Value = &entry
+		r.recent.MoveToFront(element)
+		return
+	}
+
+	r.entries[entry.Key] = r.recent.PushFront(&entry)
+	keyHash, _ := z.KeyToHash(entry.Key)
+	r.hashes[keyHash] = entry.Key
+
+	// expired entries are otherwise only dropped when they are looked at
+	r.adds++
+	if r.adds%1000 == 0 {
+		r.prune(time.Now())
+	}
+
+	for r.maxEntries > 0 && len(r.entries) > r.maxEntries {
+		r.remove(r.recent.Back().Value.(*Entry).Key)
+	}
+}
+
+// Hit increments the hit count of an entry
+func (r *Registry) Hit(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if element, ok := r.entries[key]; ok {
+		element.Value.(*Entry).Hits++
+		r.recent.MoveToFront(element)
+	}
+}
+
+// Get returns the entry for a key if it is registered and not expired
+func (r *Registry) Get(key string) (Entry, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	element, ok := r.entries[key]
+	if !ok {
+		return Entry{}, false
+	}
+
+	entry := element.Value.(*Entry)
+	if time.Now().After(entry.ExpiresAt) {
+		r.remove(key)
+		return Entry{}, false
+	}
+
+	return *entry, true
+}
+
+func (r *Registry) Remove(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.remove(key)
+}
+
+// Evict removes the entry evicted by the memory engine, which only knows the hashes of keys
+func (r *Registry) Evict(keyHash uint64, conflict uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key, ok := r.hashes[keyHash]
+	if !ok {
+		return
+	}
+
+	if _, keyConflict := z.KeyToHash(key); keyConflict == conflict {
+		r.remove(key)
+	}
+}
+
+// RemoveIndex removes all entries of an index, or cached through an alias
+func (r *Registry) RemoveIndex(index string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for key, element := range r.entries {
+		entry := element.Value.(*Entry)
+		if entry.Index == index || entry.Alias == index {
+			r.remove(key)
+		}
+	}
+}
+
+func (r *Registry) Clear() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.entries = make(map[string]*list.Element)
+	r.recent.Init()
+	r.hashes = make(map[uint64]string)
+}
+
+// Entries returns the live entries of an index or alias, most hit first. An empty index returns all entries.
+func (r *Registry) Entries(index string) []Entry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.prune(time.Now())
+
+	entries := []Entry{}
+	for _, element := range r.entries {
+		entry := element.Value.(*Entry)
+		if index == "" || entry.Index == index || entry.Alias == index {
+			entries = append(entries, *entry)
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Hits == entries[j].Hits {
+			return entries[i].Key < entries[j].Key
+		}
+		return entries[i].Hits > entries[j].Hits
+	})
+
+	return entries
+}
+
+// Stats returns the number of entries and their total size per index
+func (r *Registry) Stats() map[string]IndexStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.prune(time.Now())
+
+	stats := make(map[string]IndexStats)
+	for _, element := range r.entries {
+		entry := element.Value.(*Entry)
+		s := stats[entry.Index]
+		s.Entries++
+		s.Bytes += entry.Size
+		stats[entry.Index] = s
+	}
+
+	return stats
+}
+
+func (r *Registry) remove(key string) {
+	element, ok := r.entries[key]
+	if !ok {
+		return
+	}
+
+	r.recent.Remove(element)
+	delete(r.entries, key)
+
+	keyHash, _ := z.KeyToHash(key)
+	if r.hashes[keyHash] == key {
+		delete(r.hashes, keyHash)
+	}
+}
+
+func (r *Registry) prune(now time.Time) {
+	for key, element := range r.entries {
+		if now.After(element.Value.(*Entry).ExpiresAt) {
+			r.remove(key)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+)
+
+// Certificate is a key pair read from PEM files. Reload reads the files again, so
+// that rotated certificates are used by new connections without a restart.
+type Certificate struct {
+	certFile string
+	keyFile  string
+	current  atomic.Pointer[tls.Certificate]
+}
+
+// Load reads the key pair of certFile and keyFile
+func Load(certFile string, keyFile string) (*Certificate, error) {
+	c := &Certificate{certFile: certFile, keyFile: keyFile}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Reload reads the files again, the current key pair is kept when they are invalid,
+// for example when the certificate was rotated but not its key yet
+func (c *Certificate) Reload() error {
+	pair, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("error loading the certificate %s: %w", c.certFile, err)
+	}
+
+	c.current.Store(&pair)
+	return nil
+}
+
+// GetCertificate presents the current certificate to clients, see tls.Config
+func (c *Certificate) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.current.Load(), nil
+}
+
+// GetClientCertificate presents the current certificate to servers, see tls.Config
+func (c *Certificate) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return c.current.Load(), nil
+}
+
+// Pool returns the system CAs along with the ones of the PEM bundle caFile
+func Pool(caFile string) (*x509.CertPool, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the CA bundle: %w", err)
+	}
+
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("no certificates found in the CA bundle " + caFile)
+	}
+
+	return pool, nil
+}
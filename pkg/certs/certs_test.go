@@ -0,0 +1,112 @@
+package certs_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/certs"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// writeCertificate writes a self-signed certificate and its key to dir
+func writeCertificate(dir string, serial int64) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).To(BeNil())
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).To(BeNil())
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	Expect(err).To(BeNil())
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	Expect(os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)).To(Succeed())
+	Expect(os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)).To(Succeed())
+
+	return certFile, keyFile
+}
+
+var _ = Describe("Certs", func() {
+	var dir string
+
+	serial := func(certificate *certs.Certificate) int64 {
+		pair, err := certificate.GetCertificate(nil)
+		Expect(err).To(BeNil())
+
+		leaf, err := x509.ParseCertificate(pair.Certificate[0])
+		Expect(err).To(BeNil())
+		return leaf.SerialNumber.Int64()
+	}
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+	})
+
+	It("should use the rotated certificate after a reload", func() {
+		certFile, keyFile := writeCertificate(dir, 1)
+
+		certificate, err := certs.Load(certFile, keyFile)
+		Expect(err).To(BeNil())
+		Expect(serial(certificate)).To(Equal(int64(1)))
+
+		writeCertificate(dir, 2)
+		Expect(serial(certificate)).To(Equal(int64(1)))
+
+		Expect(certificate.Reload()).To(Succeed())
+		Expect(serial(certificate)).To(Equal(int64(2)))
+	})
+
+	It("should keep the current certificate when the files are invalid", func() {
+		certFile, keyFile := writeCertificate(dir, 1)
+
+		certificate, err := certs.Load(certFile, keyFile)
+		Expect(err).To(BeNil())
+
+		// the certificate was rotated, not its key yet
+		Expect(os.WriteFile(keyFile, []byte("rotating"), 0o600)).To(Succeed())
+
+		Expect(certificate.Reload()).To(MatchError(ContainSubstring("error loading the certificate " + certFile)))
+		Expect(serial(certificate)).To(Equal(int64(1)))
+	})
+
+	It("should trust the CAs of the bundle", func() {
+		certFile, _ := writeCertificate(dir, 1)
+
+		pool, err := certs.Pool(certFile)
+		Expect(err).To(BeNil())
+
+		data, _ := os.ReadFile(certFile)
+		block, _ := pem.Decode(data)
+		leaf, err := x509.ParseCertificate(block.Bytes)
+		Expect(err).To(BeNil())
+
+		_, err = leaf.Verify(x509.VerifyOptions{Roots: pool, DNSName: "localhost"})
+		Expect(err).To(BeNil())
+	})
+
+	It("should refuse a CA bundle without certificates", func() {
+		file := filepath.Join(dir, "ca.pem")
+		Expect(os.WriteFile(file, []byte("not a certificate"), 0o600)).To(Succeed())
+
+		_, err := certs.Pool(file)
+		Expect(err).To(MatchError("no certificates found in the CA bundle " + file))
+	})
+})
@@ -1,32 +1,519 @@
 package config
 
 import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"net/url"
 	"os"
-	"strconv"
 	"time"
 
 	"github.com/joho/godotenv"
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/certs"
 	"github.com/maxroll-media-group/meilisearch-proxy/pkg/logger"
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/routepolicy"
+	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
-	MeilisearchHost        string
-	MeilisearchMasterKey   string
-	ProxyMasterKey         string
-	ProxyMasterKeyOverride bool
-	ProxyPurgeToken        string
-	Port                   string
-	CacheConfig            *CacheConfig
-	AutoRestartInterval    time.Duration
+	MeilisearchHost        string             `yaml:"meilisearchHost"`
+	MeilisearchMasterKey   string             `yaml:"meilisearchMasterKey"`
+	ProxyMasterKey         string             `yaml:"proxyMasterKey"`
+	ProxyMasterKeyOverride bool               `yaml:"proxyMasterKeyOverride"`
+	ProxyPurgeToken        string             `yaml:"proxyPurgeToken"`
+	Port                   string             `yaml:"port"`
+	CacheConfig            *CacheConfig       `yaml:"cache"`
+	WarmConfig             *WarmConfig        `yaml:"warm"`
+	PurgeConfig            *PurgeConfig       `yaml:"purge"`
+	CacheOnlyConfig        *CacheOnlyConfig   `yaml:"cacheOnly"`
+	HealthConfig           *HealthConfig      `yaml:"health"`
+	UpstreamConfig         *UpstreamConfig    `yaml:"upstream"`
+	RateLimitConfig        *RateLimitConfig   `yaml:"rateLimit"`
+	AnalyticsConfig        *AnalyticsConfig   `yaml:"analytics"`
+	MirrorConfig           *MirrorConfig      `yaml:"mirror"`
+	TracingConfig          *TracingConfig     `yaml:"tracing"`
+	CORSConfig             *CORSConfig        `yaml:"cors"`
+	TLSConfig              *TLSConfig         `yaml:"tls"`
+	AdminConfig            *AdminConfig       `yaml:"admin"`
+	RoutePolicyConfig      *RoutePolicyConfig `yaml:"routePolicy"`
+	// SearchRules are the guardrails applied to searches per index, "*" applies to indexes without rules
+	SearchRules map[string]*SearchRule `yaml:"searchRules"`
+	// IndexAliases maps virtual index names to physical indexes
+	IndexAliases map[string]string `yaml:"indexAliases"`
+	// Experiments split the searches of an index between variants, by name
+	Experiments         map[string]*Experiment `yaml:"experiments"`
+	AutoRestartInterval time.Duration          `yaml:"autoRestartInterval"`
+	// AccessLogSampleRate is the fraction of requests logged, server errors are always logged
+	AccessLogSampleRate float64 `yaml:"accessLogSampleRate"`
+	// ShutdownDelay is how long readiness fails before the server stops accepting requests
+	ShutdownDelay time.Duration `yaml:"shutdownDelay"`
+	// ShutdownTimeout bounds the draining of in-flight requests
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout"`
+	// File is the YAML file the config was read from, empty when it only comes from env vars
+	File string `yaml:"-"`
+	// ReloadInterval is how often the config file is checked for changes, 0 only reloads on SIGHUP
+	ReloadInterval time.Duration `yaml:"reloadInterval"`
+	// SecretFiles are the files secrets were read from, they are watched for rotation like File
+	SecretFiles []string `yaml:"-"`
 }
 
 type CacheConfig struct {
-	TTL    time.Duration
-	Engine string
-	Url    string
+	// TTL is in seconds, the config file takes a duration (5m, 1h, etc)
+	TTL    time.Duration `yaml:"ttl"`
+	Engine string        `yaml:"engine"`
+	Url    string        `yaml:"url"`
+	// MaxEntrySize is the size in bytes above which responses are not cached, 0 disables the limit
+	MaxEntrySize int64 `yaml:"maxEntrySize"`
+	// StaleTTL keeps a copy of each entry for this long, served when Meilisearch fails. 0 disables it.
+	StaleTTL time.Duration `yaml:"staleTtl"`
 }
 
+// DefaultCacheConfig is used when no cache configuration is given
+func DefaultCacheConfig() *CacheConfig {
+	return &CacheConfig{
+		TTL:          300,
+		Engine:       "memory",
+		MaxEntrySize: 5 * 1024 * 1024,
+	}
+}
+
+type UpstreamConfig struct {
+	DialTimeout         time.Duration `yaml:"dialTimeout"`
+	TLSHandshakeTimeout time.Duration `yaml:"tlsHandshakeTimeout"`
+	// ResponseHeaderTimeout bounds the wait for the response headers of a search
+	ResponseHeaderTimeout time.Duration `yaml:"responseHeaderTimeout"`
+	// Timeout bounds a whole search, including reading the response body
+	Timeout time.Duration `yaml:"timeout"`
+	// Retries is the number of retries of searches and GET requests
+	Retries      int           `yaml:"retries"`
+	RetryBackoff time.Duration `yaml:"retryBackoff"`
+	// BreakerThreshold is the number of consecutive failed searches opening the circuit breaker
+	BreakerThreshold int `yaml:"breakerThreshold"`
+	// BreakerCooldown is how long the breaker stays open before letting a request through
+	BreakerCooldown time.Duration `yaml:"breakerCooldown"`
+	// Replicas are other Meilisearch hosts serving the same indexes, searches are hedged to them
+	Replicas []string `yaml:"replicas"`
+	// HedgePercentile is the search latency percentile after which a search is hedged
+	HedgePercentile float64 `yaml:"hedgePercentile"`
+	// HedgeMinDelay is the minimum delay before hedging a search
+	HedgeMinDelay time.Duration `yaml:"hedgeMinDelay"`
+	// HedgeBudget is the maximum fraction of searches that are hedged, 0 disables hedging
+	HedgeBudget float64 `yaml:"hedgeBudget"`
+	// CAFile is a PEM bundle of CAs trusted for Meilisearch over https, on top of the system ones
+	CAFile string `yaml:"caFile"`
+	// CertFile and KeyFile are the client certificate presented to Meilisearch (mTLS)
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+	// ServerName overrides the name sent as SNI and verified in the certificate of Meilisearch
+	ServerName string `yaml:"serverName"`
+	// InsecureSkipVerify doesn't verify the certificate of Meilisearch, for tests only
+	InsecureSkipVerify bool `yaml:"insecureSkipVerify"`
+}
+
+// TLS returns the TLS config of the connections to Meilisearch, and its client
+// certificate, nil without mTLS, to reload when it is rotated
+func (c *UpstreamConfig) TLS() (*tls.Config, *certs.Certificate, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+
+	if c.CAFile != "" {
+		pool, err := certs.Pool(c.CAFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if c.CertFile == "" {
+		return tlsConfig, nil, nil
+	}
+
+	certificate, err := certs.Load(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	tlsConfig.GetClientCertificate = certificate.GetClientCertificate
+
+	return tlsConfig, certificate, nil
+}
+
+// DefaultUpstreamConfig is used when no upstream configuration is given
+func DefaultUpstreamConfig() *UpstreamConfig {
+	return &UpstreamConfig{
+		DialTimeout:           5 * time.Second,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: 10 * time.Second,
+		Timeout:               30 * time.Second,
+		Retries:               2,
+		RetryBackoff:          100 * time.Millisecond,
+		BreakerThreshold:      5,
+		BreakerCooldown:       30 * time.Second,
+		HedgePercentile:       95,
+		HedgeMinDelay:         10 * time.Millisecond,
+		HedgeBudget:           0.05,
+	}
+}
+
+// Experiment splits the searches of an index between variants, clients are
+// assigned to a variant by a hash of the header or cookie identifying them
+type Experiment struct {
+	// Index is the index or alias whose searches are split
+	Index string `json:"index" yaml:"index"`
+	// Header and Cookie identify clients, searches without either are not part of the experiment
+	Header string `json:"header" yaml:"header"`
+	Cookie string `json:"cookie" yaml:"cookie"`
+	// Enabled experiments split searches, they can be turned on and off at runtime
+	Enabled  bool                `json:"enabled" yaml:"enabled"`
+	Variants []ExperimentVariant `json:"variants" yaml:"variants"`
+}
+
+type ExperimentVariant struct {
+	Name string `json:"name" yaml:"name"`
+	// Weight is the share of clients assigned to the variant, relative to the other variants
+	Weight int `json:"weight" yaml:"weight"`
+	// Index is where the searches of the variant go, empty keeps the index of the experiment
+	Index string `json:"index,omitempty" yaml:"index"`
+	// Host is the Meilisearch instance the searches of the variant go to, empty keeps MEILISEARCH_HOST
+	Host string `json:"host,omitempty" yaml:"host"`
+}
+
+// SearchRule rewrites or rejects searches before they are looked up in the cache
+type SearchRule struct {
+	// MaxLimit caps limit and hitsPerPage
+	MaxLimit int `json:"maxLimit" yaml:"maxLimit"`
+	// AttributesToRetrieve is the whitelist of attributes a search can retrieve
+	AttributesToRetrieve []string `json:"attributesToRetrieve" yaml:"attributesToRetrieve"`
+	// MaxFacets rejects searches asking for more facets
+	MaxFacets int `json:"maxFacets" yaml:"maxFacets"`
+	// MaxQueryLength rejects searches with a longer q, in characters
+	MaxQueryLength int `json:"maxQueryLength" yaml:"maxQueryLength"`
+	// DeniedParameters are stripped from searches
+	DeniedParameters []string `json:"deniedParameters" yaml:"deniedParameters"`
+	// Filter is added to the filter of every search
+	Filter string `json:"filter" yaml:"filter"`
+	// KeyFilters are added to the filter of searches made with an API key, tenant
+	// tokens are matched by the API key they are signed with
+	KeyFilters map[string]string `json:"keyFilters" yaml:"keyFilters"`
+}
+
+const (
+	AnalyticsSinkFile    = "file"
+	AnalyticsSinkStdout  = "stdout"
+	AnalyticsSinkRedis   = "redis"
+	AnalyticsSinkWebhook = "webhook"
+)
+
+type AnalyticsConfig struct {
+	// Enabled records an event per search, aggregated for the /analytics endpoint
+	Enabled bool `yaml:"enabled"`
+	// Sinks the events are sent to, any of AnalyticsSinkFile, AnalyticsSinkStdout, AnalyticsSinkRedis or AnalyticsSinkWebhook
+	Sinks       []string `yaml:"sinks"`
+	File        string   `yaml:"file"`
+	RedisUrl    string   `yaml:"redisUrl"`
+	RedisStream string   `yaml:"redisStream"`
+	// RedisMaxLen trims the stream to about this many events
+	RedisMaxLen int64  `yaml:"redisMaxLen"`
+	WebhookUrl  string `yaml:"webhookUrl"`
+	// BatchSize and FlushInterval bound how many events are sent at once and how long they wait
+	BatchSize     int           `yaml:"batchSize"`
+	FlushInterval time.Duration `yaml:"flushInterval"`
+	// BufferSize is the number of searches waiting to be recorded, more are dropped
+	BufferSize int `yaml:"bufferSize"`
+}
+
+// DefaultAnalyticsConfig is used when no analytics configuration is given, analytics are disabled
+func DefaultAnalyticsConfig() *AnalyticsConfig {
+	return &AnalyticsConfig{
+		RedisStream:   "meilisearch-proxy:analytics",
+		RedisMaxLen:   1000000,
+		BatchSize:     100,
+		FlushInterval: 5 * time.Second,
+		BufferSize:    10000,
+	}
+}
+
+const (
+	TracingExporterNone   = "none"
+	TracingExporterOTLP   = "otlp"
+	TracingExporterStdout = "stdout"
+)
+
+type TracingConfig struct {
+	// Exporter is where spans are sent, one of TracingExporterNone, TracingExporterOTLP or TracingExporterStdout
+	Exporter string `yaml:"exporter"`
+	// Endpoint is the URL of the OTLP/HTTP collector, empty uses the OTEL_EXPORTER_OTLP_* variables
+	Endpoint    string `yaml:"endpoint"`
+	ServiceName string `yaml:"serviceName"`
+	// SampleRatio is the fraction of traces started by the proxy that are sampled, the
+	// sampling decision of the caller is kept for traces started upstream
+	SampleRatio float64 `yaml:"sampleRatio"`
+}
+
+// DefaultTracingConfig is used when no tracing configuration is given, tracing is disabled
+func DefaultTracingConfig() *TracingConfig {
+	return &TracingConfig{
+		Exporter:    TracingExporterNone,
+		ServiceName: "meilisearch-proxy",
+		SampleRatio: 1,
+	}
+}
+
+// CORSConfig has one policy for the search routes and one for the admin routes
+// (purge, warm, cache, mode, aliases, analytics, experiments and metrics)
+type CORSConfig struct {
+	Public CORSPolicy `yaml:"public"`
+	Admin  CORSPolicy `yaml:"admin"`
+}
+
+type CORSPolicy struct {
+	// AllowedOrigins are exact origins (https://example.com), subdomain wildcards
+	// (https://*.example.com) or * for any origin. Empty disables CORS.
+	AllowedOrigins []string `yaml:"allowedOrigins"`
+	// AllowCredentials lets browsers send cookies and Authorization headers, it can't be used with *
+	AllowCredentials bool     `yaml:"allowCredentials"`
+	AllowedMethods   []string `yaml:"allowedMethods"`
+	AllowedHeaders   []string `yaml:"allowedHeaders"`
+	// ExposedHeaders are the response headers readable by scripts, like X-Cache
+	ExposedHeaders []string `yaml:"exposedHeaders"`
+	// MaxAge is how long browsers cache preflight responses, 0 leaves it to the browser
+	MaxAge time.Duration `yaml:"maxAge"`
+}
+
+// DefaultCORSConfig is used when no CORS configuration is given, searches are allowed
+// from any origin and admin routes from none
+func DefaultCORSConfig() *CORSConfig {
+	return &CORSConfig{
+		Public: CORSPolicy{
+			AllowedOrigins: []string{"*"},
+			AllowedMethods: []string{"GET", "POST", "OPTIONS"},
+			AllowedHeaders: []string{"Content-Type", "Authorization", "X-Meilisearch-Client"},
+		},
+		Admin: CORSPolicy{
+			AllowedMethods: []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+			AllowedHeaders: []string{"Content-Type", "Authorization"},
+		},
+	}
+}
+
+// TLSConfig serves the proxy over HTTPS, and HTTP/2
+type TLSConfig struct {
+	// CertFile and KeyFile are the PEM certificate and key of the proxy, reloaded when
+	// they change. Empty serves plain HTTP.
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+}
+
+// DefaultTLSConfig is used when no TLS configuration is given, the proxy serves plain HTTP
+func DefaultTLSConfig() *TLSConfig {
+	return &TLSConfig{}
+}
+
+// AdminConfig moves the admin routes (purge, warm, cache, mode, aliases, analytics,
+// experiments and metrics) to their own listener, kept inside the cluster network
+type AdminConfig struct {
+	// Listen is a port (9090), an address (127.0.0.1:9090) or a unix socket
+	// (unix:/run/meilisearch-proxy/admin.sock). Empty serves them on the public port.
+	Listen string `yaml:"listen"`
+}
+
+// DefaultAdminConfig is used when no admin configuration is given, the admin routes are public
+func DefaultAdminConfig() *AdminConfig {
+	return &AdminConfig{}
+}
+
+// RoutePolicyConfig restricts the routes of Meilisearch served on the public listener,
+// see routepolicy.New for the rules
+type RoutePolicyConfig struct {
+	// Preset is all, read-only or search-only, the allow rules are added to it
+	Preset string   `yaml:"preset"`
+	Allow  []string `yaml:"allow"`
+	// Deny rules win over the preset and the allow rules
+	Deny []string `yaml:"deny"`
+}
+
+// DefaultRoutePolicyConfig is used when no route policy is given, every route is allowed
+func DefaultRoutePolicyConfig() *RoutePolicyConfig {
+	return &RoutePolicyConfig{
+		Preset: routepolicy.PresetAll,
+	}
+}
+
+type MirrorConfig struct {
+	// Host is the shadow Meilisearch instance searches are mirrored to, empty disables mirroring
+	Host   string `yaml:"host"`
+	ApiKey string `yaml:"apiKey"`
+	// SampleRate is the percentage of searches mirrored to the shadow instance
+	SampleRate float64 `yaml:"sampleRate"`
+	// Timeout bounds a mirrored search
+	Timeout time.Duration `yaml:"timeout"`
+	// Concurrency is the number of mirrored searches in flight, more are dropped
+	Concurrency int `yaml:"concurrency"`
+	// PrimaryKey is the attribute hits are told apart by when comparing responses
+	PrimaryKey string `yaml:"primaryKey"`
+}
+
+// DefaultMirrorConfig is used when no mirror configuration is given, mirroring is disabled
+func DefaultMirrorConfig() *MirrorConfig {
+	return &MirrorConfig{
+		SampleRate:  10,
+		Timeout:     5 * time.Second,
+		Concurrency: 10,
+		PrimaryKey:  "id",
+	}
+}
+
+const (
+	RateLimitByIP     = "ip"
+	RateLimitByAPIKey = "api_key"
+	RateLimitByTenant = "tenant"
+)
+
+type RateLimitConfig struct {
+	// By is what clients are told apart by, one of RateLimitByIP, RateLimitByAPIKey or RateLimitByTenant
+	By string `yaml:"by"`
+	// Store keeps the token buckets, memory or redis to share them across replicas
+	Store string `yaml:"store"`
+	Url   string `yaml:"url"`
+	// Rate is the number of requests per second of a client, cache hits included. 0 disables it.
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+	// MissRate is the number of requests per second of a client reaching Meilisearch. 0 disables it.
+	MissRate  float64 `yaml:"missRate"`
+	MissBurst int     `yaml:"missBurst"`
+	// TrustedProxies are the CIDRs whose X-Forwarded-For header is trusted
+	TrustedProxies []string `yaml:"trustedProxies"`
+	// Keys are the API keys that get a bucket of their own with by api_key or tenant, and
+	// that tenant tokens are verified against. Other requests only have the bucket of their IP.
+	Keys []string `yaml:"keys"`
+}
+
+// DefaultRateLimitConfig is used when no rate limit configuration is given, it doesn't limit anything
+func DefaultRateLimitConfig() *RateLimitConfig {
+	return &RateLimitConfig{
+		By:    RateLimitByIP,
+		Store: "memory",
+	}
+}
+
+type PurgeConfig struct {
+	// RequireHealthyUpstream refuses to purge while Meilisearch's /health is failing,
+	// so that the cache keeps serving while Meilisearch can't repopulate it
+	RequireHealthyUpstream bool `yaml:"requireHealthyUpstream"`
+	// HealthTimeout bounds the Meilisearch health check
+	HealthTimeout time.Duration `yaml:"healthTimeout"`
+	// Timeout bounds a whole purge job
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// DefaultPurgeConfig is used when no purge configuration is given
+func DefaultPurgeConfig() *PurgeConfig {
+	return &PurgeConfig{
+		RequireHealthyUpstream: true,
+		HealthTimeout:          5 * time.Second,
+		Timeout:                30 * time.Second,
+	}
+}
+
+const (
+	CacheOnlyMissError = "error"
+	CacheOnlyMissEmpty = "empty"
+)
+
+type CacheOnlyConfig struct {
+	// Enabled serves searches from the cache only and rejects writes, it can be toggled at runtime
+	Enabled bool `yaml:"enabled"`
+	// MissResponse is either CacheOnlyMissError or CacheOnlyMissEmpty
+	MissResponse string `yaml:"missResponse"`
+	// RetryAfter is sent with the 503 returned to writes
+	RetryAfter time.Duration `yaml:"retryAfter"`
+}
+
+// DefaultCacheOnlyConfig is used when no cache-only configuration is given
+func DefaultCacheOnlyConfig() *CacheOnlyConfig {
+	return &CacheOnlyConfig{
+		Enabled:      false,
+		MissResponse: CacheOnlyMissError,
+		RetryAfter:   time.Minute,
+	}
+}
+
+const (
+	// ReadinessStrict requires Meilisearch and the cache to be healthy
+	ReadinessStrict = "strict"
+	// ReadinessStale stays ready while Meilisearch is down as long as the cache can serve
+	ReadinessStale = "stale"
+)
+
+type HealthConfig struct {
+	ReadinessPolicy string `yaml:"readinessPolicy"`
+	// CheckTimeout bounds each readiness check
+	CheckTimeout time.Duration `yaml:"checkTimeout"`
+}
+
+// DefaultHealthConfig is used when no health configuration is given
+func DefaultHealthConfig() *HealthConfig {
+	return &HealthConfig{
+		ReadinessPolicy: ReadinessStale,
+		CheckTimeout:    2 * time.Second,
+	}
+}
+
+type WarmConfig struct {
+	// TopN is the number of popular queries kept per index, 0 disables tracking
+	TopN int `yaml:"topN"`
+	// HalfLife is the time after which a query's popularity score is halved
+	HalfLife time.Duration `yaml:"halfLife"`
+	// Interval schedules periodic warming, 0 disables it
+	Interval time.Duration `yaml:"interval"`
+	// Rate is the maximum number of warming requests per second sent upstream
+	Rate int `yaml:"rate"`
+	// OnPurge replays the popular queries of an index after it has been purged
+	OnPurge bool `yaml:"onPurge"`
+}
+
+// DefaultWarmConfig is used when no warm configuration is given, no queries are tracked
+func DefaultWarmConfig() *WarmConfig {
+	return &WarmConfig{
+		HalfLife: time.Hour,
+		Rate:     5,
+		OnPurge:  true,
+	}
+}
+
+// DefaultConfig is the config without a config file nor env vars
+func DefaultConfig() *Config {
+	return &Config{
+		Port:                "8080",
+		CacheConfig:         DefaultCacheConfig(),
+		WarmConfig:          DefaultWarmConfig(),
+		PurgeConfig:         DefaultPurgeConfig(),
+		CacheOnlyConfig:     DefaultCacheOnlyConfig(),
+		HealthConfig:        DefaultHealthConfig(),
+		UpstreamConfig:      DefaultUpstreamConfig(),
+		RateLimitConfig:     DefaultRateLimitConfig(),
+		AnalyticsConfig:     DefaultAnalyticsConfig(),
+		MirrorConfig:        DefaultMirrorConfig(),
+		TracingConfig:       DefaultTracingConfig(),
+		CORSConfig:          DefaultCORSConfig(),
+		TLSConfig:           DefaultTLSConfig(),
+		AdminConfig:         DefaultAdminConfig(),
+		RoutePolicyConfig:   DefaultRoutePolicyConfig(),
+		AccessLogSampleRate: 1,
+		ShutdownDelay:       5 * time.Second,
+		ShutdownTimeout:     20 * time.Second,
+		ReloadInterval:      10 * time.Second,
+	}
+}
+
+// LoadConfig loads the .env file and reads the config, see Load. Unless skipUrlCheck
+// is set, Meilisearch must be reachable.
 func LoadConfig(skipUrlCheck bool) (*Config, error) {
 	logger := logger.GetLogger()
 
@@ -35,76 +522,244 @@ func LoadConfig(skipUrlCheck bool) (*Config, error) {
 		logger.Warn().Msg("Could not load .env file")
 	}
 
-	CacheConfig := &CacheConfig{
-		TTL:    300,
-		Engine: "memory",
-		Url:    "",
+	config, err := Load(os.Getenv("CONFIG_FILE"))
+	if err != nil {
+		return nil, err
 	}
 
-	if os.Getenv("CACHE_ENGINE") != "" {
-		if os.Getenv("CACHE_ENGINE") == "redis" && os.Getenv("CACHE_URL") == "" {
-			logger.Fatal().Msg("CACHE_URL is required when using Redis cache")
+	// check if the host is reachable
+	if !skipUrlCheck {
+		tlsConfig, _, err := config.UpstreamConfig.TLS()
+		if err != nil {
+			return nil, err
 		}
 
-		CacheConfig.Engine = os.Getenv("CACHE_ENGINE")
-		CacheConfig.Url = os.Getenv("CACHE_URL")
-	}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+		_, err = client.Get(config.MeilisearchHost)
 
-	if os.Getenv("CACHE_TTL") != "" {
-		ttl, err := strconv.Atoi(os.Getenv("CACHE_TTL"))
 		if err != nil {
-			logger.Fatal().Msg("CACHE_TTL must be an integer")
+			return nil, err
 		}
-		CacheConfig.TTL = time.Duration(ttl)
+	}
+
+	return config, nil
+}
+
+// Load reads the YAML config file, when there is one, then env vars on top of it.
+// All the invalid settings are returned at once.
+func Load(file string) (*Config, error) {
+	config := DefaultConfig()
 
-		if CacheConfig.TTL < 1 {
-			logger.Fatal().Msg("CACHE_TTL must be greater than 0")
+	if file != "" {
+		if err := readFile(file, config); err != nil {
+			return nil, err
 		}
+		config.File = file
 	}
 
-	config := &Config{
-		MeilisearchHost:        os.Getenv("MEILISEARCH_HOST"),
-		MeilisearchMasterKey:   os.Getenv("MEILISEARCH_MASTER_KEY"),
-		ProxyMasterKey:         os.Getenv("PROXY_MASTER_KEY"),
-		ProxyPurgeToken:        os.Getenv("PROXY_PURGE_TOKEN"),
-		ProxyMasterKeyOverride: false,
-		Port:                   os.Getenv("PORT"),
-		CacheConfig:            CacheConfig,
-		AutoRestartInterval:    getAutoRestartInterval(),
+	errs := applyEnv(config)
+	config.resolve()
+
+	// before anything is logged, invalid settings included
+	logger.Redact(config.Secrets()...)
+
+	if err := config.Validate(); err != nil {
+		errs = append(errs, err)
 	}
 
-	if config.Port == "" {
-		config.Port = "8080"
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
 	}
 
-	override, err := strconv.ParseBool(os.Getenv("PROXY_MASTER_KEY_OVERRIDE"))
-	if err == nil {
-		config.ProxyMasterKeyOverride = override
+	return config, nil
+}
+
+// readFile decodes a YAML config file over the defaults, unknown settings are refused.
+// Durations are written as 30s or 5m, the cache TTL included, in whole seconds.
+func readFile(path string, config *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
 	}
 
-	if config.ProxyMasterKey == "" && config.ProxyMasterKeyOverride && config.MeilisearchMasterKey == "" {
-		logger.Fatal().Msg("PROXY_MASTER_KEY_OVERRIDE is enabled but PROXY_MASTER_KEY is not set")
+	// the cache TTL is decoded as a duration, 300 would be 300ns rather than 300s
+	var file struct {
+		Cache struct {
+			TTL yaml.Node `yaml:"ttl"`
+		} `yaml:"cache"`
+	}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("error reading %s: %w", path, err)
+	}
+	if ttl := file.Cache.TTL; ttl.Tag == "!!int" {
+		return fmt.Errorf("error reading %s: cache.ttl must be a duration with a unit like 300s or 5m, got %s", path, ttl.Value)
 	}
 
-	// check if the host is reachable
-	if !skipUrlCheck {
-		_, err = http.Get(config.MeilisearchHost)
+	defaultTTL := config.CacheConfig.TTL
 
-		if err != nil {
-			return nil, err
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+
+	if err := decoder.Decode(config); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("error reading %s: %w", path, err)
+	}
+
+	// sections left empty in the file keep their defaults
+	defaults := DefaultConfig()
+	if config.CacheConfig == nil {
+		config.CacheConfig = defaults.CacheConfig
+	}
+	if config.WarmConfig == nil {
+		config.WarmConfig = defaults.WarmConfig
+	}
+	if config.PurgeConfig == nil {
+		config.PurgeConfig = defaults.PurgeConfig
+	}
+	if config.CacheOnlyConfig == nil {
+		config.CacheOnlyConfig = defaults.CacheOnlyConfig
+	}
+	if config.HealthConfig == nil {
+		config.HealthConfig = defaults.HealthConfig
+	}
+	if config.UpstreamConfig == nil {
+		config.UpstreamConfig = defaults.UpstreamConfig
+	}
+	if config.RateLimitConfig == nil {
+		config.RateLimitConfig = defaults.RateLimitConfig
+	}
+	if config.AnalyticsConfig == nil {
+		config.AnalyticsConfig = defaults.AnalyticsConfig
+	}
+	if config.MirrorConfig == nil {
+		config.MirrorConfig = defaults.MirrorConfig
+	}
+	if config.TracingConfig == nil {
+		config.TracingConfig = defaults.TracingConfig
+	}
+	if config.CORSConfig == nil {
+		config.CORSConfig = defaults.CORSConfig
+	}
+	if config.TLSConfig == nil {
+		config.TLSConfig = defaults.TLSConfig
+	}
+	if config.AdminConfig == nil {
+		config.AdminConfig = defaults.AdminConfig
+	}
+	if config.RoutePolicyConfig == nil {
+		config.RoutePolicyConfig = defaults.RoutePolicyConfig
+	}
+
+	// the TTL is kept in seconds, like CACHE_TTL, fractions of a second would be dropped
+	if file.Cache.TTL.IsZero() {
+		config.CacheConfig.TTL = defaultTTL
+	} else if config.CacheConfig.TTL%time.Second != 0 {
+		return fmt.Errorf("error reading %s: cache.ttl must be a whole number of seconds like 300s or 5m, got %s", path, file.Cache.TTL.Value)
+	} else {
+		config.CacheConfig.TTL /= time.Second
+	}
+
+	return nil
+}
+
+// resolve fills the settings that default to other settings
+func (c *Config) resolve() {
+	if c.RateLimitConfig.Store == "redis" && c.RateLimitConfig.Url == "" {
+		c.RateLimitConfig.Url = c.CacheConfig.Url
+	}
+
+	if c.AnalyticsConfig.RedisUrl == "" {
+		for _, sink := range c.AnalyticsConfig.Sinks {
+			if sink == AnalyticsSinkRedis {
+				c.AnalyticsConfig.RedisUrl = c.CacheConfig.Url
+			}
 		}
 	}
 
-	return config, nil
+	if c.MirrorConfig.Host != "" && c.MirrorConfig.ApiKey == "" {
+		c.MirrorConfig.ApiKey = c.MeilisearchMasterKey
+	}
+}
+
+// WatchedFiles are the config file and the files of secrets and certificates, the
+// config is reloaded when they change
+func (c *Config) WatchedFiles() []string {
+	var files []string
+	if c.File != "" {
+		files = append(files, c.File)
+	}
+	files = append(files, c.SecretFiles...)
+
+	if c.TLSConfig != nil && c.TLSConfig.CertFile != "" {
+		files = append(files, c.TLSConfig.CertFile, c.TLSConfig.KeyFile)
+	}
+	if c.UpstreamConfig != nil && c.UpstreamConfig.CertFile != "" {
+		files = append(files, c.UpstreamConfig.CertFile, c.UpstreamConfig.KeyFile)
+	}
+
+	return files
+}
+
+// Secrets returns the keys, tokens and passwords of URLs of the config, masked in logs
+func (c *Config) Secrets() []string {
+	// webhook URLs often carry their token in the path
+	secrets := []string{c.MeilisearchMasterKey, c.ProxyMasterKey, c.ProxyPurgeToken, c.MirrorConfig.ApiKey, c.AnalyticsConfig.WebhookUrl}
+	secrets = append(secrets, c.RateLimitConfig.Keys...)
+	for _, rule := range c.SearchRules {
+		if rule == nil {
+			continue
+		}
+		for key := range rule.KeyFilters {
+			secrets = append(secrets, key)
+		}
+	}
+
+	for _, value := range []string{c.CacheConfig.Url, c.RateLimitConfig.Url, c.AnalyticsConfig.RedisUrl, c.AnalyticsConfig.WebhookUrl} {
+		u, err := url.Parse(value)
+		if err != nil || u.User == nil {
+			continue
+		}
+		if password, ok := u.User.Password(); ok {
+			secrets = append(secrets, password)
+		}
+	}
+
+	return secrets
 }
 
-func getAutoRestartInterval() time.Duration {
-	// os.Getenv("AUTO_RESTART_INTERVAL") is a string (1s, 1m, 1h, etc)
-	interval, err := time.ParseDuration(os.Getenv("AUTO_RESTART_INTERVAL"))
+// loadSearchRules reads the search rules per index from a JSON file
+func loadSearchRules(path string) (map[string]*SearchRule, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+
+	var rules map[string]*SearchRule
+	if err := decoder.Decode(&rules); err != nil {
+		return nil, err
+	}
 
+	return rules, nil
+}
+
+// loadExperiments reads the experiments from a JSON file, by name
+func loadExperiments(path string) (map[string]*Experiment, error) {
+	file, err := os.Open(path)
 	if err != nil {
-		return 0
+		return nil, err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+
+	var experiments map[string]*Experiment
+	if err := decoder.Decode(&experiments); err != nil {
+		return nil, err
 	}
 
-	return interval
+	return experiments, nil
 }
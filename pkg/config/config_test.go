@@ -1,10 +1,15 @@
 package config_test
 
 import (
+	"encoding/json"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	"gopkg.in/yaml.v3"
 
 	"github.com/maxroll-media-group/meilisearch-proxy/pkg/config"
 )
@@ -32,24 +37,283 @@ var _ = Describe("Config", func() {
 				ProxyMasterKeyOverride: false,
 				Port:                   "8080",
 				CacheConfig: &config.CacheConfig{
-					TTL:    300,
-					Engine: "memory",
-					Url:    "",
+					TTL:          300,
+					Engine:       "memory",
+					Url:          "",
+					MaxEntrySize: 5 * 1024 * 1024,
 				},
+				WarmConfig: &config.WarmConfig{
+					TopN:     0,
+					HalfLife: time.Hour,
+					Interval: 0,
+					Rate:     5,
+					OnPurge:  true,
+				},
+				PurgeConfig: &config.PurgeConfig{
+					RequireHealthyUpstream: true,
+					HealthTimeout:          5 * time.Second,
+					Timeout:                30 * time.Second,
+				},
+				CacheOnlyConfig: &config.CacheOnlyConfig{
+					Enabled:      false,
+					MissResponse: config.CacheOnlyMissError,
+					RetryAfter:   time.Minute,
+				},
+				HealthConfig: &config.HealthConfig{
+					ReadinessPolicy: config.ReadinessStale,
+					CheckTimeout:    2 * time.Second,
+				},
+				UpstreamConfig: &config.UpstreamConfig{
+					DialTimeout:           5 * time.Second,
+					TLSHandshakeTimeout:   5 * time.Second,
+					ResponseHeaderTimeout: 10 * time.Second,
+					Timeout:               30 * time.Second,
+					Retries:               2,
+					RetryBackoff:          100 * time.Millisecond,
+					BreakerThreshold:      5,
+					BreakerCooldown:       30 * time.Second,
+					HedgePercentile:       95,
+					HedgeMinDelay:         10 * time.Millisecond,
+					HedgeBudget:           0.05,
+				},
+				RateLimitConfig: &config.RateLimitConfig{
+					By:    config.RateLimitByIP,
+					Store: "memory",
+				},
+				AnalyticsConfig: &config.AnalyticsConfig{
+					RedisStream:   "meilisearch-proxy:analytics",
+					RedisMaxLen:   1000000,
+					BatchSize:     100,
+					FlushInterval: 5 * time.Second,
+					BufferSize:    10000,
+				},
+				MirrorConfig: &config.MirrorConfig{
+					SampleRate:  10,
+					Timeout:     5 * time.Second,
+					Concurrency: 10,
+					PrimaryKey:  "id",
+				},
+				TracingConfig: &config.TracingConfig{
+					Exporter:    config.TracingExporterNone,
+					ServiceName: "meilisearch-proxy",
+					SampleRatio: 1,
+				},
+				CORSConfig:          config.DefaultCORSConfig(),
+				TLSConfig:           &config.TLSConfig{},
+				AdminConfig:         &config.AdminConfig{},
+				RoutePolicyConfig:   &config.RoutePolicyConfig{Preset: "all"},
+				AccessLogSampleRate: 1,
+				ShutdownDelay:       5 * time.Second,
+				ShutdownTimeout:     20 * time.Second,
+				ReloadInterval:      10 * time.Second,
 			}
 
 			Expect(cfg).To(Equal(expectedConfig))
 		})
 	})
 
+	Context("LoadConfig Experiments", func() {
+		It("should load the experiments file", func() {
+			path := filepath.Join(GinkgoT().TempDir(), "experiments.json")
+			Expect(os.WriteFile(path, []byte(`{
+				"ranking": {
+					"index": "products",
+					"header": "X-User-Id",
+					"enabled": true,
+					"variants": [
+						{"name": "control", "weight": 1},
+						{"name": "typo", "weight": 1, "index": "products_exp"}
+					]
+				}
+			}`), 0o600)).To(Succeed())
+			os.Setenv("EXPERIMENTS_FILE", path)
+			os.Setenv("MEILISEARCH_HOST", "http://localhost:7700")
+
+			cfg, err := config.LoadConfig(true)
+
+			Expect(err).To(BeNil())
+			Expect(cfg.Experiments).To(Equal(map[string]*config.Experiment{
+				"ranking": {
+					Index:   "products",
+					Header:  "X-User-Id",
+					Enabled: true,
+					Variants: []config.ExperimentVariant{
+						{Name: "control", Weight: 1},
+						{Name: "typo", Weight: 1, Index: "products_exp"},
+					},
+				},
+			}))
+		})
+	})
+
+	Context("Load", func() {
+		writeFile := func(content string) string {
+			path := filepath.Join(GinkgoT().TempDir(), "config.yaml")
+			Expect(os.WriteFile(path, []byte(content), 0o600)).To(Succeed())
+			return path
+		}
+
+		It("should read the config file, with env vars on top", func() {
+			path := writeFile(`
+meilisearchHost: http://meilisearch:7700
+proxyPurgeToken: purge
+port: 7700
+cache:
+  ttl: 10m
+  engine: redis
+  url: redis://localhost:6379
+rateLimit:
+  rate: 20
+  burst: 40
+searchRules:
+  products:
+    maxLimit: 50
+`)
+			os.Setenv("PORT", "8080")
+
+			cfg, err := config.Load(path)
+
+			Expect(err).To(BeNil())
+			Expect(cfg.File).To(Equal(path))
+			Expect(cfg.MeilisearchHost).To(Equal("http://meilisearch:7700"))
+			Expect(cfg.Port).To(Equal("8080"))
+			Expect(cfg.CacheConfig.TTL).To(Equal(time.Duration(600)))
+			Expect(cfg.CacheConfig.MaxEntrySize).To(Equal(int64(5 * 1024 * 1024)))
+			Expect(cfg.RateLimitConfig).To(Equal(&config.RateLimitConfig{By: config.RateLimitByIP, Store: "memory", Rate: 20, Burst: 40}))
+			Expect(cfg.SearchRules).To(HaveKeyWithValue("products", &config.SearchRule{MaxLimit: 50}))
+			Expect(cfg.UpstreamConfig).To(Equal(config.DefaultUpstreamConfig()))
+		})
+
+		It("should read secrets from files", func() {
+			secret := filepath.Join(GinkgoT().TempDir(), "master-key")
+			Expect(os.WriteFile(secret, []byte("fileMasterKey\n"), 0o600)).To(Succeed())
+			os.Setenv("MEILISEARCH_MASTER_KEY", "masterKey")
+			os.Setenv("MEILISEARCH_MASTER_KEY_FILE", secret)
+			os.Setenv("PROXY_PURGE_TOKEN_FILE", filepath.Join(GinkgoT().TempDir(), "missing"))
+
+			_, err := config.Load("")
+			Expect(err).To(MatchError(ContainSubstring("error reading PROXY_PURGE_TOKEN_FILE")))
+
+			os.Unsetenv("PROXY_PURGE_TOKEN_FILE")
+			path := writeFile("meilisearchHost: http://meilisearch:7700\n")
+
+			cfg, err := config.Load(path)
+
+			Expect(err).To(BeNil())
+			Expect(cfg.MeilisearchMasterKey).To(Equal("fileMasterKey"))
+			Expect(cfg.WatchedFiles()).To(Equal([]string{path, secret}))
+		})
+
+		It("should refuse a cache TTL without a unit", func() {
+			_, err := config.Load(writeFile("cache:\n  ttl: 300\n"))
+
+			Expect(err).To(MatchError(ContainSubstring("cache.ttl must be a duration with a unit like 300s or 5m, got 300")))
+
+			cfg, err := config.Load(writeFile("meilisearchHost: http://meilisearch:7700\ncache:\n  ttl: 300s\n"))
+
+			Expect(err).To(BeNil())
+			Expect(cfg.CacheConfig.TTL).To(Equal(time.Duration(300)))
+		})
+
+		It("should refuse a cache TTL that isn't a whole number of seconds", func() {
+			for _, ttl := range []string{"1500ms", "500ms"} {
+				_, err := config.Load(writeFile("meilisearchHost: http://meilisearch:7700\ncache:\n  ttl: " + ttl + "\n"))
+
+				Expect(err).To(MatchError(ContainSubstring("cache.ttl must be a whole number of seconds like 300s or 5m, got " + ttl)))
+			}
+		})
+
+		It("should load the sample config, whose settings are all in the schema", func() {
+			_, err := config.Load("../../config.sample.yaml")
+			Expect(err).To(BeNil())
+
+			data, err := os.ReadFile("../../config.schema.json")
+			Expect(err).To(BeNil())
+			var schema map[string]interface{}
+			Expect(json.Unmarshal(data, &schema)).To(Succeed())
+
+			data, err = os.ReadFile("../../config.sample.yaml")
+			Expect(err).To(BeNil())
+			var sample map[string]interface{}
+			Expect(yaml.Unmarshal(data, &sample)).To(Succeed())
+
+			// expectInSchema checks that the keys of a section, and of its subsections, are described
+			var expectInSchema func(section map[string]interface{}, properties map[string]interface{}, prefix string)
+			expectInSchema = func(section map[string]interface{}, properties map[string]interface{}, prefix string) {
+				for key, value := range section {
+					Expect(properties).To(HaveKey(key), prefix+key)
+
+					property := properties[key].(map[string]interface{})
+					if ref, ok := property["$ref"].(string); ok {
+						property = schema["definitions"].(map[string]interface{})[strings.TrimPrefix(ref, "#/definitions/")].(map[string]interface{})
+					}
+					if subsection, ok := value.(map[string]interface{}); ok && property["properties"] != nil {
+						expectInSchema(subsection, property["properties"].(map[string]interface{}), prefix+key+".")
+					}
+				}
+			}
+			expectInSchema(sample, schema["properties"].(map[string]interface{}), "")
+		})
+
+		It("should refuse unknown settings", func() {
+			_, err := config.Load(writeFile("cache:\n  tll: 10m\n"))
+
+			Expect(err).To(MatchError(ContainSubstring("field tll not found")))
+		})
+
+		It("should return all the invalid settings", func() {
+			path := writeFile(`
+meilisearchHost: meilisearch:7700
+cache:
+  engine: redis
+upstream:
+  hedgePercentile: 120
+tls:
+  certFile: proxy.pem
+admin:
+  listen: "8080"
+routePolicy:
+  preset: read-write
+rateLimit:
+  by: api_key
+cors:
+  public:
+    allowedOrigins: ["*"]
+    allowCredentials: true
+  admin:
+    allowedOrigins: [admin.example.com]
+`)
+			os.Setenv("CACHE_TTL", "ten")
+
+			_, err := config.Load(path)
+
+			Expect(err).To(HaveOccurred())
+			Expect(strings.Split(err.Error(), "\n")).To(ConsistOf(
+				"CACHE_TTL must be an integer",
+				`meilisearchHost (MEILISEARCH_HOST) must be a URL like http://meilisearch:7700, got "meilisearch:7700"`,
+				"cache.url (CACHE_URL) is required when using Redis cache",
+				"upstream.hedgePercentile (UPSTREAM_HEDGE_PERCENTILE) must be a number between 0 and 100",
+				"tls.certFile (TLS_CERT_FILE) and tls.keyFile (TLS_KEY_FILE) must be set together",
+				"admin.listen (ADMIN_LISTEN) must be another port than port (PORT)",
+				`routePolicy (ROUTE_POLICY, ROUTE_POLICY_ALLOW and ROUTE_POLICY_DENY) is invalid: unknown preset "read-write", must be all, read-only or search-only`,
+				"rateLimit.keys (RATE_LIMIT_KEYS) is required when rateLimit.by (RATE_LIMIT_BY) is api_key or tenant",
+				"cors.public.allowCredentials (CORS_ALLOW_CREDENTIALS) can't be used when any origin is allowed with *",
+				`cors.admin.allowedOrigins (ADMIN_CORS_ALLOWED_ORIGINS) must be *, or origins like https://example.com or https://*.example.com, got "admin.example.com"`,
+			))
+		})
+	})
+
 	// cleanup env vars
 	AfterEach(func() {
 		os.Unsetenv("CACHE_ENGINE")
 		os.Unsetenv("CACHE_TTL")
 		os.Unsetenv("MEILISEARCH_HOST")
 		os.Unsetenv("MEILISEARCH_MASTER_KEY")
+		os.Unsetenv("MEILISEARCH_MASTER_KEY_FILE")
+		os.Unsetenv("PROXY_PURGE_TOKEN_FILE")
 		os.Unsetenv("PROXY_MASTER_KEY")
 		os.Unsetenv("PORT")
+		os.Unsetenv("EXPERIMENTS_FILE")
 
 	})
 
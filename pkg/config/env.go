@@ -0,0 +1,297 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// envReader sets the settings of the env vars that are set, and collects the ones
+// that can't be parsed
+type envReader struct {
+	errs []error
+	// files are the files secrets were read from
+	files []string
+}
+
+func (e *envReader) fail(format string, args ...interface{}) {
+	e.errs = append(e.errs, fmt.Errorf(format, args...))
+}
+
+func (e *envReader) string(name string, value *string) {
+	if os.Getenv(name) != "" {
+		*value = os.Getenv(name)
+	}
+}
+
+func (e *envReader) int(name string, value *int) {
+	if os.Getenv(name) == "" {
+		return
+	}
+
+	n, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		e.fail("%s must be an integer", name)
+		return
+	}
+	*value = n
+}
+
+func (e *envReader) int64(name string, value *int64) {
+	if os.Getenv(name) == "" {
+		return
+	}
+
+	n, err := strconv.ParseInt(os.Getenv(name), 10, 64)
+	if err != nil {
+		e.fail("%s must be an integer", name)
+		return
+	}
+	*value = n
+}
+
+func (e *envReader) float(name string, value *float64) {
+	if os.Getenv(name) == "" {
+		return
+	}
+
+	f, err := strconv.ParseFloat(os.Getenv(name), 64)
+	if err != nil {
+		e.fail("%s must be a number", name)
+		return
+	}
+	*value = f
+}
+
+func (e *envReader) bool(name string, value *bool) {
+	if os.Getenv(name) == "" {
+		return
+	}
+
+	b, err := strconv.ParseBool(os.Getenv(name))
+	if err != nil {
+		e.fail("%s must be true or false", name)
+		return
+	}
+	*value = b
+}
+
+func (e *envReader) duration(name string, value *time.Duration) {
+	if os.Getenv(name) == "" {
+		return
+	}
+
+	d, err := time.ParseDuration(os.Getenv(name))
+	if err != nil {
+		e.fail("%s must be a duration (5s, 1m, etc)", name)
+		return
+	}
+	*value = d
+}
+
+// secret reads a secret from the file set by NAME_FILE, like Kubernetes secret mounts
+// and Docker secrets, or from NAME
+func (e *envReader) secret(name string, value *string) {
+	file := os.Getenv(name + "_FILE")
+	if file == "" {
+		e.string(name, value)
+		return
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		e.fail("error reading %s_FILE: %w", name, err)
+		return
+	}
+
+	*value = strings.TrimRight(string(data), "\r\n")
+	e.files = append(e.files, file)
+}
+
+// secretList reads a comma separated list of secrets, from NAME_FILE or NAME like secret
+func (e *envReader) secretList(name string, value *[]string) {
+	var secrets string
+	e.secret(name, &secrets)
+	if secrets == "" {
+		return
+	}
+
+	*value = nil
+	for _, item := range strings.Split(secrets, ",") {
+		*value = append(*value, strings.TrimSpace(item))
+	}
+}
+
+// list reads a comma separated list
+func (e *envReader) list(name string, value *[]string) {
+	if os.Getenv(name) == "" {
+		return
+	}
+
+	*value = nil
+	for _, item := range strings.Split(os.Getenv(name), ",") {
+		*value = append(*value, strings.TrimSpace(item))
+	}
+}
+
+// corsPolicy reads the PREFIX_ALLOWED_ORIGINS, etc, of a CORS policy
+func (e *envReader) corsPolicy(prefix string, policy *CORSPolicy) {
+	e.list(prefix+"_ALLOWED_ORIGINS", &policy.AllowedOrigins)
+	e.bool(prefix+"_ALLOW_CREDENTIALS", &policy.AllowCredentials)
+	e.list(prefix+"_ALLOWED_METHODS", &policy.AllowedMethods)
+	e.list(prefix+"_ALLOWED_HEADERS", &policy.AllowedHeaders)
+	e.list(prefix+"_EXPOSED_HEADERS", &policy.ExposedHeaders)
+	e.duration(prefix+"_MAX_AGE", &policy.MaxAge)
+}
+
+// applyEnv overrides the settings of the config file with the env vars that are set
+func applyEnv(config *Config) []error {
+	env := &envReader{}
+
+	env.string("MEILISEARCH_HOST", &config.MeilisearchHost)
+	env.secret("MEILISEARCH_MASTER_KEY", &config.MeilisearchMasterKey)
+	env.secret("PROXY_MASTER_KEY", &config.ProxyMasterKey)
+	env.bool("PROXY_MASTER_KEY_OVERRIDE", &config.ProxyMasterKeyOverride)
+	env.secret("PROXY_PURGE_TOKEN", &config.ProxyPurgeToken)
+	env.string("PORT", &config.Port)
+
+	cache := config.CacheConfig
+	env.string("CACHE_ENGINE", &cache.Engine)
+	env.secret("CACHE_URL", &cache.Url)
+	env.int64("CACHE_MAX_ENTRY_SIZE", &cache.MaxEntrySize)
+	env.duration("CACHE_STALE_TTL", &cache.StaleTTL)
+
+	ttl := int64(cache.TTL)
+	env.int64("CACHE_TTL", &ttl)
+	cache.TTL = time.Duration(ttl)
+
+	upstream := config.UpstreamConfig
+	env.duration("UPSTREAM_DIAL_TIMEOUT", &upstream.DialTimeout)
+	env.duration("UPSTREAM_TLS_TIMEOUT", &upstream.TLSHandshakeTimeout)
+	env.duration("UPSTREAM_HEADER_TIMEOUT", &upstream.ResponseHeaderTimeout)
+	env.duration("UPSTREAM_TIMEOUT", &upstream.Timeout)
+	env.int("UPSTREAM_RETRIES", &upstream.Retries)
+	env.duration("UPSTREAM_RETRY_BACKOFF", &upstream.RetryBackoff)
+	env.int("UPSTREAM_BREAKER_THRESHOLD", &upstream.BreakerThreshold)
+	env.duration("UPSTREAM_BREAKER_COOLDOWN", &upstream.BreakerCooldown)
+	env.list("MEILISEARCH_REPLICAS", &upstream.Replicas)
+	env.float("UPSTREAM_HEDGE_PERCENTILE", &upstream.HedgePercentile)
+	env.duration("UPSTREAM_HEDGE_MIN_DELAY", &upstream.HedgeMinDelay)
+	env.float("UPSTREAM_HEDGE_BUDGET", &upstream.HedgeBudget)
+	env.string("UPSTREAM_CA_FILE", &upstream.CAFile)
+	env.string("UPSTREAM_CERT_FILE", &upstream.CertFile)
+	env.string("UPSTREAM_KEY_FILE", &upstream.KeyFile)
+	env.string("UPSTREAM_SERVER_NAME", &upstream.ServerName)
+	env.bool("UPSTREAM_INSECURE_SKIP_VERIFY", &upstream.InsecureSkipVerify)
+
+	env.string("TLS_CERT_FILE", &config.TLSConfig.CertFile)
+	env.string("TLS_KEY_FILE", &config.TLSConfig.KeyFile)
+	env.string("ADMIN_LISTEN", &config.AdminConfig.Listen)
+
+	routePolicy := config.RoutePolicyConfig
+	env.string("ROUTE_POLICY", &routePolicy.Preset)
+	env.list("ROUTE_POLICY_ALLOW", &routePolicy.Allow)
+	env.list("ROUTE_POLICY_DENY", &routePolicy.Deny)
+
+	rateLimit := config.RateLimitConfig
+	env.string("RATE_LIMIT_BY", &rateLimit.By)
+	env.string("RATE_LIMIT_STORE", &rateLimit.Store)
+	env.secret("RATE_LIMIT_URL", &rateLimit.Url)
+	env.float("RATE_LIMIT_RATE", &rateLimit.Rate)
+	env.int("RATE_LIMIT_BURST", &rateLimit.Burst)
+	env.float("RATE_LIMIT_MISS_RATE", &rateLimit.MissRate)
+	env.int("RATE_LIMIT_MISS_BURST", &rateLimit.MissBurst)
+	env.list("RATE_LIMIT_TRUSTED_PROXIES", &rateLimit.TrustedProxies)
+	env.secretList("RATE_LIMIT_KEYS", &rateLimit.Keys)
+
+	analytics := config.AnalyticsConfig
+	env.bool("ANALYTICS_ENABLED", &analytics.Enabled)
+	env.list("ANALYTICS_SINKS", &analytics.Sinks)
+	env.string("ANALYTICS_FILE", &analytics.File)
+	env.secret("ANALYTICS_REDIS_URL", &analytics.RedisUrl)
+	env.string("ANALYTICS_REDIS_STREAM", &analytics.RedisStream)
+	env.secret("ANALYTICS_WEBHOOK_URL", &analytics.WebhookUrl)
+	env.int("ANALYTICS_BATCH_SIZE", &analytics.BatchSize)
+	env.duration("ANALYTICS_FLUSH_INTERVAL", &analytics.FlushInterval)
+
+	mirror := config.MirrorConfig
+	env.string("MIRROR_HOST", &mirror.Host)
+	env.secret("MIRROR_API_KEY", &mirror.ApiKey)
+	env.float("MIRROR_SAMPLE_RATE", &mirror.SampleRate)
+	env.duration("MIRROR_TIMEOUT", &mirror.Timeout)
+	env.int("MIRROR_CONCURRENCY", &mirror.Concurrency)
+	env.string("MIRROR_PRIMARY_KEY", &mirror.PrimaryKey)
+
+	tracing := config.TracingConfig
+	env.string("TRACING_EXPORTER", &tracing.Exporter)
+	env.string("TRACING_ENDPOINT", &tracing.Endpoint)
+	env.string("TRACING_SERVICE_NAME", &tracing.ServiceName)
+	env.float("TRACING_SAMPLE_RATIO", &tracing.SampleRatio)
+
+	env.corsPolicy("CORS", &config.CORSConfig.Public)
+	env.corsPolicy("ADMIN_CORS", &config.CORSConfig.Admin)
+
+	env.float("ACCESS_LOG_SAMPLE_RATE", &config.AccessLogSampleRate)
+
+	if os.Getenv("SEARCH_RULES_FILE") != "" {
+		rules, err := loadSearchRules(os.Getenv("SEARCH_RULES_FILE"))
+		if err != nil {
+			env.fail("error loading SEARCH_RULES_FILE: %w", err)
+		} else {
+			config.SearchRules = rules
+		}
+	}
+
+	if os.Getenv("EXPERIMENTS_FILE") != "" {
+		experiments, err := loadExperiments(os.Getenv("EXPERIMENTS_FILE"))
+		if err != nil {
+			env.fail("error loading EXPERIMENTS_FILE: %w", err)
+		} else {
+			config.Experiments = experiments
+		}
+	}
+
+	if os.Getenv("INDEX_ALIASES") != "" {
+		config.IndexAliases = make(map[string]string)
+		for _, pair := range strings.Split(os.Getenv("INDEX_ALIASES"), ",") {
+			alias, index, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok {
+				env.fail("INDEX_ALIASES must be a comma separated list of alias=index, got %q", pair)
+				continue
+			}
+			config.IndexAliases[alias] = index
+		}
+	}
+
+	warm := config.WarmConfig
+	env.int("WARM_TOP_N", &warm.TopN)
+	env.duration("WARM_HALF_LIFE", &warm.HalfLife)
+	env.duration("WARM_INTERVAL", &warm.Interval)
+	env.int("WARM_RATE", &warm.Rate)
+	env.bool("WARM_ON_PURGE", &warm.OnPurge)
+
+	purge := config.PurgeConfig
+	env.bool("PURGE_REQUIRE_HEALTHY_UPSTREAM", &purge.RequireHealthyUpstream)
+	env.duration("PURGE_HEALTH_TIMEOUT", &purge.HealthTimeout)
+	env.duration("PURGE_TIMEOUT", &purge.Timeout)
+
+	cacheOnly := config.CacheOnlyConfig
+	env.bool("CACHE_ONLY", &cacheOnly.Enabled)
+	env.string("CACHE_ONLY_MISS_RESPONSE", &cacheOnly.MissResponse)
+	env.duration("CACHE_ONLY_RETRY_AFTER", &cacheOnly.RetryAfter)
+
+	health := config.HealthConfig
+	env.string("READINESS_POLICY", &health.ReadinessPolicy)
+	env.duration("READINESS_CHECK_TIMEOUT", &health.CheckTimeout)
+
+	env.duration("AUTO_RESTART_INTERVAL", &config.AutoRestartInterval)
+	env.duration("SHUTDOWN_DELAY", &config.ShutdownDelay)
+	env.duration("SHUTDOWN_TIMEOUT", &config.ShutdownTimeout)
+	env.duration("CONFIG_RELOAD_INTERVAL", &config.ReloadInterval)
+
+	config.SecretFiles = env.files
+
+	return env.errs
+}
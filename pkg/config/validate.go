@@ -0,0 +1,211 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/routepolicy"
+)
+
+// validator collects the invalid settings of a config. Settings are named by their
+// key in the config file, followed by their env var.
+type validator struct {
+	errs []error
+}
+
+func (v *validator) check(ok bool, format string, args ...interface{}) {
+	if !ok {
+		v.errs = append(v.errs, fmt.Errorf(format, args...))
+	}
+}
+
+func isURL(value string) bool {
+	u, err := url.Parse(value)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// Validate returns all the invalid settings of the config, joined
+func (c *Config) Validate() error {
+	v := &validator{}
+
+	v.check(c.MeilisearchHost != "", "meilisearchHost (MEILISEARCH_HOST) is required")
+	v.check(c.MeilisearchHost == "" || isURL(c.MeilisearchHost),
+		"meilisearchHost (MEILISEARCH_HOST) must be a URL like http://meilisearch:7700, got %q", c.MeilisearchHost)
+
+	v.check(!c.ProxyMasterKeyOverride || c.ProxyMasterKey != "" || c.MeilisearchMasterKey != "",
+		"proxyMasterKeyOverride (PROXY_MASTER_KEY_OVERRIDE) is enabled but proxyMasterKey (PROXY_MASTER_KEY) is not set")
+
+	cache := c.CacheConfig
+	v.check(cache.Engine == "memory" || cache.Engine == "redis", "cache.engine (CACHE_ENGINE) must be either memory or redis")
+	v.check(cache.Engine != "redis" || cache.Url != "", "cache.url (CACHE_URL) is required when using Redis cache")
+	v.check(cache.TTL >= 1, "cache.ttl (CACHE_TTL) must be greater than 0")
+	v.check(cache.MaxEntrySize >= 0, "cache.maxEntrySize (CACHE_MAX_ENTRY_SIZE) must be a positive number of bytes")
+	v.check(cache.StaleTTL >= 0, "cache.staleTtl (CACHE_STALE_TTL) must be a positive duration")
+
+	upstream := c.UpstreamConfig
+	for name, duration := range map[string]time.Duration{
+		"upstream.dialTimeout (UPSTREAM_DIAL_TIMEOUT)":             upstream.DialTimeout,
+		"upstream.tlsHandshakeTimeout (UPSTREAM_TLS_TIMEOUT)":      upstream.TLSHandshakeTimeout,
+		"upstream.responseHeaderTimeout (UPSTREAM_HEADER_TIMEOUT)": upstream.ResponseHeaderTimeout,
+		"upstream.timeout (UPSTREAM_TIMEOUT)":                      upstream.Timeout,
+		"upstream.retryBackoff (UPSTREAM_RETRY_BACKOFF)":           upstream.RetryBackoff,
+		"upstream.breakerCooldown (UPSTREAM_BREAKER_COOLDOWN)":     upstream.BreakerCooldown,
+		"upstream.hedgeMinDelay (UPSTREAM_HEDGE_MIN_DELAY)":        upstream.HedgeMinDelay,
+	} {
+		v.check(duration >= 0, "%s must be a positive duration", name)
+	}
+	v.check(upstream.Retries >= 0, "upstream.retries (UPSTREAM_RETRIES) must be a positive integer")
+	v.check(upstream.BreakerThreshold >= 0, "upstream.breakerThreshold (UPSTREAM_BREAKER_THRESHOLD) must be a positive integer, 0 disables the breaker")
+	for _, replica := range upstream.Replicas {
+		v.check(isURL(replica), "upstream.replicas (MEILISEARCH_REPLICAS) must be URLs, got %q", replica)
+	}
+	v.check(upstream.HedgePercentile > 0 && upstream.HedgePercentile < 100, "upstream.hedgePercentile (UPSTREAM_HEDGE_PERCENTILE) must be a number between 0 and 100")
+	v.check((upstream.CertFile == "") == (upstream.KeyFile == ""), "upstream.certFile (UPSTREAM_CERT_FILE) and upstream.keyFile (UPSTREAM_KEY_FILE) must be set together")
+	v.check(upstream.HedgeBudget >= 0 && upstream.HedgeBudget <= 1, "upstream.hedgeBudget (UPSTREAM_HEDGE_BUDGET) must be a fraction between 0 and 1, 0 disables hedging")
+
+	rateLimit := c.RateLimitConfig
+	switch rateLimit.By {
+	case RateLimitByIP, RateLimitByAPIKey, RateLimitByTenant:
+	default:
+		v.check(false, "rateLimit.by (RATE_LIMIT_BY) must be one of ip, api_key or tenant")
+	}
+	v.check(rateLimit.By == RateLimitByIP || len(rateLimit.Keys) > 0, "rateLimit.keys (RATE_LIMIT_KEYS) is required when rateLimit.by (RATE_LIMIT_BY) is api_key or tenant")
+	v.check(rateLimit.Store == "memory" || rateLimit.Store == "redis", "rateLimit.store (RATE_LIMIT_STORE) must be either memory or redis")
+	v.check(rateLimit.Store != "redis" || rateLimit.Url != "", "rateLimit.url (RATE_LIMIT_URL) or cache.url (CACHE_URL) is required when using the redis rate limit store")
+	v.check(rateLimit.Rate >= 0, "rateLimit.rate (RATE_LIMIT_RATE) must be a positive number of requests per second, 0 disables it")
+	v.check(rateLimit.MissRate >= 0, "rateLimit.missRate (RATE_LIMIT_MISS_RATE) must be a positive number of requests per second, 0 disables it")
+	v.check(rateLimit.Burst >= 0, "rateLimit.burst (RATE_LIMIT_BURST) must be a positive integer")
+	v.check(rateLimit.MissBurst >= 0, "rateLimit.missBurst (RATE_LIMIT_MISS_BURST) must be a positive integer")
+	for _, cidr := range rateLimit.TrustedProxies {
+		_, _, err := net.ParseCIDR(cidr)
+		v.check(err == nil, "rateLimit.trustedProxies (RATE_LIMIT_TRUSTED_PROXIES) must be CIDRs, got %q", cidr)
+	}
+
+	analytics := c.AnalyticsConfig
+	for _, sink := range analytics.Sinks {
+		switch sink {
+		case AnalyticsSinkFile:
+			v.check(analytics.File != "", "analytics.file (ANALYTICS_FILE) is required when using the file analytics sink")
+		case AnalyticsSinkStdout:
+		case AnalyticsSinkRedis:
+			v.check(analytics.RedisUrl != "", "analytics.redisUrl (ANALYTICS_REDIS_URL) or cache.url (CACHE_URL) is required when using the redis analytics sink")
+		case AnalyticsSinkWebhook:
+			v.check(analytics.WebhookUrl != "", "analytics.webhookUrl (ANALYTICS_WEBHOOK_URL) is required when using the webhook analytics sink")
+		default:
+			v.check(false, "analytics.sinks (ANALYTICS_SINKS) must be file, stdout, redis or webhook, got %q", sink)
+		}
+	}
+	v.check(analytics.BatchSize >= 1, "analytics.batchSize (ANALYTICS_BATCH_SIZE) must be an integer greater than 0")
+	v.check(analytics.FlushInterval > 0, "analytics.flushInterval (ANALYTICS_FLUSH_INTERVAL) must be a positive duration")
+
+	mirror := c.MirrorConfig
+	v.check(mirror.Host == "" || isURL(mirror.Host), "mirror.host (MIRROR_HOST) must be a URL, got %q", mirror.Host)
+	v.check(mirror.SampleRate >= 0 && mirror.SampleRate <= 100, "mirror.sampleRate (MIRROR_SAMPLE_RATE) must be a percentage between 0 and 100")
+	v.check(mirror.Timeout > 0, "mirror.timeout (MIRROR_TIMEOUT) must be a positive duration")
+	v.check(mirror.Concurrency >= 1, "mirror.concurrency (MIRROR_CONCURRENCY) must be an integer greater than 0")
+
+	tracing := c.TracingConfig
+	switch tracing.Exporter {
+	case TracingExporterNone, TracingExporterOTLP, TracingExporterStdout:
+	default:
+		v.check(false, "tracing.exporter (TRACING_EXPORTER) must be none, otlp or stdout")
+	}
+	v.check(tracing.Endpoint == "" || isURL(tracing.Endpoint), "tracing.endpoint (TRACING_ENDPOINT) must be a URL, got %q", tracing.Endpoint)
+	v.check(tracing.SampleRatio >= 0 && tracing.SampleRatio <= 1, "tracing.sampleRatio (TRACING_SAMPLE_RATIO) must be a fraction between 0 and 1")
+
+	v.check((c.TLSConfig.CertFile == "") == (c.TLSConfig.KeyFile == ""), "tls.certFile (TLS_CERT_FILE) and tls.keyFile (TLS_KEY_FILE) must be set together")
+
+	if listen := c.AdminConfig.Listen; listen != "" && !strings.HasPrefix(listen, "unix:") {
+		_, port, err := net.SplitHostPort(listen)
+		if err != nil {
+			port = listen
+		}
+		_, err = strconv.Atoi(port)
+		v.check(err == nil, "admin.listen (ADMIN_LISTEN) must be a port, an address or unix: followed by the path of a socket, got %q", listen)
+		v.check(port != c.Port, "admin.listen (ADMIN_LISTEN) must be another port than port (PORT)")
+	}
+
+	routePolicy := c.RoutePolicyConfig
+	_, err := routepolicy.New(routePolicy.Preset, routePolicy.Allow, routePolicy.Deny)
+	v.check(err == nil, "routePolicy (ROUTE_POLICY, ROUTE_POLICY_ALLOW and ROUTE_POLICY_DENY) is invalid: %v", err)
+
+	validateCORSPolicy(v, "cors.public", "CORS", c.CORSConfig.Public)
+	validateCORSPolicy(v, "cors.admin", "ADMIN_CORS", c.CORSConfig.Admin)
+
+	v.check(c.AccessLogSampleRate >= 0 && c.AccessLogSampleRate <= 1, "accessLogSampleRate (ACCESS_LOG_SAMPLE_RATE) must be a fraction between 0 and 1, 0 disables the access log")
+
+	for alias, index := range c.IndexAliases {
+		v.check(alias != "" && index != "" && alias != index, "indexAliases (INDEX_ALIASES) must map aliases to other indexes, got %q to %q", alias, index)
+	}
+
+	c.validateExperiments(v)
+
+	warm := c.WarmConfig
+	v.check(warm.TopN >= 0, "warm.topN (WARM_TOP_N) must be a positive integer")
+	v.check(warm.HalfLife > 0, "warm.halfLife (WARM_HALF_LIFE) must be a positive duration (30m, 1h, etc)")
+	v.check(warm.Interval >= 0, "warm.interval (WARM_INTERVAL) must be a positive duration (30m, 1h, etc)")
+	v.check(warm.Rate >= 1, "warm.rate (WARM_RATE) must be an integer greater than 0")
+
+	purge := c.PurgeConfig
+	v.check(purge.HealthTimeout > 0, "purge.healthTimeout (PURGE_HEALTH_TIMEOUT) must be a positive duration (5s, 1m, etc)")
+	v.check(purge.Timeout > 0, "purge.timeout (PURGE_TIMEOUT) must be a positive duration (30s, 1m, etc)")
+
+	cacheOnly := c.CacheOnlyConfig
+	v.check(cacheOnly.MissResponse == CacheOnlyMissError || cacheOnly.MissResponse == CacheOnlyMissEmpty, "cacheOnly.missResponse (CACHE_ONLY_MISS_RESPONSE) must be either error or empty")
+	v.check(cacheOnly.RetryAfter >= time.Second, "cacheOnly.retryAfter (CACHE_ONLY_RETRY_AFTER) must be a duration of at least 1s")
+
+	health := c.HealthConfig
+	v.check(health.ReadinessPolicy == ReadinessStrict || health.ReadinessPolicy == ReadinessStale, "health.readinessPolicy (READINESS_POLICY) must be either strict or stale")
+	v.check(health.CheckTimeout > 0, "health.checkTimeout (READINESS_CHECK_TIMEOUT) must be a positive duration (2s, 500ms, etc)")
+
+	v.check(c.AutoRestartInterval >= 0, "autoRestartInterval (AUTO_RESTART_INTERVAL) must be a positive duration")
+	v.check(c.ShutdownDelay >= 0, "shutdownDelay (SHUTDOWN_DELAY) must be a positive duration")
+	v.check(c.ShutdownTimeout >= 0, "shutdownTimeout (SHUTDOWN_TIMEOUT) must be a positive duration")
+	v.check(c.ReloadInterval >= 0, "reloadInterval (CONFIG_RELOAD_INTERVAL) must be a positive duration, 0 only reloads on SIGHUP")
+
+	return errors.Join(v.errs...)
+}
+
+// corsOrigin matches the origins of CORS policies, with an optional subdomain wildcard
+var corsOrigin = regexp.MustCompile(`^https?://(\*\.)?[a-zA-Z0-9.-]+(:[0-9]+)?$`)
+
+func validateCORSPolicy(v *validator, key string, env string, policy CORSPolicy) {
+	for _, origin := range policy.AllowedOrigins {
+		v.check(origin == "*" || corsOrigin.MatchString(origin), "%s.allowedOrigins (%s_ALLOWED_ORIGINS) must be *, or origins like https://example.com or https://*.example.com, got %q", key, env, origin)
+		v.check(origin != "*" || !policy.AllowCredentials, "%s.allowCredentials (%s_ALLOW_CREDENTIALS) can't be used when any origin is allowed with *", key, env)
+	}
+	v.check(policy.MaxAge >= 0, "%s.maxAge (%s_MAX_AGE) must be a positive duration", key, env)
+}
+
+func (c *Config) validateExperiments(v *validator) {
+	indexes := make(map[string]string)
+
+	for name, experiment := range c.Experiments {
+		if experiment.Index == "" {
+			v.check(false, "experiment %s has no index", name)
+			continue
+		}
+		if other, ok := indexes[experiment.Index]; ok {
+			v.check(false, "experiments %s and %s split the same index %s", name, other, experiment.Index)
+		}
+		indexes[experiment.Index] = name
+
+		v.check(experiment.Header != "" || experiment.Cookie != "", "experiment %s needs a header or a cookie to identify clients", name)
+		v.check(len(experiment.Variants) > 0, "experiment %s has no variants", name)
+
+		variants := make(map[string]bool)
+		for _, variant := range experiment.Variants {
+			v.check(variant.Name != "" && !variants[variant.Name], "variants of experiment %s must have unique names", name)
+			variants[variant.Name] = true
+
+			v.check(variant.Weight >= 1, "variant %s of experiment %s must have a weight greater than 0", variant.Name, name)
+			v.check(variant.Host == "" || isURL(variant.Host), "host of variant %s of experiment %s must be a URL, got %q", variant.Name, name, variant.Host)
+		}
+	}
+}
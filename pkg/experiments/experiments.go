@@ -0,0 +1,234 @@
+package experiments
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Assignment is the variant of an experiment a search was assigned to
+type Assignment struct {
+	Experiment string
+	Variant    string
+	// Index and Host are where the search goes, empty when the variant keeps them
+	Index string
+	Host  string
+}
+
+// Status is an experiment and whether it is running
+type Status struct {
+	Name     string                     `json:"name"`
+	Index    string                     `json:"index"`
+	Header   string                     `json:"header,omitempty"`
+	Cookie   string                     `json:"cookie,omitempty"`
+	Enabled  bool                       `json:"enabled"`
+	Variants []config.ExperimentVariant `json:"variants"`
+}
+
+type experiment struct {
+	name        string
+	config      *config.Experiment
+	enabled     bool
+	totalWeight int
+}
+
+// Experiments assigns clients to the variants of the experiments of their indexes.
+// Whether an experiment is running can be changed at runtime.
+type Experiments struct {
+	mu          sync.RWMutex
+	experiments map[string]*experiment
+	// byIndex maps the index of each experiment to its name
+	byIndex map[string]string
+
+	searches    *prometheus.CounterVec
+	zeroResults *prometheus.CounterVec
+	duration    *prometheus.HistogramVec
+}
+
+// New creates the experiments of the config and registers their metrics
+func New(cfg map[string]*config.Experiment, registerer prometheus.Registerer) (*Experiments, error) {
+	e := &Experiments{
+		experiments: make(map[string]*experiment, len(cfg)),
+		byIndex:     make(map[string]string, len(cfg)),
+		searches: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "meilisearch_proxy",
+			Subsystem: "experiment",
+			Name:      "searches_total",
+			Help:      "Searches of experiments by variant and cache status: hit, miss or stale.",
+		}, []string{"experiment", "variant", "cache"}),
+		zeroResults: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "meilisearch_proxy",
+			Subsystem: "experiment",
+			Name:      "zero_results_total",
+			Help:      "Searches of experiments without any hit, by variant.",
+		}, []string{"experiment", "variant"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "meilisearch_proxy",
+			Subsystem: "experiment",
+			Name:      "search_duration_seconds",
+			Help:      "Duration of the searches of experiments, by variant.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"experiment", "variant"}),
+	}
+
+	for name, experimentConfig := range cfg {
+		total := 0
+		for _, variant := range experimentConfig.Variants {
+			total += variant.Weight
+		}
+
+		e.experiments[name] = &experiment{name: name, config: experimentConfig, enabled: experimentConfig.Enabled, totalWeight: total}
+		e.byIndex[experimentConfig.Index] = name
+	}
+
+	for _, collector := range []prometheus.Collector{e.searches, e.zeroResults, e.duration} {
+		if err := registerer.Register(collector); err != nil {
+			return nil, err
+		}
+	}
+
+	return e, nil
+}
+
+// Assign returns the variant of the client of a search to the first of the indexes
+// with a running experiment. Clients without the header or cookie of the experiment
+// are not assigned.
+func (e *Experiments) Assign(r *http.Request, indexes ...string) (Assignment, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	for _, index := range indexes {
+		name, ok := e.byIndex[index]
+		if !ok {
+			continue
+		}
+
+		experiment := e.experiments[name]
+		if !experiment.enabled || experiment.totalWeight == 0 {
+			return Assignment{}, false
+		}
+
+		client := clientID(r, experiment.config)
+		if client == "" {
+			return Assignment{}, false
+		}
+
+		// the experiment name is part of the hash so clients are shuffled between experiments
+		sum := sha256.Sum256([]byte(name + "\x00" + client))
+		bucket := int(binary.BigEndian.Uint64(sum[:8]) % uint64(experiment.totalWeight))
+
+		for _, variant := range experiment.config.Variants {
+			if bucket < variant.Weight {
+				return Assignment{Experiment: name, Variant: variant.Name, Index: variant.Index, Host: variant.Host}, true
+			}
+			bucket -= variant.Weight
+		}
+	}
+
+	return Assignment{}, false
+}
+
+func clientID(r *http.Request, cfg *config.Experiment) string {
+	if cfg.Header != "" {
+		if id := r.Header.Get(cfg.Header); id != "" {
+			return id
+		}
+	}
+
+	if cfg.Cookie != "" {
+		if cookie, err := r.Cookie(cfg.Cookie); err == nil {
+			return cookie.Value
+		}
+	}
+
+	return ""
+}
+
+// SetEnabled starts or stops an experiment, it returns false when there is no such experiment
+func (e *Experiments) SetEnabled(name string, enabled bool) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	experiment, ok := e.experiments[name]
+	if ok {
+		experiment.enabled = enabled
+	}
+
+	return ok
+}
+
+// Get returns the status of an experiment
+func (e *Experiments) Get(name string) (Status, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	experiment, ok := e.experiments[name]
+	if !ok {
+		return Status{}, false
+	}
+
+	return experiment.status(), true
+}
+
+// All returns the status of every experiment, by name
+func (e *Experiments) All() []Status {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	statuses := make([]Status, 0, len(e.experiments))
+	for _, experiment := range e.experiments {
+		statuses = append(statuses, experiment.status())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+
+	return statuses
+}
+
+func (e *experiment) status() Status {
+	return Status{
+		Name:     e.name,
+		Index:    e.config.Index,
+		Header:   e.config.Header,
+		Cookie:   e.config.Cookie,
+		Enabled:  e.enabled,
+		Variants: e.config.Variants,
+	}
+}
+
+type searchResponse struct {
+	Hits               []json.RawMessage `json:"hits"`
+	EstimatedTotalHits *int64            `json:"estimatedTotalHits"`
+	TotalHits          *int64            `json:"totalHits"`
+}
+
+// Observe records the metrics of a search of a variant. The response is empty when
+// the search failed, it is only counted then.
+func (e *Experiments) Observe(assignment Assignment, cache string, duration time.Duration, response []byte) {
+	e.searches.WithLabelValues(assignment.Experiment, assignment.Variant, cache).Inc()
+	e.duration.WithLabelValues(assignment.Experiment, assignment.Variant).Observe(duration.Seconds())
+
+	if len(response) == 0 {
+		return
+	}
+
+	var search searchResponse
+	if err := json.Unmarshal(response, &search); err != nil {
+		return
+	}
+
+	total := search.TotalHits
+	if total == nil {
+		total = search.EstimatedTotalHits
+	}
+
+	if (total != nil && *total == 0) || (total == nil && len(search.Hits) == 0) {
+		e.zeroResults.WithLabelValues(assignment.Experiment, assignment.Variant).Inc()
+	}
+}
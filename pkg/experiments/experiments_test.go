@@ -0,0 +1,121 @@
+package experiments_test
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/config"
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/experiments"
+)
+
+var _ = Describe("Experiments", func() {
+
+	var registry *prometheus.Registry
+	var e *experiments.Experiments
+
+	search := func(header string, value string) *http.Request {
+		req, _ := http.NewRequest(http.MethodPost, "/indexes/products/search", nil)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		return req
+	}
+
+	BeforeEach(func() {
+		var err error
+		registry = prometheus.NewRegistry()
+		e, err = experiments.New(map[string]*config.Experiment{
+			"ranking": {
+				Index:   "products",
+				Header:  "X-User-Id",
+				Cookie:  "ab",
+				Enabled: true,
+				Variants: []config.ExperimentVariant{
+					{Name: "control", Weight: 3},
+					{Name: "typo", Weight: 1, Index: "products_exp"},
+				},
+			},
+		}, registry)
+		Expect(err).To(BeNil())
+	})
+
+	It("should assign clients to a stable variant by their weight", func() {
+		counts := map[string]int{}
+		for i := 0; i < 2000; i++ {
+			assignment, ok := e.Assign(search("X-User-Id", fmt.Sprintf("user-%d", i)), "products")
+			Expect(ok).To(BeTrue())
+			counts[assignment.Variant]++
+
+			again, _ := e.Assign(search("X-User-Id", fmt.Sprintf("user-%d", i)), "products")
+			Expect(again).To(Equal(assignment))
+
+			if assignment.Variant == "typo" {
+				Expect(assignment.Index).To(Equal("products_exp"))
+			}
+		}
+
+		Expect(counts["control"]).To(BeNumerically("~", 1500, 100))
+		Expect(counts["typo"]).To(BeNumerically("~", 500, 100))
+	})
+
+	It("should identify clients by cookie and skip unidentified clients", func() {
+		req := search("", "")
+		req.AddCookie(&http.Cookie{Name: "ab", Value: "user-1"})
+
+		byCookie, ok := e.Assign(req, "products")
+		Expect(ok).To(BeTrue())
+
+		byHeader, _ := e.Assign(search("X-User-Id", "user-1"), "products")
+		Expect(byCookie).To(Equal(byHeader))
+
+		_, ok = e.Assign(search("", ""), "products")
+		Expect(ok).To(BeFalse())
+
+		_, ok = e.Assign(search("X-User-Id", "user-1"), "users")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("should be turned on and off at runtime", func() {
+		Expect(e.SetEnabled("ranking", false)).To(BeTrue())
+		_, ok := e.Assign(search("X-User-Id", "user-1"), "products")
+		Expect(ok).To(BeFalse())
+
+		status, ok := e.Get("ranking")
+		Expect(ok).To(BeTrue())
+		Expect(status.Enabled).To(BeFalse())
+
+		Expect(e.SetEnabled("ranking", true)).To(BeTrue())
+		_, ok = e.Assign(search("X-User-Id", "user-1"), "products")
+		Expect(ok).To(BeTrue())
+
+		Expect(e.SetEnabled("unknown", true)).To(BeFalse())
+		Expect(e.All()).To(HaveLen(1))
+	})
+
+	It("should count searches and zero-result searches per variant", func() {
+		assignment := experiments.Assignment{Experiment: "ranking", Variant: "typo"}
+
+		e.Observe(assignment, "miss", 10*time.Millisecond, []byte(`{"hits":[],"estimatedTotalHits":0}`))
+		e.Observe(assignment, "hit", time.Millisecond, []byte(`{"hits":[{"id":1}],"estimatedTotalHits":1}`))
+		e.Observe(assignment, "miss", time.Second, nil)
+
+		expected := `
+# HELP meilisearch_proxy_experiment_searches_total Searches of experiments by variant and cache status: hit, miss or stale.
+# TYPE meilisearch_proxy_experiment_searches_total counter
+meilisearch_proxy_experiment_searches_total{cache="hit",experiment="ranking",variant="typo"} 1
+meilisearch_proxy_experiment_searches_total{cache="miss",experiment="ranking",variant="typo"} 2
+# HELP meilisearch_proxy_experiment_zero_results_total Searches of experiments without any hit, by variant.
+# TYPE meilisearch_proxy_experiment_zero_results_total counter
+meilisearch_proxy_experiment_zero_results_total{experiment="ranking",variant="typo"} 1
+`
+		Expect(testutil.GatherAndCompare(registry, strings.NewReader(expected),
+			"meilisearch_proxy_experiment_searches_total", "meilisearch_proxy_experiment_zero_results_total")).To(Succeed())
+	})
+})
@@ -0,0 +1,263 @@
+package guardrails
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/config"
+)
+
+// defaultLimit is the number of hits Meilisearch returns when no limit is given
+const defaultLimit = 20
+
+// Error is returned for searches rejected by a rule, Code is a Meilisearch error code
+type Error struct {
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// listParams are the search parameters holding a list, comma separated in GET searches
+var listParams = []string{"attributesToRetrieve", "attributesToCrop", "attributesToHighlight", "attributesToSearchOn", "facets", "sort"}
+
+// Apply rewrites the parameters of a search according to a rule, or rejects it.
+// apiKey is the API key of the search, or the uid of the API key of a tenant token.
+func Apply(rule *config.SearchRule, apiKey string, params map[string]interface{}) error {
+	if rule == nil {
+		return nil
+	}
+
+	for _, param := range rule.DeniedParameters {
+		delete(params, param)
+	}
+
+	if rule.MaxQueryLength > 0 {
+		if q, ok := params["q"].(string); ok && utf8.RuneCountInString(q) > rule.MaxQueryLength {
+			return &Error{
+				Code:    "invalid_search_q",
+				Message: fmt.Sprintf("The query is longer than %d characters.", rule.MaxQueryLength),
+			}
+		}
+	}
+
+	if rule.MaxFacets > 0 {
+		// "*" asks for every facet of the index
+		if facets, ok := params["facets"].([]interface{}); ok && (len(facets) > rule.MaxFacets || slices.Contains(facets, interface{}("*"))) {
+			return &Error{
+				Code:    "invalid_search_facets",
+				Message: fmt.Sprintf("At most %d facets can be requested.", rule.MaxFacets),
+			}
+		}
+	}
+
+	if rule.MaxLimit > 0 {
+		capLimits(params, rule.MaxLimit)
+	}
+
+	if len(rule.AttributesToRetrieve) > 0 {
+		params["attributesToRetrieve"] = allowedAttributes(params["attributesToRetrieve"], rule.AttributesToRetrieve)
+	}
+
+	if rule.Filter != "" {
+		addFilter(params, rule.Filter)
+	}
+
+	if filter, ok := rule.KeyFilters[apiKey]; ok && apiKey != "" {
+		addFilter(params, filter)
+	}
+
+	return nil
+}
+
+func toInt(v interface{}) (int, bool) {
+	switch n := v.(type) {
+	case json.Number:
+		i, err := n.Int64()
+		return int(i), err == nil
+	case float64:
+		return int(n), true
+	}
+
+	return 0, false
+}
+
+// capLimits caps limit, or hitsPerPage for paginated searches
+func capLimits(params map[string]interface{}, max int) {
+	_, paginated := params["page"]
+	if _, ok := params["hitsPerPage"]; ok {
+		paginated = true
+	}
+
+	param := "limit"
+	if paginated {
+		param = "hitsPerPage"
+	}
+
+	value, ok := params[param]
+	if !ok {
+		if max < defaultLimit {
+			params[param] = json.Number(strconv.Itoa(max))
+		}
+		return
+	}
+
+	if n, ok := toInt(value); ok && n > max {
+		params[param] = json.Number(strconv.Itoa(max))
+	}
+}
+
+// allowedAttributes keeps the requested attributes that are in the whitelist
+func allowedAttributes(requested interface{}, whitelist []string) []interface{} {
+	var allowed []interface{}
+
+	if attributes, ok := requested.([]interface{}); ok {
+		for _, attribute := range attributes {
+			if name, ok := attribute.(string); ok && slices.Contains(whitelist, name) {
+				allowed = append(allowed, name)
+			}
+		}
+	}
+
+	// nothing or only disallowed attributes were asked for, retrieve the whole whitelist
+	if len(allowed) == 0 {
+		for _, name := range whitelist {
+			allowed = append(allowed, name)
+		}
+	}
+
+	return allowed
+}
+
+// addFilter ANDs a filter with the filter of a search, which is either a string or
+// an array of filters that are already ANDed
+func addFilter(params map[string]interface{}, filter string) {
+	switch existing := params["filter"].(type) {
+	case string:
+		if strings.TrimSpace(existing) != "" {
+			params["filter"] = fmt.Sprintf("(%s) AND (%s)", existing, filter)
+			return
+		}
+	case []interface{}:
+		params["filter"] = append(existing, filter)
+		return
+	}
+
+	params["filter"] = filter
+}
+
+// RewriteBody applies a rule to the JSON body of a POST search
+func RewriteBody(rule *config.SearchRule, apiKey string, body []byte) ([]byte, error) {
+	if rule == nil {
+		return body, nil
+	}
+
+	if len(bytes.TrimSpace(body)) == 0 {
+		body = []byte("{}")
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+
+	var params map[string]interface{}
+	if err := decoder.Decode(&params); err != nil {
+		return nil, &Error{Code: "malformed_payload", Message: fmt.Sprintf("The search body is not a JSON object: %s.", err)}
+	}
+	if params == nil {
+		params = map[string]interface{}{}
+	}
+
+	if err := Apply(rule, apiKey, params); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(params)
+}
+
+// RewriteQuery applies a rule to the query string of a GET search. The values of a
+// repeated list parameter are merged, repeated filters are ANDed and the values of
+// other repeated parameters are each checked and rewritten.
+func RewriteQuery(rule *config.SearchRule, apiKey string, query url.Values) (url.Values, error) {
+	if rule == nil {
+		return query, nil
+	}
+
+	params := make(map[string]interface{}, len(query))
+	for name, values := range query {
+		switch {
+		case slices.Contains(listParams, name):
+			var list []interface{}
+			for _, value := range values {
+				for _, item := range strings.Split(value, ",") {
+					list = append(list, item)
+				}
+			}
+			params[name] = list
+		case name == "filter" && len(values) > 1:
+			filters := make([]interface{}, 0, len(values))
+			for _, value := range values {
+				filters = append(filters, value)
+			}
+			params[name] = filters
+		default:
+			params[name] = queryParam(name, values[0])
+		}
+	}
+
+	if err := Apply(rule, apiKey, params); err != nil {
+		return nil, err
+	}
+
+	rewritten := make(url.Values, len(params))
+	for name, value := range params {
+		switch v := value.(type) {
+		case []interface{}:
+			items := make([]string, 0, len(v))
+			for _, item := range v {
+				items = append(items, fmt.Sprint(item))
+			}
+			if name == "filter" {
+				rewritten.Set(name, "("+strings.Join(items, ") AND (")+")")
+			} else {
+				rewritten.Set(name, strings.Join(items, ","))
+			}
+		default:
+			rewritten.Set(name, fmt.Sprint(v))
+		}
+	}
+
+	// the other values of repeated parameters go through the rule on their own
+	for name, values := range query {
+		if _, kept := rewritten[name]; !kept || len(values) < 2 || slices.Contains(listParams, name) || name == "filter" {
+			continue
+		}
+
+		for _, value := range values[1:] {
+			other := map[string]interface{}{name: queryParam(name, value)}
+			if err := Apply(rule, apiKey, other); err != nil {
+				return nil, err
+			}
+			rewritten.Add(name, fmt.Sprint(other[name]))
+		}
+	}
+
+	return rewritten, nil
+}
+
+// queryParam is the value of a parameter of a GET search as it is in a JSON body
+func queryParam(name string, value string) interface{} {
+	switch name {
+	case "limit", "hitsPerPage", "page", "offset":
+		return json.Number(value)
+	}
+
+	return value
+}
@@ -0,0 +1,13 @@
+package guardrails_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestGuardrails(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Guardrails Suite")
+}
@@ -0,0 +1,120 @@
+package guardrails_test
+
+import (
+	"errors"
+	"net/url"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/config"
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/guardrails"
+)
+
+var _ = Describe("Guardrails", func() {
+
+	rule := &config.SearchRule{
+		MaxLimit:             50,
+		AttributesToRetrieve: []string{"id", "title"},
+		MaxFacets:            2,
+		MaxQueryLength:       10,
+		DeniedParameters:     []string{"showRankingScoreDetails"},
+		Filter:               "public = true",
+		KeyFilters:           map[string]string{"tenant-key": "tenant = 42"},
+	}
+
+	Context("RewriteBody", func() {
+		It("should cap the limit, whitelist attributes and strip denied parameters", func() {
+			body, err := guardrails.RewriteBody(rule, "", []byte(`{"q":"shoes","limit":10000,"attributesToRetrieve":["*"],"showRankingScoreDetails":true}`))
+			Expect(err).To(BeNil())
+			Expect(body).To(MatchJSON(`{"q":"shoes","limit":50,"attributesToRetrieve":["id","title"],"filter":"public = true"}`))
+		})
+
+		It("should cap hitsPerPage of paginated searches", func() {
+			body, err := guardrails.RewriteBody(rule, "", []byte(`{"page":2,"hitsPerPage":500,"attributesToRetrieve":["title","price"]}`))
+			Expect(err).To(BeNil())
+			Expect(body).To(MatchJSON(`{"page":2,"hitsPerPage":50,"attributesToRetrieve":["title"],"filter":"public = true"}`))
+		})
+
+		It("should AND the filters of the rule and the API key with the search filter", func() {
+			body, err := guardrails.RewriteBody(rule, "tenant-key", []byte(`{"filter":"color = red"}`))
+			Expect(err).To(BeNil())
+			Expect(body).To(MatchJSON(`{"filter":"((color = red) AND (public = true)) AND (tenant = 42)","attributesToRetrieve":["id","title"]}`))
+
+			body, err = guardrails.RewriteBody(rule, "tenant-key", []byte(`{"filter":["color = red"]}`))
+			Expect(err).To(BeNil())
+			Expect(body).To(MatchJSON(`{"filter":["color = red","public = true","tenant = 42"],"attributesToRetrieve":["id","title"]}`))
+		})
+
+		It("should apply the rule to an empty body", func() {
+			body, err := guardrails.RewriteBody(&config.SearchRule{MaxLimit: 5}, "", nil)
+			Expect(err).To(BeNil())
+			Expect(body).To(MatchJSON(`{"limit":5}`))
+		})
+
+		It("should reject over-long queries and too many facets", func() {
+			var ruleErr *guardrails.Error
+
+			_, err := guardrails.RewriteBody(rule, "", []byte(`{"q":"a very long query"}`))
+			Expect(errors.As(err, &ruleErr)).To(BeTrue())
+			Expect(ruleErr.Code).To(Equal("invalid_search_q"))
+
+			_, err = guardrails.RewriteBody(rule, "", []byte(`{"facets":["a","b","c"]}`))
+			Expect(errors.As(err, &ruleErr)).To(BeTrue())
+			Expect(ruleErr.Code).To(Equal("invalid_search_facets"))
+
+			// * asks for every facet
+			_, err = guardrails.RewriteBody(rule, "", []byte(`{"facets":["*"]}`))
+			Expect(errors.As(err, &ruleErr)).To(BeTrue())
+			Expect(ruleErr.Code).To(Equal("invalid_search_facets"))
+		})
+
+		It("should leave searches untouched without a rule", func() {
+			body, err := guardrails.RewriteBody(nil, "", []byte(`{"limit":10000}`))
+			Expect(err).To(BeNil())
+			Expect(body).To(MatchJSON(`{"limit":10000}`))
+		})
+	})
+
+	Context("RewriteQuery", func() {
+		It("should apply the rule to the parameters of GET searches", func() {
+			query, err := guardrails.RewriteQuery(rule, "", url.Values{
+				"q":                    {"shoes"},
+				"limit":                {"1000"},
+				"attributesToRetrieve": {"title,secret"},
+			})
+			Expect(err).To(BeNil())
+			Expect(query).To(Equal(url.Values{
+				"q":                    {"shoes"},
+				"limit":                {"50"},
+				"attributesToRetrieve": {"title"},
+				"filter":               {"public = true"},
+			}))
+		})
+
+		It("should keep repeated parameters, applying the rule to each value", func() {
+			query, err := guardrails.RewriteQuery(rule, "", url.Values{
+				"q":                    {"shoes"},
+				"limit":                {"10", "1000"},
+				"attributesToRetrieve": {"title", "id,secret"},
+				"filter":               {"color = red", "size = 42"},
+			})
+			Expect(err).To(BeNil())
+			Expect(query).To(Equal(url.Values{
+				"q":                    {"shoes"},
+				"limit":                {"10", "50"},
+				"attributesToRetrieve": {"title,id"},
+				"filter":               {"(color = red) AND (size = 42) AND (public = true)"},
+			}))
+
+			var ruleErr *guardrails.Error
+			_, err = guardrails.RewriteQuery(rule, "", url.Values{"q": {"shoes", "a very long query"}})
+			Expect(errors.As(err, &ruleErr)).To(BeTrue())
+			Expect(ruleErr.Code).To(Equal("invalid_search_q"))
+
+			_, err = guardrails.RewriteQuery(rule, "", url.Values{"facets": {"*"}})
+			Expect(errors.As(err, &ruleErr)).To(BeTrue())
+			Expect(ruleErr.Code).To(Equal("invalid_search_facets"))
+		})
+	})
+})
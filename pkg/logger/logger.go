@@ -1,42 +1,80 @@
 package logger
 
 import (
-	"log"
+	"io"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/rs/zerolog"
 )
 
+const (
+	FormatJSON    = "json"
+	FormatConsole = "console"
+)
+
+var (
+	once   sync.Once
+	logger zerolog.Logger
+)
+
+// GetLogger returns the logger shared by the whole proxy, configured by LOG_LEVEL
+// (info by default) and LOG_FORMAT (console by default)
 func GetLogger() zerolog.Logger {
-	logLevel := zerolog.TraceLevel
+	once.Do(func() {
+		logger = fromEnv()
+	})
+
+	return logger
+}
+
+// New creates a logger writing JSON lines, or human readable lines with the file and
+// line they were logged from. Secrets are masked, see Redact.
+func New(out io.Writer, format string, level zerolog.Level) zerolog.Logger {
+	out = redactWriter{out: out}
+
+	if format == FormatConsole {
+		return zerolog.New(
+			zerolog.ConsoleWriter{Out: out, TimeFormat: time.RFC3339},
+		).Level(level).With().Timestamp().Caller().Logger()
+	}
+
+	return zerolog.New(out).Level(level).With().Timestamp().Logger()
+}
+
+func fromEnv() zerolog.Logger {
+	format := FormatConsole
+	var unknownFormat bool
+
+	switch os.Getenv("LOG_FORMAT") {
+	case "", FormatConsole:
+	case FormatJSON:
+		format = FormatJSON
+	default:
+		unknownFormat = true
+	}
+
+	level := zerolog.InfoLevel
+	var unknownLevel bool
 
 	if os.Getenv("LOG_LEVEL") != "" {
-		level := os.Getenv("LOG_LEVEL")
-
-		switch level {
-		case "trace":
-			logLevel = zerolog.TraceLevel
-		case "debug":
-			logLevel = zerolog.DebugLevel
-		case "info":
-			logLevel = zerolog.InfoLevel
-		case "warn":
-			logLevel = zerolog.WarnLevel
-		case "error":
-			logLevel = zerolog.ErrorLevel
-		case "fatal":
-			logLevel = zerolog.FatalLevel
-		case "panic":
-			logLevel = zerolog.PanicLevel
-		default:
-			log.Fatalf("Unknown log level: %s", level)
+		parsed, err := zerolog.ParseLevel(os.Getenv("LOG_LEVEL"))
+		if err != nil || parsed == zerolog.NoLevel || parsed == zerolog.Disabled {
+			unknownLevel = true
+		} else {
+			level = parsed
 		}
 	}
 
-	logger := zerolog.New(
-		zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.RFC3339},
-	).Level(logLevel).With().Timestamp().Caller().Logger()
+	l := New(os.Stderr, format, level)
 
-	return logger
+	if unknownFormat {
+		l.Fatal().Msgf("Unknown log format: %s, expected json or console", os.Getenv("LOG_FORMAT"))
+	}
+	if unknownLevel {
+		l.Fatal().Msgf("Unknown log level: %s", os.Getenv("LOG_LEVEL"))
+	}
+
+	return l
 }
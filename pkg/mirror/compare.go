@@ -0,0 +1,117 @@
+package mirror
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Diff is how the response of the shadow instance differs from the primary's
+type Diff struct {
+	// MissingHits is the number of hits of the primary the shadow didn't return
+	MissingHits int
+	// ExtraHits is the number of hits of the shadow the primary didn't return
+	ExtraHits int
+	// OrderChanged is set when the hits returned by both are ranked differently
+	OrderChanged     bool
+	PrimaryTotalHits *int64
+	ShadowTotalHits  *int64
+}
+
+// TotalHitsChanged reports whether estimatedTotalHits (totalHits for paginated searches) differ
+func (d Diff) TotalHitsChanged() bool {
+	if d.PrimaryTotalHits == nil || d.ShadowTotalHits == nil {
+		return d.PrimaryTotalHits != d.ShadowTotalHits
+	}
+
+	return *d.PrimaryTotalHits != *d.ShadowTotalHits
+}
+
+// Equal reports whether both instances answered the same hits, in the same order, with the same total
+func (d Diff) Equal() bool {
+	return d.MissingHits == 0 && d.ExtraHits == 0 && !d.OrderChanged && !d.TotalHitsChanged()
+}
+
+type searchResponse struct {
+	Hits               []map[string]json.RawMessage `json:"hits"`
+	EstimatedTotalHits *int64                       `json:"estimatedTotalHits"`
+	TotalHits          *int64                       `json:"totalHits"`
+}
+
+func (r searchResponse) totalHits() *int64 {
+	if r.TotalHits != nil {
+		return r.TotalHits
+	}
+
+	return r.EstimatedTotalHits
+}
+
+// hitIDs identifies hits by their primary key, hits without it by their whole content
+func (r searchResponse) hitIDs(primaryKey string) []string {
+	ids := make([]string, 0, len(r.Hits))
+	for _, hit := range r.Hits {
+		if id, ok := hit[primaryKey]; ok {
+			ids = append(ids, string(id))
+			continue
+		}
+
+		// map keys are sorted when marshalled
+		content, _ := json.Marshal(hit)
+		ids = append(ids, string(content))
+	}
+
+	return ids
+}
+
+// Compare compares the search responses of the primary and the shadow instance
+func Compare(primary, shadow []byte, primaryKey string) (Diff, error) {
+	var primaryResponse, shadowResponse searchResponse
+	if err := json.Unmarshal(primary, &primaryResponse); err != nil {
+		return Diff{}, fmt.Errorf("invalid primary response: %w", err)
+	}
+	if err := json.Unmarshal(shadow, &shadowResponse); err != nil {
+		return Diff{}, fmt.Errorf("invalid shadow response: %w", err)
+	}
+
+	diff := Diff{
+		PrimaryTotalHits: primaryResponse.totalHits(),
+		ShadowTotalHits:  shadowResponse.totalHits(),
+	}
+
+	primaryIDs := primaryResponse.hitIDs(primaryKey)
+	shadowIDs := shadowResponse.hitIDs(primaryKey)
+
+	inPrimary := make(map[string]bool, len(primaryIDs))
+	for _, id := range primaryIDs {
+		inPrimary[id] = true
+	}
+	inShadow := make(map[string]bool, len(shadowIDs))
+	for _, id := range shadowIDs {
+		inShadow[id] = true
+	}
+
+	// the hits returned by both, in the order each instance ranked them
+	var primaryCommon, shadowCommon []string
+	for _, id := range primaryIDs {
+		if inShadow[id] {
+			primaryCommon = append(primaryCommon, id)
+		} else {
+			diff.MissingHits++
+		}
+	}
+	for _, id := range shadowIDs {
+		if inPrimary[id] {
+			shadowCommon = append(shadowCommon, id)
+		} else {
+			diff.ExtraHits++
+		}
+	}
+
+	for i := range primaryCommon {
+		if i >= len(shadowCommon) || primaryCommon[i] != shadowCommon[i] {
+			diff.OrderChanged = true
+			break
+		}
+	}
+
+	return diff, nil
+}
@@ -0,0 +1,210 @@
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/config"
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/util"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+// maxResponseSize bounds how much of a shadow response is read
+const maxResponseSize = 10 * 1024 * 1024
+
+// Search is a search answered by the primary instance
+type Search struct {
+	Index  string
+	Method string
+	// Path includes the query string of GET searches
+	Path string
+	Body []byte
+	// Response is what the client was answered
+	Response []byte
+}
+
+// Mirror sends a sample of searches to a shadow instance and compares its responses.
+// Mirrored searches run in the background and never delay the client.
+type Mirror struct {
+	ctx        context.Context
+	host       *url.URL
+	apiKey     string
+	sampleRate float64
+	timeout    time.Duration
+	primaryKey string
+	client     *http.Client
+	slots      chan struct{}
+	logger     zerolog.Logger
+
+	searches    *prometheus.CounterVec
+	differences *prometheus.CounterVec
+	duration    *prometheus.HistogramVec
+}
+
+// New creates a mirror to the shadow instance of the config and registers its metrics
+func New(ctx context.Context, cfg *config.MirrorConfig, registerer prometheus.Registerer, logger zerolog.Logger) (*Mirror, error) {
+	host, err := url.Parse(cfg.Host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid shadow host: %w", err)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = cfg.Concurrency
+
+	m := &Mirror{
+		ctx:        ctx,
+		host:       host,
+		apiKey:     cfg.ApiKey,
+		sampleRate: cfg.SampleRate,
+		timeout:    cfg.Timeout,
+		primaryKey: cfg.PrimaryKey,
+		client:     &http.Client{Transport: transport},
+		slots:      make(chan struct{}, cfg.Concurrency),
+		logger:     logger,
+		searches: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "meilisearch_proxy",
+			Subsystem: "mirror",
+			Name:      "searches_total",
+			Help:      "Searches mirrored to the shadow instance, by result: match, mismatch, error or dropped.",
+		}, []string{"index", "result"}),
+		differences: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "meilisearch_proxy",
+			Subsystem: "mirror",
+			Name:      "differences_total",
+			Help:      "Differences between the primary and the shadow responses, by kind: missing_hits, extra_hits, order or total_hits.",
+		}, []string{"index", "kind"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "meilisearch_proxy",
+			Subsystem: "mirror",
+			Name:      "shadow_duration_seconds",
+			Help:      "Duration of the searches mirrored to the shadow instance.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"index"}),
+	}
+
+	for _, collector := range []prometheus.Collector{m.searches, m.differences, m.duration} {
+		if err := registerer.Register(collector); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// Search mirrors a sample of searches to the shadow instance. It returns right away,
+// searches are dropped when too many are already in flight.
+func (m *Mirror) Search(search Search) {
+	if rand.Float64()*100 >= m.sampleRate {
+		return
+	}
+
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		m.searches.WithLabelValues(search.Index, "dropped").Inc()
+		return
+	}
+
+	go func() {
+		defer func() { <-m.slots }()
+		m.compare(search)
+	}()
+}
+
+func (m *Mirror) compare(search Search) {
+	start := time.Now()
+	response, err := m.send(search)
+	m.duration.WithLabelValues(search.Index).Observe(time.Since(start).Seconds())
+
+	var diff Diff
+	if err == nil {
+		diff, err = Compare(search.Response, response, m.primaryKey)
+	}
+
+	if err != nil {
+		m.searches.WithLabelValues(search.Index, "error").Inc()
+		m.logger.Warn().Str("index", search.Index).Str("path", search.Path).Err(err).Msg("Mirrored search failed")
+		return
+	}
+
+	if diff.Equal() {
+		m.searches.WithLabelValues(search.Index, "match").Inc()
+		return
+	}
+
+	m.searches.WithLabelValues(search.Index, "mismatch").Inc()
+	if diff.MissingHits > 0 {
+		m.differences.WithLabelValues(search.Index, "missing_hits").Inc()
+	}
+	if diff.ExtraHits > 0 {
+		m.differences.WithLabelValues(search.Index, "extra_hits").Inc()
+	}
+	if diff.OrderChanged {
+		m.differences.WithLabelValues(search.Index, "order").Inc()
+	}
+	if diff.TotalHitsChanged() {
+		m.differences.WithLabelValues(search.Index, "total_hits").Inc()
+	}
+
+	event := m.logger.Warn().
+		Str("index", search.Index).
+		Str("path", search.Path).
+		Int("missingHits", diff.MissingHits).
+		Int("extraHits", diff.ExtraHits).
+		Bool("orderChanged", diff.OrderChanged).
+		Interface("primaryTotalHits", diff.PrimaryTotalHits).
+		Interface("shadowTotalHits", diff.ShadowTotalHits)
+	if json.Valid(search.Body) {
+		event = event.RawJSON("search", search.Body)
+	}
+	event.Msg("Shadow response differs from the primary")
+}
+
+// send replays a search on the shadow instance and returns its response
+func (m *Mirror) send(search Search) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(m.ctx, m.timeout)
+	defer cancel()
+
+	target, err := url.Parse(search.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	u := *m.host
+	u.Path = util.SingleJoiningSlash(m.host.Path, target.Path)
+	u.RawQuery = target.RawQuery
+
+	req, err := http.NewRequestWithContext(ctx, search.Method, u.String(), bytes.NewReader(search.Body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if m.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+m.apiKey)
+	}
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("shadow responded with status %d", resp.StatusCode)
+	}
+
+	return body, nil
+}
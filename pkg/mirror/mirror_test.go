@@ -0,0 +1,195 @@
+package mirror_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
+
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/config"
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/mirror"
+)
+
+// shadowRequest is what the shadow instance received
+type shadowRequest struct {
+	url  string
+	auth string
+	body string
+}
+
+const primaryJSON = `{"hits":[{"id":1,"title":"a"},{"id":2,"title":"b"},{"id":3,"title":"c"}],"estimatedTotalHits":3}`
+
+var _ = Describe("Mirror", func() {
+
+	Context("Compare", func() {
+		It("should find no difference between identical responses", func() {
+			diff, err := mirror.Compare([]byte(primaryJSON), []byte(primaryJSON), "id")
+			Expect(err).To(BeNil())
+			Expect(diff.Equal()).To(BeTrue())
+		})
+
+		It("should count missing and extra hits and total differences", func() {
+			shadow := `{"hits":[{"id":1,"title":"a"},{"id":2,"title":"b"},{"id":4,"title":"d"}],"estimatedTotalHits":4}`
+
+			diff, err := mirror.Compare([]byte(primaryJSON), []byte(shadow), "id")
+			Expect(err).To(BeNil())
+			Expect(diff.MissingHits).To(Equal(1))
+			Expect(diff.ExtraHits).To(Equal(1))
+			Expect(diff.OrderChanged).To(BeFalse())
+			Expect(diff.TotalHitsChanged()).To(BeTrue())
+			Expect(diff.Equal()).To(BeFalse())
+		})
+
+		It("should detect hits ranked differently", func() {
+			shadow := `{"hits":[{"id":2,"title":"b"},{"id":1,"title":"a"},{"id":3,"title":"c"}],"estimatedTotalHits":3}`
+
+			diff, err := mirror.Compare([]byte(primaryJSON), []byte(shadow), "id")
+			Expect(err).To(BeNil())
+			Expect(diff.MissingHits).To(Equal(0))
+			Expect(diff.ExtraHits).To(Equal(0))
+			Expect(diff.OrderChanged).To(BeTrue())
+		})
+
+		It("should compare whole hits when they don't have the primary key", func() {
+			primary := `{"hits":[{"sku":"x","title":"a"}],"totalHits":1}`
+			shadow := `{"hits":[{"title":"a","sku":"x"}],"totalHits":1}`
+
+			diff, err := mirror.Compare([]byte(primary), []byte(shadow), "id")
+			Expect(err).To(BeNil())
+			Expect(diff.Equal()).To(BeTrue())
+		})
+
+		It("should fail on an invalid response", func() {
+			_, err := mirror.Compare([]byte(primaryJSON), []byte(`not json`), "id")
+			Expect(err).ToNot(BeNil())
+		})
+	})
+
+	Context("Search", func() {
+		var shadow *httptest.Server
+		var shadowResponse string
+		var requests chan shadowRequest
+		var release chan struct{}
+
+		newMirror := func(sampleRate float64, concurrency int) (*mirror.Mirror, *prometheus.Registry) {
+			registry := prometheus.NewRegistry()
+			m, err := mirror.New(context.Background(), &config.MirrorConfig{
+				Host:        shadow.URL,
+				ApiKey:      "shadowKey",
+				SampleRate:  sampleRate,
+				Timeout:     time.Second,
+				Concurrency: concurrency,
+				PrimaryKey:  "id",
+			}, registry, zerolog.Nop())
+			Expect(err).To(BeNil())
+
+			return m, registry
+		}
+
+		count := func(registry *prometheus.Registry, result string) func() int {
+			return func() int {
+				families, _ := registry.Gather()
+				for _, family := range families {
+					if family.GetName() != "meilisearch_proxy_mirror_searches_total" {
+						continue
+					}
+					for _, metric := range family.GetMetric() {
+						for _, label := range metric.GetLabel() {
+							if label.GetName() == "result" && label.GetValue() == result {
+								return int(metric.GetCounter().GetValue())
+							}
+						}
+					}
+				}
+				return 0
+			}
+		}
+
+		BeforeEach(func() {
+			shadowResponse = primaryJSON
+			requests = make(chan shadowRequest, 10)
+			release = nil
+
+			shadow = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				requests <- shadowRequest{url: r.URL.String(), auth: r.Header.Get("Authorization"), body: string(body)}
+
+				if release != nil {
+					<-release
+				}
+				w.Write([]byte(shadowResponse))
+			}))
+		})
+
+		AfterEach(func() {
+			shadow.Close()
+		})
+
+		It("should replay searches on the shadow instance and count matches", func() {
+			m, registry := newMirror(100, 10)
+
+			m.Search(mirror.Search{
+				Index:    "products",
+				Method:   http.MethodPost,
+				Path:     "/indexes/products/search",
+				Body:     []byte(`{"q":"shoes"}`),
+				Response: []byte(primaryJSON),
+			})
+
+			Eventually(requests).Should(Receive(Equal(shadowRequest{
+				url:  "/indexes/products/search",
+				auth: "Bearer shadowKey",
+				body: `{"q":"shoes"}`,
+			})))
+
+			Eventually(count(registry, "match")).Should(Equal(1))
+		})
+
+		It("should count the differences of mismatching responses", func() {
+			shadowResponse = `{"hits":[{"id":3},{"id":2},{"id":1}],"estimatedTotalHits":30}`
+			m, registry := newMirror(100, 10)
+
+			m.Search(mirror.Search{Index: "products", Method: http.MethodGet, Path: "/indexes/products/search?q=shoes", Response: []byte(primaryJSON)})
+
+			var req shadowRequest
+			Eventually(requests).Should(Receive(&req))
+			Expect(req.url).To(Equal("/indexes/products/search?q=shoes"))
+
+			Eventually(count(registry, "mismatch")).Should(Equal(1))
+			Expect(testutil.GatherAndCount(registry, "meilisearch_proxy_mirror_differences_total")).To(Equal(2))
+		})
+
+		It("should only mirror the sampled searches", func() {
+			m, registry := newMirror(0.000001, 10)
+
+			for i := 0; i < 100; i++ {
+				m.Search(mirror.Search{Index: "products", Method: http.MethodPost, Path: "/indexes/products/search", Response: []byte(primaryJSON)})
+			}
+
+			Consistently(requests, 100*time.Millisecond).ShouldNot(Receive())
+			Expect(count(registry, "match")()).To(Equal(0))
+		})
+
+		It("should drop searches instead of waiting for the shadow instance", func() {
+			release = make(chan struct{})
+			m, registry := newMirror(100, 1)
+
+			search := mirror.Search{Index: "products", Method: http.MethodPost, Path: "/indexes/products/search", Response: []byte(primaryJSON)}
+			m.Search(search)
+			Eventually(requests).Should(Receive())
+
+			m.Search(search)
+			Expect(count(registry, "dropped")()).To(Equal(1))
+
+			close(release)
+			Eventually(count(registry, "match")).Should(Equal(1))
+		})
+	})
+})
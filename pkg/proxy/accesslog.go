@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+type accessLogKey struct{}
+
+// responseRecorder keeps the status and size of a response for the access log and the
+// span of its request
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	if rr.status == 0 {
+		rr.status = status
+	}
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+func (rr *responseRecorder) Write(p []byte) (int, error) {
+	if rr.status == 0 {
+		rr.status = http.StatusOK
+	}
+	n, err := rr.ResponseWriter.Write(p)
+	rr.bytes += int64(n)
+
+	return n, err
+}
+
+// Unwrap lets the reverse proxy flush streamed responses
+func (rr *responseRecorder) Unwrap() http.ResponseWriter {
+	return rr.ResponseWriter
+}
+
+// accessLogEntry collects what is only known deeper in the handling of a request
+type accessLogEntry struct {
+	mu sync.Mutex
+	// upstream is the Meilisearch node that answered, a replica when the search was hedged
+	upstream string
+	// traceID is the trace of the request, its span is started after the access log
+	traceID string
+}
+
+func (e *accessLogEntry) setUpstream(host string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.upstream = host
+}
+
+// recordTrace notes the trace of a request, for its access log
+func recordTrace(ctx context.Context) {
+	entry, ok := ctx.Value(accessLogKey{}).(*accessLogEntry)
+	if span := trace.SpanContextFromContext(ctx); ok && span.HasTraceID() {
+		entry.mu.Lock()
+		defer entry.mu.Unlock()
+
+		entry.traceID = span.TraceID().String()
+	}
+}
+
+// recordUpstream notes the Meilisearch node that answered a request, for its access log
+func recordUpstream(resp *http.Response) {
+	if entry, ok := resp.Request.Context().Value(accessLogKey{}).(*accessLogEntry); ok {
+		entry.setUpstream(resp.Request.URL.Host)
+	}
+}
+
+// accessLogMiddleware logs requests once served. It runs before CORS, authentication and
+// rate limiting, so that the requests they reject are logged too.
+func (p *Proxy) accessLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder, r := p.startAccessLog(w, r)
+		defer p.logAccess(recorder, r, start)
+
+		next.ServeHTTP(recorder, r)
+	})
+}
+
+// startAccessLog wraps the response writer of a request to log it once served
+func (p *Proxy) startAccessLog(w http.ResponseWriter, r *http.Request) (*responseRecorder, *http.Request) {
+	entry := &accessLogEntry{}
+
+	return &responseRecorder{ResponseWriter: w}, r.WithContext(context.WithValue(r.Context(), accessLogKey{}, entry))
+}
+
+// recordResponse returns the recorder of the access log of a response, or a new one
+// when the response isn't logged
+func recordResponse(w http.ResponseWriter) *responseRecorder {
+	if recorder, ok := w.(*responseRecorder); ok {
+		return recorder
+	}
+
+	return &responseRecorder{ResponseWriter: w}
+}
+
+// logAccess logs a sample of requests, server errors are always logged. Health checks aren't.
+func (p *Proxy) logAccess(w *responseRecorder, r *http.Request, start time.Time) {
+	rate := p.GetConfig().AccessLogSampleRate
+	if healthPath.MatchString(r.URL.Path) || (w.status < http.StatusInternalServerError && rand.Float64() >= rate) {
+		return
+	}
+
+	entry, _ := r.Context().Value(accessLogKey{}).(*accessLogEntry)
+	entry.mu.Lock()
+	upstream, traceID := entry.upstream, entry.traceID
+	entry.mu.Unlock()
+
+	status := w.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	event := p.log(r.Context()).Info().
+		Str("type", "access").
+		Str("method", r.Method).
+		Str("path", r.URL.Path).
+		Int("status", status).
+		Int64("bytes", w.bytes).
+		Float64("durationMs", float64(time.Since(start).Microseconds())/1000)
+
+	if match := indexPath.FindStringSubmatch(r.URL.Path); match != nil {
+		event = event.Str("index", match[1])
+	}
+	if cache := w.Header().Get("X-Cache"); cache != "" {
+		event = event.Str("cache", strings.ToLower(cache))
+	}
+	if upstream != "" {
+		event = event.Str("upstream", upstream)
+	}
+	if traceID != "" {
+		event = event.Str("traceId", traceID)
+	}
+
+	event.Msg("access")
+}
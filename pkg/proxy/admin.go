@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/caching"
+)
+
+var (
+	cacheIndexPath = regexp.MustCompile(`^/cache/indexes/([^/]+)$`)
+	cacheKeyPath   = regexp.MustCompile(`^/cache/keys/([^/]+)$`)
+)
+
+type cacheEntryResponse struct {
+	caching.Entry
+	TTLSeconds int64           `json:"ttlSeconds"`
+	Value      json.RawMessage `json:"value,omitempty"`
+}
+
+// handleCache serves the cache inspection endpoints:
+//
+//	GET    /cache               entry count and size per index
+//	GET    /cache/indexes/{idx} entries of an index
+//	GET    /cache/keys/{key}    a single entry with its cached response
+//	DELETE /cache/keys/{key}    remove a single entry
+func (p *Proxy) handleCache(w http.ResponseWriter, r *http.Request) {
+	if !p.authorizePurge(w, r) {
+		return
+	}
+
+	path := strings.TrimSuffix(r.URL.Path, "/")
+
+	switch {
+	case path == "/cache" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"indexes": p.registry.Stats(),
+		})
+
+	case cacheIndexPath.MatchString(path) && r.Method == http.MethodGet:
+		index := cacheIndexPath.FindStringSubmatch(path)[1]
+
+		entries := []cacheEntryResponse{}
+		for _, entry := range p.registry.Entries(index) {
+			entries = append(entries, cacheEntryResponse{
+				Entry:      entry,
+				TTLSeconds: int64(entry.TTL().Seconds()),
+			})
+		}
+
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"index":   index,
+			"entries": entries,
+		})
+
+	case cacheKeyPath.MatchString(path) && r.Method == http.MethodGet:
+		key := cacheKeyPath.FindStringSubmatch(path)[1]
+		p.getCacheEntry(w, r, key)
+
+	case cacheKeyPath.MatchString(path) && r.Method == http.MethodDelete:
+		key := cacheKeyPath.FindStringSubmatch(path)[1]
+
+		if err := p.deleteCacheEntry(r.Context(), key); err != nil {
+			p.log(r.Context()).Error().Msgf("Error deleting cache key %s: %s", key, err)
+			http.Error(w, "Error deleting cache key", http.StatusInternalServerError)
+			return
+		}
+
+		p.log(r.Context()).Info().Msgf("Deleted cache key %s", key)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+func (p *Proxy) getCacheEntry(w http.ResponseWriter, r *http.Request, key string) {
+	value, err := p.GetCache().Get(r.Context(), key)
+	if err != nil {
+		// evicted or expired in the cache engine, forget about it
+		p.registry.Remove(key)
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	response := cacheEntryResponse{
+		Entry: caching.Entry{Key: key, Size: len(value)},
+	}
+
+	// entries stored by another replica sharing the cache only have a value
+	if entry, ok := p.registry.Get(key); ok {
+		response.Entry = entry
+		response.TTLSeconds = int64(entry.TTL().Seconds())
+	}
+	if json.Valid([]byte(value)) {
+		response.Value = json.RawMessage(value)
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
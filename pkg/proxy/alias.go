@@ -0,0 +1,328 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/eko/gocache/lib/v4/store"
+
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/config"
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/guardrails"
+)
+
+var (
+	indexPath = regexp.MustCompile(`^/indexes/([^/]+)(/.*)?$`)
+	aliasPath = regexp.MustCompile(`^/aliases/([^/]+)$`)
+)
+
+type aliasKey struct{}
+
+// aliasedRequest is stored in the context of requests made to an alias
+type aliasedRequest struct {
+	alias string
+	// path is the path of the request before the alias was resolved
+	path string
+}
+
+// aliasTable maps virtual index names to physical indexes
+type aliasTable struct {
+	mu      sync.RWMutex
+	aliases map[string]string
+}
+
+func newAliasTable(aliases map[string]string) *aliasTable {
+	t := &aliasTable{aliases: make(map[string]string, len(aliases))}
+	for alias, index := range aliases {
+		t.aliases[alias] = index
+	}
+
+	return t
+}
+
+// resolve returns the index an alias points to
+func (t *aliasTable) resolve(name string) (string, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	index, ok := t.aliases[name]
+	return index, ok
+}
+
+// set points an alias to an index and returns its previous index, if any
+func (t *aliasTable) set(alias string, index string) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	previous, ok := t.aliases[alias]
+	t.aliases[alias] = index
+
+	return previous, ok
+}
+
+func (t *aliasTable) remove(alias string) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	previous, ok := t.aliases[alias]
+	delete(t.aliases, alias)
+
+	return previous, ok
+}
+
+func (t *aliasTable) all() map[string]string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	aliases := make(map[string]string, len(t.aliases))
+	for alias, index := range t.aliases {
+		aliases[alias] = index
+	}
+
+	return aliases
+}
+
+// resolveAlias rewrites requests to /indexes/{alias}/... to the index the alias points to
+func (p *Proxy) resolveAlias(r *http.Request) *http.Request {
+	match := indexPath.FindStringSubmatch(r.URL.Path)
+	if match == nil {
+		return r
+	}
+
+	index, ok := p.aliases.resolve(match[1])
+	if !ok {
+		return r
+	}
+
+	aliased := aliasedRequest{alias: match[1], path: r.URL.Path}
+
+	// the URL is shared with the request the access log reports, which keeps the alias
+	u := *r.URL
+	u.Path = "/indexes/" + index + match[2]
+	u.RawPath = ""
+
+	r = r.WithContext(context.WithValue(r.Context(), aliasKey{}, aliased))
+	r.URL = &u
+
+	return r
+}
+
+// requestAlias returns the alias a request was made to
+func requestAlias(r *http.Request) (aliasedRequest, bool) {
+	aliased, ok := r.Context().Value(aliasKey{}).(aliasedRequest)
+	return aliased, ok
+}
+
+// rewriteMultiSearch resolves the aliases in the indexUid of each query of a multi-search
+// and applies the search rule of its index, like it's done for searches
+func (p *Proxy) rewriteMultiSearch(r *http.Request) error {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+
+	setBody := func(body []byte) {
+		r.Body = io.NopCloser(strings.NewReader(string(body)))
+		r.ContentLength = int64(len(body))
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(string(body)))
+	decoder.UseNumber()
+
+	var search map[string]interface{}
+	if err := decoder.Decode(&search); err != nil {
+		// let Meilisearch answer invalid bodies
+		setBody(body)
+		return nil
+	}
+
+	queries, _ := search["queries"].([]interface{})
+	// federated multi-searches are paginated as a whole, their queries can't set a limit
+	federation, federated := search["federation"].(map[string]interface{})
+	maxLimit := 0
+
+	rewritten := false
+	for _, query := range queries {
+		query, ok := query.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		uid, ok := query["indexUid"].(string)
+		if !ok {
+			continue
+		}
+
+		index := uid
+		if resolved, ok := p.aliases.resolve(uid); ok {
+			index = resolved
+			query["indexUid"] = index
+			rewritten = true
+		}
+
+		rule := p.searchRule(uid, index)
+		if rule == nil {
+			continue
+		}
+
+		_, hasLimit := query["limit"]
+		_, hasHitsPerPage := query["hitsPerPage"]
+		if err := guardrails.Apply(rule, filterKey(r, rule), query); err != nil {
+			return err
+		}
+		rewritten = true
+
+		if federated {
+			if !hasLimit {
+				delete(query, "limit")
+			}
+			if !hasHitsPerPage {
+				delete(query, "hitsPerPage")
+			}
+			if rule.MaxLimit > 0 && (maxLimit == 0 || rule.MaxLimit < maxLimit) {
+				maxLimit = rule.MaxLimit
+			}
+		}
+	}
+
+	if maxLimit > 0 {
+		guardrails.Apply(&config.SearchRule{MaxLimit: maxLimit}, "", federation)
+	}
+
+	if rewritten {
+		if body, err = json.Marshal(search); err != nil {
+			return err
+		}
+	}
+	setBody(body)
+
+	return nil
+}
+
+// SetAlias points an alias to an index. The entries cached through the alias belong to
+// its previous index, they are invalidated once new requests go to the new index.
+func (p *Proxy) SetAlias(ctx context.Context, alias string, index string) error {
+	previous, existed := p.aliases.set(alias, index)
+	if !existed || previous == index {
+		p.log(ctx).Info().Msgf("Alias %s points to %s", alias, index)
+		return nil
+	}
+
+	p.log(ctx).Info().Msgf("Alias %s moved from %s to %s", alias, previous, index)
+
+	return p.invalidateAlias(ctx, alias)
+}
+
+// RemoveAlias removes an alias and invalidates the entries cached through it
+func (p *Proxy) RemoveAlias(ctx context.Context, alias string) (bool, error) {
+	previous, existed := p.aliases.remove(alias)
+	if !existed {
+		return false, nil
+	}
+
+	p.log(ctx).Info().Msgf("Alias %s to %s removed", alias, previous)
+
+	return true, p.invalidateAlias(ctx, alias)
+}
+
+func (p *Proxy) invalidateAlias(ctx context.Context, alias string) error {
+	if err := p.GetCache().Invalidate(ctx, store.WithInvalidateTags([]string{alias})); err != nil {
+		return fmt.Errorf("error invalidating the cache of alias %s: %w", alias, err)
+	}
+	p.registry.RemoveIndex(alias)
+
+	return nil
+}
+
+type aliasRequest struct {
+	Index string `json:"index"`
+}
+
+type aliasResponse struct {
+	Alias string `json:"alias"`
+	Index string `json:"index"`
+}
+
+// handleAliases serves GET /aliases, and GET, PUT and DELETE /aliases/{alias}
+func (p *Proxy) handleAliases(w http.ResponseWriter, r *http.Request) {
+	if !p.authorizePurge(w, r) {
+		return
+	}
+
+	if r.URL.Path == "/aliases" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		aliases := []aliasResponse{}
+		for alias, index := range p.aliases.all() {
+			aliases = append(aliases, aliasResponse{Alias: alias, Index: index})
+		}
+		sort.Slice(aliases, func(i, j int) bool { return aliases[i].Alias < aliases[j].Alias })
+
+		writeJSON(w, http.StatusOK, aliases)
+		return
+	}
+
+	match := aliasPath.FindStringSubmatch(r.URL.Path)
+	if match == nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	alias := match[1]
+
+	switch r.Method {
+	case http.MethodGet:
+		index, ok := p.aliases.resolve(alias)
+		if !ok {
+			http.Error(w, "Alias not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, aliasResponse{Alias: alias, Index: index})
+
+	case http.MethodPut:
+		var req aliasRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Index == "" {
+			http.Error(w, `Invalid body, expected {"index": "..."}`, http.StatusBadRequest)
+			return
+		}
+		if req.Index == alias {
+			http.Error(w, "An alias cannot point to itself", http.StatusBadRequest)
+			return
+		}
+		if _, ok := p.aliases.resolve(req.Index); ok {
+			http.Error(w, "An alias cannot point to another alias", http.StatusBadRequest)
+			return
+		}
+
+		if err := p.SetAlias(r.Context(), alias, req.Index); err != nil {
+			p.log(r.Context()).Error().Msgf("Error moving alias %s: %s", alias, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, aliasResponse{Alias: alias, Index: req.Index})
+
+	case http.MethodDelete:
+		removed, err := p.RemoveAlias(r.Context(), alias)
+		if err != nil {
+			p.log(r.Context()).Error().Msgf("Error removing alias %s: %s", alias, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !removed {
+			http.Error(w, "Alias not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/analytics"
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/config"
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/logger"
+	"github.com/redis/go-redis/v9"
+)
+
+var analyticsIndexPath = regexp.MustCompile(`^/analytics/indexes/([^/]+)$`)
+
+// newAnalytics creates the recorder of search events and its sinks, nil when analytics are disabled
+func newAnalytics(ctx context.Context, cfg *config.AnalyticsConfig) (*analytics.Recorder, *analytics.Aggregator) {
+	if cfg == nil || !cfg.Enabled {
+		return nil, nil
+	}
+
+	logger := logger.GetLogger()
+
+	var sinks []analytics.Sink
+	for _, name := range cfg.Sinks {
+		switch name {
+		case config.AnalyticsSinkFile:
+			sink, err := analytics.NewFileSink(cfg.File)
+			if err != nil {
+				logger.Fatal().Msgf("Error opening analytics file: %s", err)
+			}
+			sinks = append(sinks, sink)
+		case config.AnalyticsSinkStdout:
+			sinks = append(sinks, analytics.NewWriterSink(os.Stdout))
+		case config.AnalyticsSinkRedis:
+			opts, err := redis.ParseURL(cfg.RedisUrl)
+			if err != nil {
+				logger.Fatal().Msgf("Error parsing analytics Redis URL: %s", err)
+			}
+
+			client := redis.NewClient(opts)
+			if err := client.Ping(ctx).Err(); err != nil {
+				logger.Error().Msg("Redis not available, analytics events are not sent to the Redis stream")
+				client.Close()
+				continue
+			}
+			sinks = append(sinks, analytics.NewRedisStreamSink(client, cfg.RedisStream, cfg.RedisMaxLen))
+		case config.AnalyticsSinkWebhook:
+			sinks = append(sinks, analytics.NewWebhookSink(cfg.WebhookUrl))
+		}
+	}
+
+	logger.Info().Msgf("Recording search analytics, sinks: %s", strings.Join(cfg.Sinks, ", "))
+
+	aggregator := analytics.NewAggregator()
+
+	return analytics.NewRecorder(sinks, aggregator, cfg.BufferSize, cfg.BatchSize, cfg.FlushInterval, logger), aggregator
+}
+
+// clientKeyID identifies the API key of a search without exposing it, tenant tokens
+// are identified by the uid of their API key
+func clientKeyID(r *http.Request) string {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		return ""
+	}
+
+	if claims, ok := parseTenantToken(token); ok {
+		return claims.APIKeyUID
+	}
+
+	return hashKey([]byte(token))[:16]
+}
+
+// recordSearch queues the analytics event of a search answered from the cache or by Meilisearch
+func (p *Proxy) recordSearch(w http.ResponseWriter, r *http.Request, index string, body []byte, query url.Values, start time.Time, status int, response string) {
+	p.analytics.Record(analytics.Search{
+		Time:      start,
+		Index:     index,
+		Method:    r.Method,
+		Body:      body,
+		Query:     query,
+		Response:  response,
+		Cache:     strings.ToLower(w.Header().Get("X-Cache")),
+		ClientKey: clientKeyID(r),
+		Status:    status,
+		Duration:  time.Since(start),
+	})
+}
+
+// handleAnalytics serves GET /analytics, the summary of every index, and
+// GET /analytics/indexes/{index}?limit=20 with the top queries of an index
+func (p *Proxy) handleAnalytics(w http.ResponseWriter, r *http.Request) {
+	if !p.authorizePurge(w, r) {
+		return
+	}
+
+	if p.searchStats == nil {
+		http.Error(w, "Analytics are disabled", http.StatusNotFound)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := strings.TrimSuffix(r.URL.Path, "/")
+
+	if path == "/analytics" {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"indexes": p.searchStats.Summary(),
+			"dropped": p.analytics.Dropped(),
+		})
+		return
+	}
+
+	match := analyticsIndexPath.FindStringSubmatch(path)
+	if match == nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	limit := 20
+	if r.URL.Query().Get("limit") != "" {
+		n, err := strconv.Atoi(r.URL.Query().Get("limit"))
+		if err != nil || n < 1 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	report, ok := p.searchStats.Report(match[1], limit)
+	if !ok {
+		http.Error(w, "No searches recorded for this index", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/config"
+)
+
+// adminPath matches the routes of the proxy API, they get the admin CORS policy
+var adminPath = regexp.MustCompile(`^/(purge|warm|cache|mode|aliases|analytics|experiments|proxy/metrics)(/|$)`)
+
+// corsHeaders are the CORS headers of Meilisearch, replaced by the ones of the proxy
+var corsHeaders = []string{
+	"Access-Control-Allow-Origin",
+	"Access-Control-Allow-Credentials",
+	"Access-Control-Allow-Methods",
+	"Access-Control-Allow-Headers",
+	"Access-Control-Expose-Headers",
+	"Access-Control-Max-Age",
+}
+
+// corsMiddleware applies the CORS policy of the route and answers preflight requests.
+// It runs before authentication and rate limiting, so that browsers can read their errors.
+func (p *Proxy) corsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		policy := p.corsConfig().Public
+		if adminPath.MatchString(r.URL.Path) {
+			policy = p.corsConfig().Admin
+		}
+
+		origin := r.Header.Get("Origin")
+		allowed := allowOrigin(policy, origin)
+
+		// the headers depend on the origin, unless any origin is allowed
+		if allowed != "*" {
+			w.Header().Add("Vary", "Origin")
+		}
+
+		if allowed != "" {
+			w.Header().Set("Access-Control-Allow-Origin", allowed)
+			if policy.AllowCredentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+			if len(policy.ExposedHeaders) > 0 {
+				w.Header().Set("Access-Control-Expose-Headers", strings.Join(policy.ExposedHeaders, ", "))
+			}
+		}
+
+		if r.Method == http.MethodOptions {
+			if allowed != "" && r.Header.Get("Access-Control-Request-Method") != "" {
+				w.Header().Set("Access-Control-Allow-Methods", strings.Join(policy.AllowedMethods, ", "))
+				w.Header().Set("Access-Control-Allow-Headers", strings.Join(policy.AllowedHeaders, ", "))
+				if policy.MaxAge > 0 {
+					w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(policy.MaxAge.Seconds())))
+				}
+			}
+
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (p *Proxy) corsConfig() *config.CORSConfig {
+	if p.GetConfig().CORSConfig == nil {
+		return config.DefaultCORSConfig()
+	}
+
+	return p.GetConfig().CORSConfig
+}
+
+// allowOrigin returns the Access-Control-Allow-Origin of a request from origin, empty
+// when the policy doesn't allow it
+func allowOrigin(policy config.CORSPolicy, origin string) string {
+	if origin == "" {
+		return ""
+	}
+
+	for _, allowed := range policy.AllowedOrigins {
+		if allowed == "*" {
+			return "*"
+		}
+		if strings.EqualFold(allowed, origin) || matchesWildcardOrigin(allowed, origin) {
+			return origin
+		}
+	}
+
+	return ""
+}
+
+// matchesWildcardOrigin matches https://shop.example.com with https://*.example.com,
+// but not https://example.com
+func matchesWildcardOrigin(allowed string, origin string) bool {
+	scheme, domain, ok := strings.Cut(strings.ToLower(allowed), "*")
+	if !ok {
+		return false
+	}
+
+	origin = strings.ToLower(origin)
+	if !strings.HasPrefix(origin, scheme) {
+		return false
+	}
+
+	host := strings.TrimPrefix(origin, scheme)
+	return strings.HasSuffix(host, domain) && len(host) > len(domain)
+}
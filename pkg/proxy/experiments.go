@@ -0,0 +1,185 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/config"
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/experiments"
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/logger"
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/upstream"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var experimentPath = regexp.MustCompile(`^/experiments/([^/]+)$`)
+
+type experimentKey struct{}
+
+// newExperiments creates the experiments of the config, nil when there are none
+func newExperiments(cfg map[string]*config.Experiment, registerer prometheus.Registerer) *experiments.Experiments {
+	if len(cfg) == 0 {
+		return nil
+	}
+
+	logger := logger.GetLogger()
+
+	e, err := experiments.New(cfg, registerer)
+	if err != nil {
+		logger.Fatal().Msgf("Error creating experiments: %s", err)
+	}
+
+	for name, experiment := range cfg {
+		logger.Info().Msgf("Experiment %s splits the searches of %s between %d variants, enabled: %t", name, experiment.Index, len(experiment.Variants), experiment.Enabled)
+	}
+
+	return e
+}
+
+// newVariantProxies creates a reverse proxy per Meilisearch host of the variants of experiments
+func (p *Proxy) newVariantProxies(cfg map[string]*config.Experiment, upstreamConfig *config.UpstreamConfig) map[string]*httputil.ReverseProxy {
+	proxies := make(map[string]*httputil.ReverseProxy)
+
+	// variant hosts are not hedged to the replicas of the primary, nor do they trip its breaker
+	variantConfig := *upstreamConfig
+	variantConfig.Replicas = nil
+
+	for _, experiment := range cfg {
+		for _, variant := range experiment.Variants {
+			if variant.Host == "" || proxies[variant.Host] != nil {
+				continue
+			}
+
+			target, err := url.Parse(variant.Host)
+			if err != nil {
+				p.Logger.Fatal().Msgf("Error parsing the host of variant %s: %s", variant.Name, err)
+			}
+
+			proxy := httputil.NewSingleHostReverseProxy(target)
+			director := proxy.Director
+			proxy.Director = func(req *http.Request) {
+				director(req)
+				req.Host = target.Host
+				req.Header.Set("Accept-Encoding", "deflate,gzip")
+				injectTraceContext(req)
+				forwardRequestID(req)
+			}
+			proxy.Transport = upstream.NewRoundTripper(upstream.NewTransport(&variantConfig, p.upstreamTLS), &variantConfig, nil)
+			proxy.ModifyResponse = p.captureResponse
+			proxy.ErrorHandler = p.handleUpstreamError
+
+			proxies[variant.Host] = proxy
+		}
+	}
+
+	return proxies
+}
+
+// assignExperiment assigns the client of a search to a variant of the experiment of
+// its index, and routes the search to the index of the variant
+func (p *Proxy) assignExperiment(w http.ResponseWriter, r *http.Request, indexes ...string) (*http.Request, experiments.Assignment, bool) {
+	if p.experiments == nil {
+		return r, experiments.Assignment{}, false
+	}
+
+	assignment, ok := p.experiments.Assign(r, indexes...)
+	if !ok {
+		return r, assignment, false
+	}
+
+	w.Header().Set("X-Experiment", assignment.Experiment)
+	w.Header().Set("X-Experiment-Variant", assignment.Variant)
+
+	r = r.WithContext(context.WithValue(r.Context(), experimentKey{}, assignment))
+
+	// the URL is shared with the request the access log reports, which keeps the index
+	if assignment.Index != "" {
+		u := *r.URL
+		u.Path = "/indexes/" + assignment.Index + "/search"
+		u.RawPath = ""
+		r.URL = &u
+	}
+
+	return r, assignment, true
+}
+
+// upstreamProxy returns the reverse proxy a search goes through, the one of the host
+// of its variant for searches of experiments
+func (p *Proxy) upstreamProxy(r *http.Request) *httputil.ReverseProxy {
+	if assignment, ok := r.Context().Value(experimentKey{}).(experiments.Assignment); ok && assignment.Host != "" {
+		return p.variantProxies[assignment.Host]
+	}
+
+	return p.proxy
+}
+
+// observeExperiment records the metrics of the variant of a search, off the request path
+func (p *Proxy) observeExperiment(w http.ResponseWriter, assignment experiments.Assignment, start time.Time, response []byte) {
+	cache := strings.ToLower(w.Header().Get("X-Cache"))
+	duration := time.Since(start)
+
+	go p.experiments.Observe(assignment, cache, duration, response)
+}
+
+type experimentRequest struct {
+	Enabled *bool `json:"enabled"`
+}
+
+// handleExperiments serves GET /experiments, and GET and PUT /experiments/{name}
+func (p *Proxy) handleExperiments(w http.ResponseWriter, r *http.Request) {
+	if !p.authorizePurge(w, r) {
+		return
+	}
+
+	if p.experiments == nil {
+		http.Error(w, "No experiments are configured", http.StatusNotFound)
+		return
+	}
+
+	if r.URL.Path == "/experiments" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, p.experiments.All())
+		return
+	}
+
+	match := experimentPath.FindStringSubmatch(r.URL.Path)
+	if match == nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	name := match[1]
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req experimentRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Enabled == nil {
+			http.Error(w, `Invalid body, expected {"enabled": true|false}`, http.StatusBadRequest)
+			return
+		}
+
+		if p.experiments.SetEnabled(name, *req.Enabled) {
+			p.log(r.Context()).Info().Msgf("Experiment %s enabled: %t", name, *req.Enabled)
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	status, ok := p.experiments.Get(name)
+	if !ok {
+		http.Error(w, "Experiment not found", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, status)
+}
@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/eko/gocache/lib/v4/store"
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/config"
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/upstream"
+)
+
+const (
+	componentMeilisearch = "meilisearch"
+	componentCache       = "cache"
+	componentUpstream    = "upstream"
+)
+
+var healthPath = regexp.MustCompile(`^/health(/|$)`)
+
+type componentStatus struct {
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"durationMs"`
+}
+
+type readinessResponse struct {
+	Status     string                     `json:"status"`
+	Mode       string                     `json:"mode"`
+	Policy     string                     `json:"policy"`
+	Components map[string]componentStatus `json:"components"`
+}
+
+func (p *Proxy) healthConfig() *config.HealthConfig {
+	if p.GetConfig().HealthConfig == nil {
+		return config.DefaultHealthConfig()
+	}
+
+	return p.GetConfig().HealthConfig
+}
+
+func (p *Proxy) handleHealth(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/health/ready":
+		p.handleReadiness(w, r)
+		return
+	case "/health/live", "/health":
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{
+		"status": "available",
+		"mode":   p.mode(),
+	})
+}
+
+// handleReadiness probes Meilisearch and does a round trip to the cache engine.
+// With the stale policy and a stale TTL, or in cache-only mode, the proxy stays ready
+// while Meilisearch is down as long as the cache can still serve searches.
+func (p *Proxy) handleReadiness(w http.ResponseWriter, r *http.Request) {
+	cfg := p.healthConfig()
+
+	// fail readiness ahead of the shutdown so the load balancer stops sending traffic
+	if p.shuttingDown.Load() {
+		writeJSON(w, http.StatusServiceUnavailable, readinessResponse{
+			Status:     "shutting_down",
+			Mode:       p.mode(),
+			Policy:     cfg.ReadinessPolicy,
+			Components: map[string]componentStatus{},
+		})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), cfg.CheckTimeout)
+	defer cancel()
+
+	checks := map[string]func(context.Context) error{
+		componentMeilisearch: func(ctx context.Context) error {
+			return p.checkUpstreamHealth(ctx, cfg.CheckTimeout)
+		},
+		componentCache: p.checkCache,
+	}
+	if p.breaker != nil {
+		checks[componentUpstream] = p.checkBreaker
+	}
+
+	response := readinessResponse{
+		Status:     "ready",
+		Mode:       p.mode(),
+		Policy:     cfg.ReadinessPolicy,
+		Components: make(map[string]componentStatus, len(checks)),
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check func(context.Context) error) {
+			defer wg.Done()
+
+			start := time.Now()
+			err := check(ctx)
+
+			status := componentStatus{Status: "ok", DurationMs: time.Since(start).Milliseconds()}
+			if err != nil {
+				status.Status = "failed"
+				status.Error = err.Error()
+			}
+
+			mu.Lock()
+			response.Components[name] = status
+			mu.Unlock()
+		}(name, check)
+	}
+	wg.Wait()
+
+	// stale copies are only kept with a stale TTL, in cache-only mode every search is answered from the cache
+	canServeStale := (cfg.ReadinessPolicy == config.ReadinessStale && p.GetConfig().CacheConfig.StaleTTL > 0) || p.cacheOnly.Load()
+
+	for name, status := range response.Components {
+		if status.Status == "ok" {
+			continue
+		}
+		if (name == componentMeilisearch || name == componentUpstream) && canServeStale && response.Components[componentCache].Status == "ok" {
+			continue
+		}
+
+		response.Status = "not_ready"
+	}
+
+	if response.Status != "ready" {
+		p.log(r.Context()).Warn().Msgf("Readiness check failed: %+v", response.Components)
+		writeJSON(w, http.StatusServiceUnavailable, response)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// checkBreaker fails while the circuit to Meilisearch is open
+func (p *Proxy) checkBreaker(ctx context.Context) error {
+	for host, state := range p.breaker.States() {
+		if state == upstream.StateOpen {
+			return fmt.Errorf("circuit breaker for %s is open", host)
+		}
+	}
+
+	return nil
+}
+
+// checkCache writes, reads and deletes a probe key in the cache engine
+func (p *Proxy) checkCache(ctx context.Context) error {
+	key := fmt.Sprintf("meilisearch-proxy:readiness:%d", time.Now().UnixNano())
+
+	if err := p.GetCache().Set(ctx, key, "ok", store.WithExpiration(time.Minute)); err != nil {
+		return fmt.Errorf("error writing to cache: %w", err)
+	}
+
+	// ristretto applies writes asynchronously, give it a moment
+	var value string
+	var err error
+	for attempt := 0; attempt < 10; attempt++ {
+		if value, err = p.GetCache().Get(ctx, key); err == nil {
+			break
+		}
+
+		select {
+		case <-time.After(10 * time.Millisecond):
+		case <-ctx.Done():
+			return fmt.Errorf("error reading from cache: %w", ctx.Err())
+		}
+	}
+
+	if err != nil {
+		return fmt.Errorf("error reading from cache: %w", err)
+	}
+
+	if value != "ok" {
+		return fmt.Errorf("cache returned %q instead of the written value", value)
+	}
+
+	return p.GetCache().Delete(ctx, key)
+}
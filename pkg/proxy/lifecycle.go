@@ -0,0 +1,289 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/caching"
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/certs"
+)
+
+// recycled cache engines are closed after this delay so in-flight requests can finish
+const cacheCloseDelay = time.Minute
+
+// traceFlushTimeout bounds the export of the spans left on shutdown
+const traceFlushTimeout = 5 * time.Second
+
+// recyclableTransport is the upstream transport of the proxy. Recycle swaps the
+// underlying transport, new requests use fresh connections while in-flight
+// requests finish on the old ones.
+type recyclableTransport struct {
+	current      atomic.Pointer[http.Transport]
+	newTransport func() *http.Transport
+}
+
+func newRecyclableTransport(newTransport func() *http.Transport) *recyclableTransport {
+	t := &recyclableTransport{newTransport: newTransport}
+	t.current.Store(newTransport())
+
+	return t
+}
+
+func (t *recyclableTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.current.Load().RoundTrip(req)
+}
+
+func (t *recyclableTransport) Recycle() {
+	old := t.current.Swap(t.newTransport())
+	old.CloseIdleConnections()
+}
+
+// Listen serves the proxy until SIGTERM or SIGINT is received, then shuts down gracefully.
+// SIGHUP reloads the config.
+func (p *Proxy) Listen() error {
+	mux := http.NewServeMux()
+
+	// mux / with all middlewares, CORS first so that browsers can read auth and rate limit errors
+	mux.Handle("/", p.requestIDMiddleware(p.accessLogMiddleware(p.corsMiddleware(p.rateLimitMiddleware(p.authMiddleware(p.headersMiddleware(p)))))))
+
+	server := &http.Server{
+		Addr:              fmt.Sprintf(":%s", p.GetConfig().Port),
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return p.Context },
+	}
+
+	tlsConfig := p.GetConfig().TLSConfig
+	if tlsConfig != nil && tlsConfig.CertFile != "" {
+		certificate, err := certs.Load(tlsConfig.CertFile, tlsConfig.KeyFile)
+		if err != nil {
+			return err
+		}
+
+		// HTTP/2 is negotiated by ServeTLS
+		server.TLSConfig = &tls.Config{
+			GetCertificate: certificate.GetCertificate,
+			MinVersion:     tls.VersionTLS12,
+		}
+
+		p.lifecycleMu.Lock()
+		p.certificates = append(p.certificates, certificate)
+		p.lifecycleMu.Unlock()
+	}
+
+	var adminServer *http.Server
+	var adminListener net.Listener
+	if address := p.adminListener(); address != "" {
+		var err error
+		adminListener, err = listenAdmin(address)
+		if err != nil {
+			return fmt.Errorf("error listening on %s: %w", address, err)
+		}
+
+		adminMux := http.NewServeMux()
+		adminMux.Handle("/", p.requestIDMiddleware(p.accessLogMiddleware(p.corsMiddleware(p.headersMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p.serve(w, r, adminRoutes)
+		}))))))
+
+		adminServer = &http.Server{
+			Handler:           adminMux,
+			ReadHeaderTimeout: 10 * time.Second,
+			BaseContext:       func(net.Listener) context.Context { return p.Context },
+		}
+	}
+
+	p.lifecycleMu.Lock()
+	p.server = server
+	p.adminServer = adminServer
+	p.lifecycleMu.Unlock()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	errs := make(chan error, 2)
+	if adminServer != nil {
+		go func() {
+			p.Logger.Info().Msgf("Starting admin server on %s", adminListener.Addr())
+			errs <- adminServer.Serve(adminListener)
+		}()
+	}
+
+	go func() {
+		if server.TLSConfig != nil {
+			p.Logger.Info().Msgf("Starting proxy server on :%s with TLS", p.GetConfig().Port)
+			errs <- server.ListenAndServeTLS("", "")
+			return
+		}
+
+		p.Logger.Info().Msgf("Starting proxy server on :%s", p.GetConfig().Port)
+		errs <- server.ListenAndServe()
+	}()
+
+	for {
+		select {
+		case err := <-errs:
+			if errors.Is(err, http.ErrServerClosed) {
+				return nil
+			}
+			return err
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				p.reload("SIGHUP")
+				continue
+			}
+
+			p.Logger.Info().Msgf("Received %s, shutting down", sig)
+			return p.Shutdown(context.Background())
+		}
+	}
+}
+
+func (p *Proxy) adminListener() string {
+	if p.GetConfig().AdminConfig == nil {
+		return ""
+	}
+
+	return p.GetConfig().AdminConfig.Listen
+}
+
+// listenAdmin listens on a port, an address or a unix socket, see config.AdminConfig
+func listenAdmin(address string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(address, "unix:"); ok {
+		// a socket left behind by a previous process fails the listen
+		if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+		return net.Listen("unix", path)
+	}
+
+	if !strings.Contains(address, ":") {
+		address = ":" + address
+	}
+	return net.Listen("tcp", address)
+}
+
+// Shutdown fails readiness, waits for the configured delay so load balancers stop
+// routing to this instance, then drains in-flight requests within the shutdown timeout
+func (p *Proxy) Shutdown(ctx context.Context) error {
+	if p.shuttingDown.Swap(true) {
+		return nil
+	}
+
+	cfg := p.GetConfig()
+
+	if cfg.ShutdownDelay > 0 {
+		p.Logger.Info().Msgf("Readiness is failing, waiting %s before shutting down", cfg.ShutdownDelay)
+
+		select {
+		case <-time.After(cfg.ShutdownDelay):
+		case <-ctx.Done():
+		}
+	}
+
+	if cfg.ShutdownTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.ShutdownTimeout)
+		defer cancel()
+	}
+
+	p.lifecycleMu.Lock()
+	server, adminServer := p.server, p.adminServer
+	p.lifecycleMu.Unlock()
+
+	var err error
+	if server != nil {
+		p.Logger.Info().Msg("Draining in-flight requests")
+		err = server.Shutdown(ctx)
+		if err != nil {
+			p.Logger.Error().Msgf("Error draining in-flight requests: %s", err)
+		}
+	}
+	if adminServer != nil {
+		if adminErr := adminServer.Shutdown(ctx); adminErr != nil {
+			p.Logger.Error().Msgf("Error draining in-flight admin requests: %s", adminErr)
+			err = errors.Join(err, adminErr)
+		}
+	}
+
+	// stop background work (warming, recycling, purge jobs)
+	p.cancel()
+
+	if p.analytics != nil {
+		if closeErr := p.analytics.Close(); closeErr != nil {
+			p.Logger.Error().Msgf("Error flushing search analytics: %s", closeErr)
+		}
+	}
+
+	// draining may have used up the shutdown context, the spans of the drained
+	// requests still need to be exported
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), traceFlushTimeout)
+	defer cancelFlush()
+
+	if closeErr := p.closeTracing(flushCtx); closeErr != nil {
+		p.Logger.Error().Msgf("Error flushing traces: %s", closeErr)
+	}
+
+	p.lifecycleMu.Lock()
+	closeCache := p.closeCache
+	p.lifecycleMu.Unlock()
+
+	if closeErr := closeCache(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+
+	p.Logger.Info().Msg("Proxy stopped")
+
+	return err
+}
+
+// Recycle replaces the upstream transport and the cache engine in-process. This is
+// what AUTO_RESTART_INTERVAL does, instead of failing health checks to get restarted.
+// Note that recycling the memory engine starts from an empty cache.
+func (p *Proxy) Recycle() {
+	p.Logger.Info().Msg("Recycling upstream transport and cache engine")
+
+	p.transport.Recycle()
+
+	cache, closeCache := caching.Open(p.Context, p.GetConfig().CacheConfig, p.registry)
+	p.cache.Store(cache)
+
+	p.lifecycleMu.Lock()
+	closeOld := p.closeCache
+	p.closeCache = closeCache
+	p.lifecycleMu.Unlock()
+
+	if p.GetConfig().CacheConfig.Engine == "memory" {
+		p.registry.Clear()
+	}
+
+	time.AfterFunc(cacheCloseDelay, func() {
+		if err := closeOld(); err != nil {
+			p.Logger.Error().Msgf("Error closing recycled cache engine: %s", err)
+		}
+	})
+}
+
+func (p *Proxy) recyclePeriodically() {
+	ticker := time.NewTicker(p.GetConfig().AutoRestartInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.Recycle()
+		case <-p.Context.Done():
+			return
+		}
+	}
+}
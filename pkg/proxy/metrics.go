@@ -0,0 +1,32 @@
+package proxy
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// newMetricsRegistry creates the registry of the metrics served on /proxy/metrics, each
+// proxy has its own so several can run in one process
+func newMetricsRegistry() *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+
+	return registry
+}
+
+// handleMetrics serves the metrics of the proxy in the Prometheus format
+func (p *Proxy) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if !p.authorizePurge(w, r) {
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	promhttp.HandlerFor(p.metrics, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
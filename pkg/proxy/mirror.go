@@ -0,0 +1,28 @@
+package proxy
+
+import (
+	"context"
+
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/config"
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/logger"
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/mirror"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// newMirror creates the mirror to the shadow instance, nil when mirroring is disabled
+func newMirror(ctx context.Context, cfg *config.MirrorConfig, registerer prometheus.Registerer) *mirror.Mirror {
+	if cfg == nil || cfg.Host == "" || cfg.SampleRate <= 0 {
+		return nil
+	}
+
+	logger := logger.GetLogger()
+
+	m, err := mirror.New(ctx, cfg, registerer, logger)
+	if err != nil {
+		logger.Fatal().Msgf("Error creating the shadow mirror: %s", err)
+	}
+
+	logger.Info().Msgf("Mirroring %g%% of the cache misses to the shadow instance %s", cfg.SampleRate, cfg.Host)
+
+	return m
+}
@@ -0,0 +1,193 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/config"
+)
+
+const (
+	modeNormal    = "normal"
+	modeCacheOnly = "cache-only"
+)
+
+// POST routes of the Meilisearch API that only read data
+var readOnlyPostPath = regexp.MustCompile(`^/(multi-search|indexes/[^/]+/(search|facet-search|documents/fetch))$`)
+
+// meilisearchError mirrors the error body returned by Meilisearch so clients
+// handle errors of the proxy the same way as errors of Meilisearch
+type meilisearchError struct {
+	Message string `json:"message"`
+	Code    string `json:"code"`
+	Type    string `json:"type"`
+	Link    string `json:"link"`
+}
+
+func writeMeilisearchError(w http.ResponseWriter, status int, code string, message string) {
+	errorType := "system"
+	switch status {
+	case http.StatusBadRequest:
+		errorType = "invalid_request"
+	case http.StatusForbidden:
+		errorType = "auth"
+	}
+
+	writeJSON(w, status, meilisearchError{
+		Message: message,
+		Code:    code,
+		Type:    errorType,
+		Link:    "https://docs.meilisearch.com/errors#" + code,
+	})
+}
+
+func isWriteRequest(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	case http.MethodPost:
+		return !readOnlyPostPath.MatchString(r.URL.Path)
+	}
+
+	return true
+}
+
+func (p *Proxy) cacheOnlyConfig() *config.CacheOnlyConfig {
+	if p.GetConfig().CacheOnlyConfig == nil {
+		return config.DefaultCacheOnlyConfig()
+	}
+
+	return p.GetConfig().CacheOnlyConfig
+}
+
+func (p *Proxy) mode() string {
+	if p.cacheOnly.Load() {
+		return modeCacheOnly
+	}
+
+	return modeNormal
+}
+
+// SetCacheOnly toggles the cache-only maintenance mode
+func (p *Proxy) SetCacheOnly(enabled bool) {
+	p.setCacheOnly(context.Background(), enabled)
+}
+
+// setCacheOnly toggles the cache-only mode, logging the change with the logger of ctx
+func (p *Proxy) setCacheOnly(ctx context.Context, enabled bool) {
+	if p.cacheOnly.Swap(enabled) != enabled {
+		p.log(ctx).Warn().Msgf("Proxy mode changed to %s", p.mode())
+	}
+}
+
+// rejectWrite answers writes with a 503 while in cache-only mode
+func (p *Proxy) rejectWrite(w http.ResponseWriter) {
+	retryAfter := p.cacheOnlyConfig().RetryAfter
+	if retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+	}
+
+	writeMeilisearchError(w, http.StatusServiceUnavailable, "proxy_cache_only",
+		"The search service is in maintenance, writes are temporarily disabled.")
+}
+
+// writeCacheOnlyMiss answers a search that is not cached while in cache-only mode
+func (p *Proxy) writeCacheOnlyMiss(w http.ResponseWriter, r *http.Request, body []byte) {
+	if p.cacheOnlyConfig().MissResponse != config.CacheOnlyMissEmpty {
+		writeCacheOnlyError(w)
+		return
+	}
+
+	query := r.URL.Query().Get("q")
+	if len(body) > 0 {
+		var search struct {
+			Q string `json:"q"`
+		}
+		json.Unmarshal(body, &search)
+		query = search.Q
+	}
+
+	writeJSON(w, http.StatusOK, emptySearchResponse(query))
+}
+
+// writeCacheOnlyMultiSearch answers a multi-search while in cache-only mode. Multi-searches
+// aren't cached, so they are always answered like a cache miss.
+func (p *Proxy) writeCacheOnlyMultiSearch(w http.ResponseWriter, r *http.Request) {
+	if p.cacheOnlyConfig().MissResponse != config.CacheOnlyMissEmpty {
+		writeCacheOnlyError(w)
+		return
+	}
+
+	var search struct {
+		Federation json.RawMessage `json:"federation"`
+		Queries    []struct {
+			IndexUID string `json:"indexUid"`
+			Q        string `json:"q"`
+		} `json:"queries"`
+	}
+	json.NewDecoder(r.Body).Decode(&search)
+
+	// federated multi-searches return a single list of hits
+	if len(search.Federation) > 0 && string(search.Federation) != "null" {
+		writeJSON(w, http.StatusOK, emptySearchResponse(""))
+		return
+	}
+
+	results := make([]map[string]interface{}, 0, len(search.Queries))
+	for _, query := range search.Queries {
+		result := emptySearchResponse(query.Q)
+		result["indexUid"] = query.IndexUID
+		results = append(results, result)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"results": results})
+}
+
+func writeCacheOnlyError(w http.ResponseWriter) {
+	writeMeilisearchError(w, http.StatusServiceUnavailable, "proxy_cache_only",
+		"The search service is in maintenance, only cached searches are available.")
+}
+
+func emptySearchResponse(query string) map[string]interface{} {
+	return map[string]interface{}{
+		"hits":               []interface{}{},
+		"query":              query,
+		"processingTimeMs":   0,
+		"limit":              20,
+		"offset":             0,
+		"estimatedTotalHits": 0,
+	}
+}
+
+// handleMode reads (GET) or changes (PUT, POST) the proxy mode:
+//
+//	{"cacheOnly": true}
+func (p *Proxy) handleMode(w http.ResponseWriter, r *http.Request) {
+	if !p.authorizePurge(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		var request struct {
+			CacheOnly *bool `json:"cacheOnly"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.CacheOnly == nil {
+			http.Error(w, `Invalid mode request, expected {"cacheOnly": true|false}`, http.StatusBadRequest)
+			return
+		}
+		p.setCacheOnly(r.Context(), *request.CacheOnly)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"mode":      p.mode(),
+		"cacheOnly": p.cacheOnly.Load(),
+	})
+}
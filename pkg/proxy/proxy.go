@@ -1,37 +1,81 @@
 package proxy
 
 import (
-	"compress/flate"
-	"compress/gzip"
 	"context"
 	"crypto/sha256"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
-	"net/http/httptest"
 	"net/http/httputil"
 	"net/url"
 	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/eko/gocache/lib/v4/cache"
 	"github.com/eko/gocache/lib/v4/store"
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/analytics"
 	"github.com/maxroll-media-group/meilisearch-proxy/pkg/caching"
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/certs"
 	"github.com/maxroll-media-group/meilisearch-proxy/pkg/config"
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/experiments"
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/guardrails"
 	"github.com/maxroll-media-group/meilisearch-proxy/pkg/logger"
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/mirror"
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/routepolicy"
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/upstream"
 	"github.com/maxroll-media-group/meilisearch-proxy/pkg/util"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Proxy struct {
 	source *url.URL
 
 	proxy       *httputil.ReverseProxy
-	cache       *cache.Cache[string]
-	config      *config.Config
+	cache       atomic.Pointer[cache.Cache[string]]
+	closeCache  func() error
+	transport   *recyclableTransport
+	upstreamTLS *tls.Config
+	breaker     *upstream.Breaker
+	rateLimiter *clientLimiter
+	aliases     *aliasTable
+	analytics   *analytics.Recorder
+	searchStats *analytics.Aggregator
+	mirror      *mirror.Mirror
+	experiments *experiments.Experiments
+	metrics     *prometheus.Registry
+	registry    *caching.Registry
+	config      atomic.Pointer[config.Config]
 	startupTime time.Time
+	queries     *queryTracker
+	warmLimiter *rateLimiter
+	purgeJobs   *purgeJobs
+	cacheOnly   atomic.Bool
+	routePolicy atomic.Pointer[routepolicy.Policy]
+
+	// variantProxies are the reverse proxies to the hosts of the variants of experiments
+	variantProxies map[string]*httputil.ReverseProxy
+	tracer         trace.Tracer
+	closeTracing   func(context.Context) error
+
+	server      *http.Server
+	adminServer *http.Server
+	// certificates are the certificates of the listener and of mTLS to Meilisearch, reloaded with the config
+	certificates []*certs.Certificate
+	lifecycleMu  sync.Mutex
+	shuttingDown atomic.Bool
+	cancel       context.CancelFunc
+
 	context.Context
 	zerolog.Logger
 }
@@ -46,8 +90,32 @@ func NewProxy(config *config.Config) *Proxy {
 
 	logger.Info().Msgf("Meilisearch host: %s", source.String())
 
-	ctx := context.Background()
+	ctx, cancel := context.WithCancel(context.Background())
+	closeTracing := newTracing(ctx, config.TracingConfig)
 	proxy := httputil.NewSingleHostReverseProxy(source)
+	upstreamConfig := config.UpstreamConfig
+	if upstreamConfig == nil {
+		upstreamConfig = defaultUpstreamConfig()
+	}
+
+	upstreamTLS, clientCertificate, err := upstreamConfig.TLS()
+	if err != nil {
+		logger.Fatal().Msgf("Error loading the TLS settings of Meilisearch: %s", err)
+	}
+	if upstreamConfig.InsecureSkipVerify {
+		logger.Warn().Msg("The certificate of Meilisearch is not verified")
+	}
+
+	transport := newRecyclableTransport(func() *http.Transport {
+		return upstream.NewTransport(upstreamConfig, upstreamTLS)
+	})
+
+	var breaker *upstream.Breaker
+	if upstreamConfig.BreakerThreshold > 0 {
+		breaker = upstream.NewBreaker(upstreamConfig.BreakerThreshold, upstreamConfig.BreakerCooldown)
+	}
+
+	proxy.Transport = upstream.NewRoundTripper(transport, upstreamConfig, breaker)
 
 	proxy.Director = func(req *http.Request) {
 		req.URL.Scheme = source.Scheme
@@ -64,163 +132,446 @@ func NewProxy(config *config.Config) *Proxy {
 		}
 
 		req.Header.Set("Accept-Encoding", "deflate,gzip")
-
-	}
-	cache := caching.NewCache(ctx, config.CacheConfig)
-
-	if config.AutoRestartInterval > 0 {
-		logger.Info().Msgf("Auto restart interval set to %s", config.AutoRestartInterval)
+		injectTraceContext(req)
+		forwardRequestID(req)
 	}
+	registry := caching.NewRegistry(caching.DefaultMaxEntries)
+	cache, closeCache := caching.Open(ctx, config.CacheConfig, registry)
 
-	return &Proxy{
+	p := &Proxy{
 		source:      source,
 		proxy:       proxy,
-		cache:       cache,
-		config:      config,
+		closeCache:  closeCache,
+		transport:   transport,
+		upstreamTLS: upstreamTLS,
+		breaker:     breaker,
+		registry:    registry,
+		cancel:      cancel,
 		Context:     ctx,
 		Logger:      logger,
 		startupTime: time.Now(),
+		warmLimiter: newRateLimiter(5),
+		purgeJobs:   newPurgeJobs(),
+		rateLimiter: newClientLimiter(ctx, config.RateLimitConfig),
+		aliases:     newAliasTable(config.IndexAliases),
+		metrics:     newMetricsRegistry(),
+
+		tracer:       otel.Tracer(tracerName),
+		closeTracing: closeTracing,
 	}
-}
+	p.cache.Store(cache)
+	p.config.Store(config)
 
-func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	routePolicy, err := newRoutePolicy(config.RoutePolicyConfig)
+	if err != nil {
+		logger.Fatal().Msgf("Error loading the route policy: %s", err)
+	}
+	p.routePolicy.Store(routePolicy)
+	if policy := config.RoutePolicyConfig; config.ProxyMasterKeyOverride && (policy == nil || policy.Preset == routepolicy.PresetAll && len(policy.Deny) == 0) {
+		logger.Warn().Msg("Every route of Meilisearch is forwarded with the master key, consider ROUTE_POLICY=read-only or search-only")
+	}
+	if clientCertificate != nil {
+		p.certificates = append(p.certificates, clientCertificate)
+	}
+	p.analytics, p.searchStats = newAnalytics(ctx, config.AnalyticsConfig)
+	p.mirror = newMirror(ctx, config.MirrorConfig, p.metrics)
+	p.experiments = newExperiments(config.Experiments, p.metrics)
+	p.variantProxies = p.newVariantProxies(config.Experiments, upstreamConfig)
+	proxy.ModifyResponse = p.captureResponse
+	proxy.ErrorHandler = p.handleUpstreamError
+
+	if watched := config.WatchedFiles(); len(watched) > 0 && config.ReloadInterval > 0 {
+		logger.Info().Msgf("Reloading the config when %s change, checked every %s", strings.Join(watched, ", "), config.ReloadInterval)
+		go p.watchConfig(watched, config.ReloadInterval)
+	}
 
-	if r.URL.Path == "/health" {
-		// TODO: Implement a more robust health check
-		// challenge: the health check should check if the underlying meilisearch is reachable
-		// and if the cache is working. However, stale cache entries should still be used to avoid downtime.
+	if config.AutoRestartInterval > 0 {
+		logger.Info().Msgf("Auto restart interval set to %s, the upstream transport and cache engine are recycled in-process", config.AutoRestartInterval)
+		go p.recyclePeriodically()
+	}
+
+	if config.CacheOnlyConfig != nil && config.CacheOnlyConfig.Enabled {
+		logger.Warn().Msg("Starting in cache-only mode, searches are only served from the cache")
+		p.cacheOnly.Store(true)
+	}
 
-		autoRestartInterval := p.config.AutoRestartInterval
+	if warm := config.WarmConfig; warm != nil {
+		p.warmLimiter = newRateLimiter(warm.Rate)
 
-		if autoRestartInterval > 0 {
-			// auto restart interval is time (1h, 1d, 1w, 1m, 1y)
-			// if the proxy is running for more than the interval, it should restart itself
-			// this is to avoid memory leaks and other issues
-			if time.Since(p.startupTime) > autoRestartInterval {
-				p.Logger.Warn().Msgf("Restarting proxy after running for %s", autoRestartInterval)
+		if warm.TopN > 0 {
+			logger.Info().Msgf("Tracking the %d most popular queries per index for cache warming", warm.TopN)
+			p.queries = newQueryTracker(warm.TopN, warm.HalfLife)
 
-				// fail the health check
-				w.WriteHeader(http.StatusServiceUnavailable)
-				return
+			if warm.Interval > 0 {
+				logger.Info().Msgf("Cache warming interval set to %s", warm.Interval)
+				go p.warmPeriodically()
 			}
-
 		}
+	}
+
+	return p
+}
+
+// routes are the routes served by a listener
+type routes int
+
+const (
+	// publicRoutes are the searches and the other routes of Meilisearch
+	publicRoutes routes = 1 << iota
+	// adminRoutes are the routes of the proxy, see config.AdminConfig
+	adminRoutes
 
-		w.WriteHeader(http.StatusOK)
+	allRoutes = publicRoutes | adminRoutes
+)
+
+// ServeHTTP serves the public listener, with the admin routes unless they have their own listener
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if p.adminListener() != "" {
+		p.serve(w, r, publicRoutes)
 		return
 	}
 
-	if regexp.MustCompile(`^/indexes/[^/]+/search$`).MatchString(r.URL.Path) {
+	p.serve(w, r, allRoutes)
+}
+
+func (p *Proxy) serve(w http.ResponseWriter, r *http.Request, routes routes) {
+	r = p.withRequestID(w, r)
+	r = p.resolveAlias(r)
+
+	r, span := p.startRequestSpan(r)
+	recordTrace(r.Context())
+	recorder := recordResponse(w)
+	defer endRequestSpan(span, recorder)
+	w = recorder
+
+	public, admin := routes&publicRoutes != 0, routes&adminRoutes != 0
+
+	if healthPath.MatchString(r.URL.Path) {
+		p.handleHealth(w, r)
+	} else if public && regexp.MustCompile(`^/indexes/[^/]+/search$`).MatchString(r.URL.Path) {
 		p.handleSearch(w, r)
-	} else if regexp.MustCompile(`^/purge(/|$)`).MatchString(r.URL.Path) {
+	} else if admin && regexp.MustCompile(`^/purge(/|$)`).MatchString(r.URL.Path) {
 		p.handlePurge(w, r)
-	} else {
+	} else if admin && regexp.MustCompile(`^/warm/[^/]+$`).MatchString(r.URL.Path) {
+		p.handleWarm(w, r)
+	} else if admin && regexp.MustCompile(`^/cache(/|$)`).MatchString(r.URL.Path) {
+		p.handleCache(w, r)
+	} else if admin && r.URL.Path == "/mode" {
+		p.handleMode(w, r)
+	} else if admin && regexp.MustCompile(`^/aliases(/|$)`).MatchString(r.URL.Path) {
+		p.handleAliases(w, r)
+	} else if admin && regexp.MustCompile(`^/analytics(/|$)`).MatchString(r.URL.Path) {
+		p.handleAnalytics(w, r)
+	} else if admin && regexp.MustCompile(`^/experiments(/|$)`).MatchString(r.URL.Path) {
+		p.handleExperiments(w, r)
+	} else if admin && r.URL.Path == "/proxy/metrics" {
+		p.handleMetrics(w, r)
+	} else if public {
 		p.handleDefault(w, r)
+	} else {
+		writeMeilisearchError(w, http.StatusNotFound, "proxy_route_not_found",
+			"The admin listener only serves the routes of the proxy.")
 	}
 }
 
 func (p *Proxy) handleSearch(w http.ResponseWriter, r *http.Request) {
+	if !p.allowRoute(w, r) {
+		return
+	}
+
+	start := time.Now()
+	logger := p.log(r.Context())
 	indexName := util.ExtractIndexName(r.URL.Path)
 
-	cacheKey := sha256.Sum256([]byte(r.URL.Path))
+	// entries cached through an alias are tagged by both names
+	tags := []string{indexName}
+	rule := p.searchRule(indexName)
+
+	// warming replays searches as clients sent them, the aliases and rules are resolved again
+	originalIndex, originalPath := indexName, r.URL.Path
+	aliased, isAliased := requestAlias(r)
+	span := trace.SpanFromContext(r.Context())
+	span.SetAttributes(attribute.String("meilisearch.index", indexName))
+
+	if isAliased {
+		span.SetAttributes(attribute.String("meilisearch.alias", aliased.alias))
+		tags = append(tags, aliased.alias)
+		rule = p.searchRule(aliased.alias, indexName)
+		originalIndex, originalPath = aliased.alias, aliased.path
+	}
+	if r.URL.RawQuery != "" {
+		originalPath = originalPath + "?" + r.URL.RawQuery
+	}
+	originalQuery := r.URL.Query()
+
+	r, assignment, inExperiment := p.assignExperiment(w, r, originalIndex, indexName)
+	if inExperiment {
+		span.SetAttributes(attribute.String("meilisearch_proxy.experiment", assignment.Experiment), attribute.String("meilisearch_proxy.variant", assignment.Variant))
+		if assignment.Index != "" {
+			tags = append(tags, assignment.Index)
+		}
+	}
+
+	keyFilter := filterKey(r, rule)
+
+	if r.Method == http.MethodGet && rule != nil {
+		query, err := guardrails.RewriteQuery(rule, keyFilter, r.URL.Query())
+		if err != nil {
+			p.rejectSearch(w, r, err)
+			return
+		}
+		r.URL.RawQuery = query.Encode()
+	}
+
+	// GET searches carry their parameters in the query string
+	path := r.URL.Path
+	if r.URL.RawQuery != "" {
+		path = path + "?" + r.URL.RawQuery
+	}
+
+	// searches of experiments are cached per variant
+	keyPath := path
+	if inExperiment {
+		keyPath = assignment.Experiment + "/" + assignment.Variant + " " + path
+	}
+
+	var originalBody, canonicalBody []byte
+	cacheKey := sha256.Sum256([]byte(keyPath))
 	if r.Method == http.MethodPost {
 		body, err := io.ReadAll(r.Body)
 		if err != nil {
-			log.Printf("Error reading request body: %s", err)
+			logger.Error().Msgf("Error reading request body: %s", err)
 			http.Error(w, "Error reading request body", http.StatusInternalServerError)
 			return
 		}
-		cacheKey = sha256.Sum256(append(cacheKey[:], body...))
+		originalBody = util.CanonicalJSON(body)
+
+		// the rewritten body is what gets cached and sent to Meilisearch
+		body, err = guardrails.RewriteBody(rule, keyFilter, body)
+		if err != nil {
+			p.rejectSearch(w, r, err)
+			return
+		}
+
+		// hash the canonical body so key order and whitespace don't split the cache
+		canonicalBody = util.CanonicalJSON(body)
+		cacheKey = sha256.Sum256(append(cacheKey[:], canonicalBody...))
 		r.Body = io.NopCloser(strings.NewReader(string(body))) // Reset the body after reading
+		r.ContentLength = int64(len(body))
+	}
+
+	// searches filtered by their key are cached per credential, so that the entry is never
+	// served to a request that only sends the same rewritten search
+	if keyFilter != "" {
+		cacheKey = sha256.Sum256(append(cacheKey[:], hashKey([]byte(r.Header.Get("Authorization")))...))
 	}
 
 	cacheKeyString := fmt.Sprintf("%x", cacheKey)
 
+	// only successful searches are tracked, so searches of indexes that don't exist
+	// don't grow the tracker. Warming replays with the master key, searches restricted
+	// by their key aren't tracked so that they are never cached unrestricted.
+	trackQuery := p.queries != nil && !isWarmRequest(r.Context()) && !restrictedSearch(r, rule)
+	recordAnalytics := p.analytics != nil && !isWarmRequest(r.Context())
+	// only searches answered by Meilisearch are mirrored, a cached response may predate
+	// the documents of the shadow instance and would show differences of its own
+	mirrorSearch := p.mirror != nil && !isWarmRequest(r.Context())
+
 	// Check if response is in cache
-	if response, err := p.cache.Get(r.Context(), cacheKeyString); err == nil {
-		p.Logger.Info().Msgf("[%s] Cache hit for %s, key: %s", indexName, r.URL.Path, cacheKeyString)
+	ctx, lookup := p.tracer.Start(r.Context(), "cache.get")
+	response, err := p.GetCache().Get(ctx, cacheKeyString)
+	lookup.SetAttributes(attribute.Bool("cache.hit", err == nil))
+	lookup.End()
+
+	if err == nil {
+		logger.Debug().Msgf("[%s] Cache hit for %s, key: %s", indexName, r.URL.Path, cacheKeyString)
+		p.registry.Hit(cacheKeyString)
 
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Cache", "HIT")
 		w.Write([]byte(response))
+
+		if trackQuery {
+			p.queries.Record(originalIndex, cacheKeyString, r.Method, originalPath, originalBody)
+		}
+		if recordAnalytics {
+			p.recordSearch(w, r, originalIndex, originalBody, originalQuery, start, http.StatusOK, response)
+		}
+		if inExperiment {
+			p.observeExperiment(w, assignment, start, []byte(response))
+		}
 		return
 	}
 
-	p.Logger.Info().Msgf("[%s] Cache miss for %s, key: %s", indexName, r.URL.Path, cacheKeyString)
+	logger.Debug().Msgf("[%s] Cache miss for %s, key: %s", indexName, r.URL.Path, cacheKeyString)
+	// the entry may have been evicted by Redis, forget it
+	p.registry.Remove(cacheKeyString)
 
-	// Capture the response for caching
-	recorder := httptest.NewRecorder()
-	responseBody, err := p.recordProxyRequest(r, recorder)
+	if p.cacheOnly.Load() {
+		logger.Debug().Msgf("[%s] Cache-only mode, not forwarding %s to Meilisearch", indexName, r.URL.Path)
+		p.writeCacheOnlyMiss(w, r, canonicalBody)
+		return
+	}
 
-	// Write the captured response to the original response writer
-	for k, v := range recorder.Header() {
+	if !p.allowMiss(w, r) {
+		return
+	}
 
-		if k == "Content-Encoding" {
-			continue
+	// Stream the response to the client while capturing it for caching
+	w.Header().Set("X-Cache", "MISS")
+	capture := p.recordProxyRequest(w, r, cacheKeyString)
+
+	if recordAnalytics {
+		status, response := capture.status, ""
+		switch {
+		case w.Header().Get("X-Cache") == "STALE":
+			status = http.StatusOK
+		case status == 0:
+			status = http.StatusBadGateway
+		case capture.cacheable():
+			response = string(capture.bytes())
 		}
+		p.recordSearch(w, r, originalIndex, originalBody, originalQuery, start, status, response)
+	}
 
-		w.Header()[k] = v
+	if inExperiment {
+		var response []byte
+		if capture.cacheable() {
+			response = capture.bytes()
+		}
+		p.observeExperiment(w, assignment, start, response)
 	}
-	w.WriteHeader(recorder.Code)
-	w.Write(responseBody)
 
-	// never cache an error response or an empty response
-	if recorder.Code != http.StatusOK || len(responseBody) == 0 {
-		p.Logger.Debug().Msgf("Not caching response for %s, key: %s", r.URL.Path, cacheKeyString)
-		p.Logger.Warn().Msgf("[%s] Could not reach upstream Meilisearch. Path: %s, key: %s", indexName, r.URL.Path, cacheKeyString)
+	// never cache an error response, an empty response or an incomplete response
+	if !capture.cacheable() {
+		logger.Debug().Msgf("Not caching response for %s, key: %s", r.URL.Path, cacheKeyString)
+
+		switch {
+		case capture.status == 0:
+			logger.Warn().Msgf("[%s] Could not reach upstream Meilisearch. Path: %s, key: %s", indexName, r.URL.Path, cacheKeyString)
+		case capture.overflow:
+			logger.Warn().Msgf("[%s] Response for %s exceeds the maximum cache entry size, key: %s", indexName, r.URL.Path, cacheKeyString)
+		case capture.err != nil:
+			logger.Warn().Msgf("[%s] Response for %s was interrupted: %s, key: %s", indexName, r.URL.Path, capture.err, cacheKeyString)
+		}
 		return
 	}
 
+	responseBody := capture.bytes()
+
+	if trackQuery {
+		p.queries.Record(originalIndex, cacheKeyString, r.Method, originalPath, originalBody)
+	}
+	if mirrorSearch {
+		p.mirror.Search(mirror.Search{Index: indexName, Method: r.Method, Path: path, Body: canonicalBody, Response: responseBody})
+	}
+
 	// Store response in cache
-	p.Logger.Debug().Msgf("[%s] Storing response in cache for %s, key: %s", indexName, r.URL.Path, cacheKeyString)
+	cfg := p.GetConfig()
+	logger.Debug().Msgf("[%s] Storing response in cache for %s, key: %s", indexName, r.URL.Path, cacheKeyString)
 
-	err = p.cache.Set(r.Context(), cacheKeyString, string(responseBody[:]), store.WithTags([]string{indexName}))
+	ctx, save := p.tracer.Start(r.Context(), "cache.set", trace.WithAttributes(attribute.Int("cache.entry_size", len(responseBody))))
+	err = p.GetCache().Set(ctx, cacheKeyString, string(responseBody[:]), store.WithTags(tags), store.WithExpiration(cfg.CacheConfig.TTL*time.Second))
 
 	if err != nil {
-		p.Logger.Error().Msgf("[%s] Error storing response in cache for %s, key: %s: %s", indexName, r.URL.Path, cacheKeyString, err)
+		logger.Error().Msgf("[%s] Error storing response in cache for %s, key: %s: %s", indexName, r.URL.Path, cacheKeyString, err)
+		save.SetStatus(codes.Error, err.Error())
+		save.End()
+		return
+	}
+
+	if staleTTL := cfg.CacheConfig.StaleTTL; staleTTL > 0 {
+		err = p.GetCache().Set(ctx, staleKey(cacheKeyString), string(responseBody), store.WithTags(tags), store.WithExpiration(staleTTL))
+		if err != nil {
+			logger.Error().Msgf("[%s] Error storing stale copy in cache, key: %s: %s", indexName, cacheKeyString, err)
+		}
 	}
+	save.End()
+
+	now := time.Now()
+	entry := caching.Entry{
+		Key:       cacheKeyString,
+		Index:     indexName,
+		Alias:     aliased.alias,
+		Method:    r.Method,
+		Path:      path,
+		Size:      len(responseBody),
+		CreatedAt: now,
+		ExpiresAt: now.Add(cfg.CacheConfig.TTL * time.Second),
+	}
+	if json.Valid(canonicalBody) {
+		entry.Body = canonicalBody
+	}
+	p.registry.Add(entry)
 }
 
-func (p *Proxy) recordProxyRequest(r *http.Request, recorder *httptest.ResponseRecorder) ([]byte, error) {
-	p.Logger.Debug().Msgf("Proxying request to %s", r.URL.String())
+// recordProxyRequest forwards a search to Meilisearch, streaming the response to the
+// client as it arrives. The returned capture holds a copy of it, see captureResponse.
+func (p *Proxy) recordProxyRequest(w http.ResponseWriter, r *http.Request, cacheKey string) *responseCapture {
+	p.log(r.Context()).Debug().Msgf("Proxying request to %s", r.URL.String())
 
-	p.proxy.ServeHTTP(recorder, r)
+	capture := newResponseCapture(p.GetConfig().CacheConfig.MaxEntrySize)
+	capture.cacheKey = cacheKey
 
-	// Check if the response is compressed
-	encoding := recorder.Header().Get("Content-Encoding")
-	var body []byte
-	var err error
+	ctx, span := p.tracer.Start(r.Context(), "meilisearch.search", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
 
-	switch encoding {
-	case "gzip":
-		p.Logger.Debug().Msg("Decompressing gzip response body")
-		gz, err := gzip.NewReader(recorder.Body)
-		if err != nil {
-			return nil, fmt.Errorf("failed to create gzip reader: %w", err)
-		}
-		defer gz.Close()
-		body, err = io.ReadAll(gz)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read gzip body: %w", err)
-		}
-	case "deflate":
-		p.Logger.Debug().Msg("Decompressing deflate response body")
-		// Decompress deflate
-		fl := flate.NewReader(recorder.Body)
-		defer fl.Close()
-		body, err = io.ReadAll(fl)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read deflate body: %w", err)
-		}
-	default:
-		p.Logger.Debug().Msg("Using response body as is")
-		body = recorder.Body.Bytes()
+	// searches don't change anything, they can be retried like GET requests and hedged to replicas
+	ctx = upstream.WithHedging(upstream.WithRetryable(context.WithValue(ctx, captureKey{}, capture)))
+	p.upstreamProxy(r).ServeHTTP(w, r.WithContext(ctx))
+
+	if capture.status == 0 {
+		span.SetStatus(codes.Error, "Meilisearch did not respond")
+	} else {
+		span.SetAttributes(attribute.Int("http.response.status_code", capture.status))
 	}
 
-	return body, nil
+	return capture
 }
 
 func (p *Proxy) handleDefault(w http.ResponseWriter, r *http.Request) {
+	if !p.allowRoute(w, r) {
+		return
+	}
+
+	if p.cacheOnly.Load() && isWriteRequest(r) {
+		p.log(r.Context()).Warn().Msgf("Cache-only mode, rejecting %s %s", r.Method, r.URL.Path)
+		p.rejectWrite(w)
+		return
+	}
+
+	if p.cacheOnly.Load() && r.Method == http.MethodPost && r.URL.Path == "/multi-search" {
+		p.log(r.Context()).Debug().Msg("Cache-only mode, not forwarding /multi-search to Meilisearch")
+		p.writeCacheOnlyMultiSearch(w, r)
+		return
+	}
+
+	// other reads (facet searches, documents, settings) aren't cached either, and
+	// Meilisearch may be down or importing a dump
+	if p.cacheOnly.Load() {
+		p.log(r.Context()).Debug().Msgf("Cache-only mode, not forwarding %s %s to Meilisearch", r.Method, r.URL.Path)
+		writeCacheOnlyError(w)
+		return
+	}
+
+	if !p.allowMiss(w, r) {
+		return
+	}
+
+	if r.Method == http.MethodPost && r.URL.Path == "/multi-search" {
+		if err := p.rewriteMultiSearch(r); err != nil {
+			var ruleErr *guardrails.Error
+			if errors.As(err, &ruleErr) {
+				p.rejectSearch(w, r, err)
+				return
+			}
+			http.Error(w, "Error reading request body", http.StatusInternalServerError)
+			return
+		}
+	}
+
 	finalURL := p.source.ResolveReference(r.URL)
-	p.Logger.Debug().Msgf("Handling request for %s", finalURL.String())
+	p.log(r.Context()).Debug().Msgf("Handling request for %s", finalURL.String())
 	p.proxy.ServeHTTP(w, r)
 }
 
@@ -228,48 +579,102 @@ func (p *Proxy) handlePurge(w http.ResponseWriter, r *http.Request) {
 
 	indexName := util.ExtractIndexName(r.URL.Path)
 
-	p.Logger.Info().Msg("Cache purge request received")
+	p.log(r.Context()).Info().Msg("Cache purge request received")
 
-	if p.config.ProxyPurgeToken != "" {
-		token := r.Header.Get("Authorization")
+	if !p.authorizePurge(w, r) {
+		return
+	}
 
-		if token != fmt.Sprintf("Bearer %s", p.config.ProxyPurgeToken) {
-			p.Logger.Error().Msg("Unauthorized purge request")
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	if purgeJobPath.MatchString(r.URL.Path) {
+		p.handlePurgeJob(w, r)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var purge purgeRequest
+	if r.Body != nil && r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&purge); err != nil && err != io.EOF {
+			http.Error(w, fmt.Sprintf("Invalid purge request: %s", err), http.StatusBadRequest)
 			return
 		}
 	}
 
-	err := p.PurgeCache(indexName)
+	if purge.Index == "" {
+		purge.Index = indexName
+	} else if indexName != "" && purge.Index != indexName {
+		http.Error(w, "Index in body does not match the index in the path", http.StatusBadRequest)
+		return
+	}
 
-	if err != nil {
-		p.Logger.Error().Msgf("Error purging cache: %s", err)
-		http.Error(w, "Error purging cache", http.StatusInternalServerError)
+	if err := purge.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	// a dry run only reads the registry, answer right away
+	if purge.DryRun {
+		entries, err := p.PurgeMatching(r.Context(), purge)
+		if err != nil {
+			p.log(r.Context()).Error().Msgf("Error purging cache: %s", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		response := purgeResponse{DryRun: true, Count: len(entries), Keys: []string{}}
+		for _, entry := range entries {
+			response.Keys = append(response.Keys, entry.Key)
+		}
+
+		writeJSON(w, http.StatusOK, response)
+		return
+	}
+
+	job := p.purgeJobs.Submit(purge, r.Header.Get("Idempotency-Key"), func(job *purgeJob) error {
+		return p.runPurgeJob(r.Context(), job)
+	})
+
+	w.Header().Set("Location", fmt.Sprintf("/purge/jobs/%s", job.ID))
+	writeJSON(w, http.StatusAccepted, job)
 }
 
-func (p *Proxy) Listen() {
-	mux := http.NewServeMux()
+// authorizePurge checks the purge token that protects the purge and admin endpoints,
+// it writes a 401 response and returns false when the request is not authorized
+func (p *Proxy) authorizePurge(w http.ResponseWriter, r *http.Request) bool {
+	purgeToken := p.GetConfig().ProxyPurgeToken
+	if purgeToken == "" {
+		return true
+	}
 
-	// mux / with both middlewares
-	mux.Handle("/", p.authMiddleware(p.headersMiddleware(p)))
+	token := r.Header.Get("Authorization")
 
-	log.Printf("Starting proxy server on  :%s", p.config.Port)
+	if token != fmt.Sprintf("Bearer %s", purgeToken) {
+		p.log(r.Context()).Error().Msgf("Unauthorized request to %s", r.URL.Path)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
 
-	http.ListenAndServe(fmt.Sprintf(":%s", p.config.Port), mux)
+	return true
 }
 
 func (p *Proxy) authMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// probes don't have the proxy key, the health routes are answered by the proxy
+		if healthPath.MatchString(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		token := r.Header.Get("Authorization")
+		cfg := p.GetConfig()
 
-		if p.config.ProxyMasterKeyOverride {
-			r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", p.config.MeilisearchMasterKey))
+		if cfg.ProxyMasterKeyOverride {
+			r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", cfg.MeilisearchMasterKey))
 
-			if token != fmt.Sprintf("Bearer %s", p.config.ProxyMasterKey) {
+			if token != fmt.Sprintf("Bearer %s", cfg.ProxyMasterKey) {
 				http.Error(w, "Unauthorized", http.StatusUnauthorized)
 				return
 			}
@@ -281,39 +686,56 @@ func (p *Proxy) authMiddleware(next http.Handler) http.Handler {
 
 func (p *Proxy) headersMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Meilisearch-Client")
-		w.Header().Set("Content-Type", "application/json")
 		w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
 
-		if r.Method == http.MethodOptions {
-			w.WriteHeader(http.StatusNoContent)
-			return
-		}
-
 		next.ServeHTTP(w, r)
 	})
 }
 
-func (p *Proxy) PurgeCache(index string) error {
+// PurgeCache removes all cached entries of an index, or the whole cache when index is empty.
+// The Meilisearch health check is done by the purge jobs, see runPurgeJob.
+func (p *Proxy) PurgeCache(ctx context.Context, index string) error {
+	logger := p.log(ctx)
 
-	// test if the underlying meilisearch is reachable
-	_, err := http.Get(p.source.String())
-	if err != nil {
-		return fmt.Errorf("Error reaching Meilisearch host: %s, refusing to purge cache", err)
-	}
+	var err error
 
 	if index != "" {
-		p.Logger.Info().Msgf("Purging cache for index: %s", index)
-		return p.cache.Invalidate(p.Context, store.WithInvalidateTags([]string{index}))
+		logger.Info().Msgf("Purging cache for index: %s", index)
+		err = p.GetCache().Invalidate(ctx, store.WithInvalidateTags([]string{index}))
+		if err == nil {
+			p.registry.RemoveIndex(index)
+		}
 	} else {
-		p.Logger.Info().Msg("Purging full cache for all indexes")
+		logger.Info().Msg("Purging full cache for all indexes")
 
-		return p.cache.Clear(p.Context)
+		err = p.GetCache().Clear(ctx)
+		if err == nil {
+			p.registry.Clear()
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if p.queries != nil && p.GetConfig().WarmConfig.OnPurge {
+		go func() {
+			warmed, err := p.WarmCache(p.Context, index)
+			if err != nil {
+				logger.Error().Msgf("Error warming cache after purge: %s", err)
+			}
+			logger.Info().Msgf("Warmed %d queries after purge", warmed)
+		}()
 	}
+
+	return nil
 }
 
 func (p *Proxy) GetCache() *cache.Cache[string] {
-	return p.cache
+	return p.cache.Load()
+}
+
+// GetConfig returns the current config, settings can change when it is reloaded
+func (p *Proxy) GetConfig() *config.Config {
+	return p.config.Load()
 }
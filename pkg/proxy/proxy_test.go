@@ -1,19 +1,50 @@
 package proxy_test
 
 import (
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
 	"io"
+	"math/big"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/alicebob/miniredis/v2"
 	"github.com/eko/gocache/lib/v4/store"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/maxroll-media-group/meilisearch-proxy/pkg/config"
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/logger"
 	"github.com/maxroll-media-group/meilisearch-proxy/pkg/proxy"
 )
 
 const testJSON = `{"name":"test"}`
+const testSearchKey = "69166bc619a4b7d7b518c76d46e73d10c2a1dae9baf31aaf4254906582534213"
 const testIndexJSON = `
 {
 	"results": [
@@ -32,10 +63,41 @@ var _ = Describe("Proxy", Ordered, func() {
 	var fakeMeilisearch *http.Server
 	var addr string
 	var proxyServer *proxy.Proxy
+	var meilisearchHealthy atomic.Bool
+	var flakyDown atomic.Bool
+
+	// purge submits a purge job and waits for it to finish
+	purge := func(path string, body string) map[string]interface{} {
+		req, _ := http.NewRequest("POST", "http://localhost:8888"+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer token")
+
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(http.StatusAccepted))
+
+		var job map[string]interface{}
+		Expect(json.NewDecoder(resp.Body).Decode(&job)).To(Succeed())
+
+		Eventually(func() string {
+			req, _ := http.NewRequest("GET", "http://localhost:8888/purge/jobs/"+job["id"].(string), nil)
+			req.Header.Set("Authorization", "Bearer token")
+
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).To(BeNil())
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+			job = map[string]interface{}{}
+			Expect(json.NewDecoder(resp.Body).Decode(&job)).To(Succeed())
+			return job["status"].(string)
+		}).Should(Or(Equal("succeeded"), Equal("failed")))
+
+		return job
+	}
 
 	// start a fake Meilisearch server
 
 	BeforeAll(func() {
+		meilisearchHealthy.Store(true)
 		redis, _ = miniredis.Run()
 		addr = "redis://" + redis.Addr()
 
@@ -45,6 +107,53 @@ var _ = Describe("Proxy", Ordered, func() {
 			w.WriteHeader(http.StatusOK)
 		})
 
+		mux.HandleFunc("/indexes/gzipped/search", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Header().Set("X-Upstream", "meilisearch")
+			gz := gzip.NewWriter(w)
+			gz.Write([]byte(testJSON))
+			gz.Close()
+		})
+
+		mux.HandleFunc("/indexes/large/search", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"hits":["` + strings.Repeat("a", 2048) + `"]}`))
+		})
+
+		mux.HandleFunc("/indexes/flaky/search", func(w http.ResponseWriter, r *http.Request) {
+			if flakyDown.Load() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte(testJSON))
+		})
+
+		mux.HandleFunc("/indexes/guarded/search", func(w http.ResponseWriter, r *http.Request) {
+			// echo the search so tests can see how it was rewritten
+			body, _ := io.ReadAll(r.Body)
+			w.Write(body)
+		})
+
+		mux.HandleFunc("/indexes/empty/search", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"hits":[],"query":"","processingTimeMs":1,"estimatedTotalHits":0}`))
+		})
+
+		mux.HandleFunc("/multi-search", func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			w.Write(body)
+		})
+
+		mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("meilisearch_index_count 1\n"))
+		})
+
+		mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+			if !meilisearchHealthy.Load() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte(`{"status":"available"}`))
+		})
+
 		mux.HandleFunc("/indexes", func(w http.ResponseWriter, r *http.Request) {
 			w.Write([]byte(testIndexJSON))
 			w.WriteHeader(http.StatusOK)
@@ -65,14 +174,43 @@ var _ = Describe("Proxy", Ordered, func() {
 			ProxyMasterKeyOverride: false,
 			Port:                   "8888",
 			CacheConfig: &config.CacheConfig{
-				TTL:    300,
-				Engine: "redis",
-				Url:    addr,
+				TTL:          300,
+				Engine:       "redis",
+				Url:          addr,
+				MaxEntrySize: 1024,
+				StaleTTL:     time.Hour,
+			},
+			IndexAliases: map[string]string{
+				"products": "test",
+			},
+			SearchRules: map[string]*config.SearchRule{
+				"guarded": {
+					MaxLimit:         50,
+					MaxQueryLength:   10,
+					DeniedParameters: []string{"showRankingScoreDetails"},
+					Filter:           "public = true",
+					KeyFilters:       map[string]string{"filtered-key": "brand = acme"},
+				},
+			},
+			AnalyticsConfig: &config.AnalyticsConfig{
+				Enabled:       true,
+				BatchSize:     1,
+				FlushInterval: time.Second,
+				BufferSize:    100,
 			},
 		}
 
 		proxyServer = proxy.NewProxy(cfg)
 		go proxyServer.Listen()
+
+		// wait for both servers to accept connections
+		Eventually(func() error {
+			conn, err := net.Dial("tcp", "localhost:8888")
+			if err == nil {
+				conn.Close()
+			}
+			return err
+		}).Should(Succeed())
 	})
 
 	Context("ProxyCalls", func() {
@@ -100,13 +238,129 @@ var _ = Describe("Proxy", Ordered, func() {
 		// create a request
 		_, _ = http.NewRequest("GET", "http://localhost:8888/indexes/test/search", nil)
 
-		cached, err := proxyServer.GetCache().Get(proxyServer.Context, "69166bc619a4b7d7b518c76d46e73d10c2a1dae9baf31aaf4254906582534213")
+		cached, err := proxyServer.GetCache().Get(proxyServer.Context, testSearchKey)
+
+		Expect(err).To(BeNil())
+
+		Expect(cached).To(Equal(testJSON))
+	})
+
+	It("should stream and cache compressed upstream responses", func() {
+
+		resp, err := http.Post("http://localhost:8888/indexes/gzipped/search", "application/json", nil)
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(resp.Header.Get("X-Upstream")).To(Equal("meilisearch"))
+		Expect(resp.Header.Get("Content-Encoding")).To(BeEmpty())
 
+		resBody, err := io.ReadAll(resp.Body)
 		Expect(err).To(BeNil())
+		Expect(resBody).To(Equal([]byte(testJSON)))
 
+		pathKey := sha256.Sum256([]byte("/indexes/gzipped/search"))
+		key := fmt.Sprintf("%x", sha256.Sum256(pathKey[:]))
+
+		cached, err := proxyServer.GetCache().Get(proxyServer.Context, key)
+		Expect(err).To(BeNil())
 		Expect(cached).To(Equal(testJSON))
 	})
 
+	It("should stream but not cache responses above the maximum entry size", func() {
+
+		resp, err := http.Post("http://localhost:8888/indexes/large/search", "application/json", nil)
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+		resBody, err := io.ReadAll(resp.Body)
+		Expect(err).To(BeNil())
+		Expect(len(resBody)).To(BeNumerically(">", 2048))
+
+		pathKey := sha256.Sum256([]byte("/indexes/large/search"))
+		key := fmt.Sprintf("%x", sha256.Sum256(pathKey[:]))
+
+		_, err = proxyServer.GetCache().Get(proxyServer.Context, key)
+		Expect(err).ToNot(BeNil())
+	})
+
+	It("should rewrite searches with the rules of the index before caching them", func() {
+		resp, err := http.Post("http://localhost:8888/indexes/guarded/search", "application/json",
+			strings.NewReader(`{"q":"shoes","limit":10000,"showRankingScoreDetails":true}`))
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(resp.Header.Get("X-Cache")).To(Equal("MISS"))
+
+		resBody, err := io.ReadAll(resp.Body)
+		Expect(err).To(BeNil())
+		Expect(resBody).To(MatchJSON(`{"q":"shoes","limit":50,"filter":"public = true"}`))
+
+		// searches rewritten to the same search share the cache entry
+		resp, err = http.Post("http://localhost:8888/indexes/guarded/search", "application/json",
+			strings.NewReader(`{"q":"shoes","limit":500}`))
+		Expect(err).To(BeNil())
+		Expect(resp.Header.Get("X-Cache")).To(Equal("HIT"))
+	})
+
+	It("should not share the cache entry of a search with bodies that have trailing bytes", func() {
+		resp, err := http.Post("http://localhost:8888/indexes/test/search", "application/json", strings.NewReader(`{"q":"trailing"}`))
+		Expect(err).To(BeNil())
+		Expect(resp.Header.Get("X-Cache")).To(Equal("MISS"))
+
+		resp, err = http.Post("http://localhost:8888/indexes/test/search", "application/json", strings.NewReader(`{"q":"trailing"} {"q":"other"}`))
+		Expect(err).To(BeNil())
+		Expect(resp.Header.Get("X-Cache")).To(Equal("MISS"))
+	})
+
+	It("should only apply key filters to their key and to tenant tokens signed by it", func() {
+		tenantToken := func(key string, uid string) string {
+			header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+			payload := base64.RawURLEncoding.EncodeToString([]byte(`{"apiKeyUid":"` + uid + `","searchRules":{"*":{}}}`))
+			mac := hmac.New(sha256.New, []byte(key))
+			mac.Write([]byte(header + "." + payload))
+			return header + "." + payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+		}
+
+		search := func(token string) (*http.Response, string) {
+			req, _ := http.NewRequest("POST", "http://localhost:8888/indexes/guarded/search", strings.NewReader(`{"q":"boots"}`))
+			req.Header.Set("Authorization", "Bearer "+token)
+
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).To(BeNil())
+			body, err := io.ReadAll(resp.Body)
+			Expect(err).To(BeNil())
+
+			return resp, string(body)
+		}
+
+		resp, body := search("filtered-key")
+		Expect(resp.Header.Get("X-Cache")).To(Equal("MISS"))
+		Expect(body).To(ContainSubstring("brand = acme"))
+
+		// the filtered search is cached for its credential only
+		resp, body = search("other-key")
+		Expect(resp.Header.Get("X-Cache")).To(Equal("MISS"))
+		Expect(body).ToNot(ContainSubstring("brand = acme"))
+
+		resp, body = search(tenantToken("filtered-key", "uid-a"))
+		Expect(resp.Header.Get("X-Cache")).To(Equal("MISS"))
+		Expect(body).To(ContainSubstring("brand = acme"))
+
+		// the claims of a token that isn't signed by the key don't choose its filter
+		_, body = search(tenantToken("made-up", "filtered-key"))
+		Expect(body).ToNot(ContainSubstring("brand = acme"))
+	})
+
+	It("should reject searches breaking the rules of the index", func() {
+		resp, err := http.Post("http://localhost:8888/indexes/guarded/search", "application/json",
+			strings.NewReader(`{"q":"a very long query"}`))
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+
+		var body map[string]interface{}
+		Expect(json.NewDecoder(resp.Body).Decode(&body)).To(Succeed())
+		Expect(body["code"]).To(Equal("invalid_search_q"))
+		Expect(body["type"]).To(Equal("invalid_request"))
+	})
+
 	It("should simply proxy other requests", func() {
 
 		// create a request
@@ -124,26 +378,172 @@ var _ = Describe("Proxy", Ordered, func() {
 		Expect(resBody).To(Equal([]byte(testIndexJSON)))
 	})
 
-	It("should purge cache on POST /purge", func() {
+	It("should leave /metrics to Meilisearch and serve its own on /proxy/metrics", func() {
+		get := func(path string) string {
+			req, _ := http.NewRequest("GET", "http://localhost:8888"+path, nil)
+			req.Header.Set("Authorization", "Bearer token")
 
-		cache := proxyServer.GetCache()
-		cache.Set(proxyServer.Context, "key", "value")
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).To(BeNil())
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			body, err := io.ReadAll(resp.Body)
+			Expect(err).To(BeNil())
 
-		// create a request
-		req, _ := http.NewRequest("POST", "http://localhost:8888/purge", nil)
+			return string(body)
+		}
+
+		Expect(get("/metrics")).To(Equal("meilisearch_index_count 1\n"))
+		Expect(get("/proxy/metrics")).To(ContainSubstring("go_goroutines"))
+	})
+
+	It("should list cached entries per index", func() {
+
+		req, _ := http.NewRequest("GET", "http://localhost:8888/cache/indexes/test", nil)
 		req.Header.Set("Authorization", "Bearer token")
 
 		resp, err := http.DefaultClient.Do(req)
-
 		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+		var listing struct {
+			Entries []struct {
+				Key  string `json:"key"`
+				Path string `json:"path"`
+				Hits int    `json:"hits"`
+			} `json:"entries"`
+		}
+		Expect(json.NewDecoder(resp.Body).Decode(&listing)).To(Succeed())
+
+		Expect(listing.Entries).To(ContainElement(SatisfyAll(
+			HaveField("Key", testSearchKey),
+			HaveField("Path", "/indexes/test/search"),
+		)))
+	})
+
+	It("should fetch and delete a single cache entry", func() {
 
+		req, _ := http.NewRequest("GET", "http://localhost:8888/cache/keys/"+testSearchKey, nil)
+		req.Header.Set("Authorization", "Bearer token")
+
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).To(BeNil())
 		Expect(resp.StatusCode).To(Equal(http.StatusOK))
 
-		_, err = cache.Get(proxyServer.Context, "key")
+		resBody, err := io.ReadAll(resp.Body)
+		Expect(err).To(BeNil())
+		Expect(string(resBody)).To(ContainSubstring(`"value":` + testJSON))
+
+		req, _ = http.NewRequest("DELETE", "http://localhost:8888/cache/keys/"+testSearchKey, nil)
+		req.Header.Set("Authorization", "Bearer token")
+
+		resp, err = http.DefaultClient.Do(req)
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(http.StatusNoContent))
+
+		_, err = proxyServer.GetCache().Get(proxyServer.Context, testSearchKey)
+		Expect(err).ToNot(BeNil())
+	})
+
+	It("should 401 when inspecting the cache without the purge token", func() {
+
+		req, _ := http.NewRequest("GET", "http://localhost:8888/cache", nil)
+
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("should only purge entries matching a query pattern", func() {
+
+		for _, body := range []string{`{"q":"shoes","filter":"brand = nike"}`, `{"q":"hats"}`} {
+			resp, err := http.Post("http://localhost:8888/indexes/test/search", "application/json", strings.NewReader(body))
+			Expect(err).To(BeNil())
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		}
+
+		dryRun := func(body string) map[string]interface{} {
+			req, _ := http.NewRequest("POST", "http://localhost:8888/purge/test", strings.NewReader(body))
+			req.Header.Set("Authorization", "Bearer token")
+
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).To(BeNil())
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+			var result map[string]interface{}
+			Expect(json.NewDecoder(resp.Body).Decode(&result)).To(Succeed())
+			return result
+		}
+
+		result := dryRun(`{"q":"^sho","filter":"nike","dryRun":true}`)
+		Expect(result["count"]).To(BeEquivalentTo(1))
+		Expect(result["dryRun"]).To(BeTrue())
+
+		result = purge("/purge/test", `{"q":"^sho"}`)
+		Expect(result["status"]).To(Equal("succeeded"))
+		Expect(result["count"]).To(BeEquivalentTo(1))
+
+		shoesKey := result["keys"].([]interface{})[0].(string)
+		_, err := proxyServer.GetCache().Get(proxyServer.Context, shoesKey)
+		Expect(err).ToNot(BeNil())
+
+		result = dryRun(`{"q":"hats","dryRun":true}`)
+		Expect(result["count"]).To(BeEquivalentTo(1))
+	})
+
+	It("should purge cache on POST /purge", func() {
+
+		cache := proxyServer.GetCache()
+		cache.Set(proxyServer.Context, "key", "value")
+
+		job := purge("/purge", "")
+
+		Expect(job["status"]).To(Equal("succeeded"))
+
+		_, err := cache.Get(proxyServer.Context, "key")
 
 		Expect(err).ToNot(BeNil())
 	})
 
+	It("should refuse to purge while Meilisearch is unhealthy", func() {
+
+		cache := proxyServer.GetCache()
+		cache.Set(proxyServer.Context, "key", "value")
+
+		meilisearchHealthy.Store(false)
+		defer meilisearchHealthy.Store(true)
+
+		job := purge("/purge", "")
+
+		Expect(job["status"]).To(Equal("failed"))
+		Expect(job["error"]).To(ContainSubstring("503"))
+
+		val, err := cache.Get(proxyServer.Context, "key")
+
+		Expect(err).To(BeNil())
+		Expect(val).To(Equal("value"))
+	})
+
+	It("should return the running job for an identical purge request", func() {
+
+		req, _ := http.NewRequest("POST", "http://localhost:8888/purge/test", nil)
+		req.Header.Set("Authorization", "Bearer token")
+		req.Header.Set("Idempotency-Key", "retry-me")
+
+		var first, second map[string]interface{}
+
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(http.StatusAccepted))
+		Expect(json.NewDecoder(resp.Body).Decode(&first)).To(Succeed())
+
+		resp, err = http.DefaultClient.Do(req)
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(http.StatusAccepted))
+		Expect(json.NewDecoder(resp.Body).Decode(&second)).To(Succeed())
+
+		Expect(second["id"]).To(Equal(first["id"]))
+	})
+
 	It("should 401 when a wrong purge token is used", func() {
 
 		// create a request
@@ -163,29 +563,2041 @@ var _ = Describe("Proxy", Ordered, func() {
 		cache.Set(proxyServer.Context, "<index_test>", "value", store.WithTags([]string{"test"}))
 		cache.Set(proxyServer.Context, "<index_test2>", "value", store.WithTags([]string{"test2"}))
 
-		// create a request
-		req, _ := http.NewRequest("POST", "http://localhost:8888/purge/test", nil)
+		job := purge("/purge/test", "")
+
+		Expect(job["status"]).To(Equal("succeeded"))
+
+		_, err := cache.Get(proxyServer.Context, "<index_test>")
+
+		Expect(err).ToNot(BeNil())
+
+		val, err := cache.Get(proxyServer.Context, "<index_test2>")
+
+		Expect(err).To(BeNil())
+		Expect(val).To(Equal("value"))
+	})
+
+	It("should only serve cached searches in cache-only mode", func() {
+
+		setMode := func(cacheOnly bool) {
+			req, _ := http.NewRequest("PUT", "http://localhost:8888/mode", strings.NewReader(fmt.Sprintf(`{"cacheOnly":%t}`, cacheOnly)))
+			req.Header.Set("Authorization", "Bearer token")
+
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).To(BeNil())
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		}
+
+		setMode(true)
+		defer setMode(false)
+
+		resp, err := http.Get("http://localhost:8888/health")
+		Expect(err).To(BeNil())
+		health, _ := io.ReadAll(resp.Body)
+		Expect(string(health)).To(ContainSubstring(`"mode":"cache-only"`))
+
+		resp, err = http.Post("http://localhost:8888/indexes/test/search", "application/json", strings.NewReader(`{"q":"not cached"}`))
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(http.StatusServiceUnavailable))
+
+		var meilisearchErr map[string]string
+		Expect(json.NewDecoder(resp.Body).Decode(&meilisearchErr)).To(Succeed())
+		Expect(meilisearchErr["code"]).To(Equal("proxy_cache_only"))
+
+		// multi-searches aren't cached, so they are never forwarded
+		resp, err = http.Post("http://localhost:8888/multi-search", "application/json", strings.NewReader(`{"queries":[{"indexUid":"test","q":"not cached"}]}`))
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(http.StatusServiceUnavailable))
+
+		req, _ := http.NewRequest("DELETE", "http://localhost:8888/indexes/test", nil)
+		resp, err = http.DefaultClient.Do(req)
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(http.StatusServiceUnavailable))
+		Expect(resp.Header.Get("Retry-After")).ToNot(BeEmpty())
+
+		// other reads aren't cached, so they are answered like misses
+		resp, err = http.Get("http://localhost:8888/indexes")
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(http.StatusServiceUnavailable))
+
+		resp, err = http.Post("http://localhost:8888/indexes/test/facet-search", "application/json", strings.NewReader(`{"facetName":"brand"}`))
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(http.StatusServiceUnavailable))
+		Expect(resp.Header.Get("Retry-After")).To(BeEmpty())
+
+		setMode(false)
+		resp, err = http.Get("http://localhost:8888/indexes")
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+	})
+
+	It("should report liveness and readiness", func() {
+
+		resp, err := http.Get("http://localhost:8888/health/live")
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+		resp, err = http.Get("http://localhost:8888/health/ready")
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+		var readiness struct {
+			Status     string `json:"status"`
+			Components map[string]struct {
+				Status string `json:"status"`
+			} `json:"components"`
+		}
+		Expect(json.NewDecoder(resp.Body).Decode(&readiness)).To(Succeed())
+		Expect(readiness.Status).To(Equal("ready"))
+		Expect(readiness.Components).To(HaveKeyWithValue("meilisearch", HaveField("Status", "ok")))
+		Expect(readiness.Components).To(HaveKeyWithValue("cache", HaveField("Status", "ok")))
+	})
+
+	It("should stay ready while Meilisearch is down and the cache can serve", func() {
+
+		meilisearchHealthy.Store(false)
+		defer meilisearchHealthy.Store(true)
+
+		resp, err := http.Get("http://localhost:8888/health/ready")
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+		body, _ := io.ReadAll(resp.Body)
+		Expect(string(body)).To(ContainSubstring(`"meilisearch":{"status":"failed"`))
+	})
+
+	It("should warm the cache of an index from JSONL queries", func() {
+
+		req, _ := http.NewRequest("POST", "http://localhost:8888/warm/test", strings.NewReader("{\"q\": \"warm\", \"limit\": 5}\n"))
 		req.Header.Set("Authorization", "Bearer token")
 
 		resp, err := http.DefaultClient.Do(req)
 
 		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(http.StatusAccepted))
 
-		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		// the warmed body is canonicalized before it is hashed
+		pathKey := sha256.Sum256([]byte("/indexes/test/search"))
+		key := fmt.Sprintf("%x", sha256.Sum256(append(pathKey[:], []byte(`{"limit":5,"q":"warm"}`)...)))
+
+		Eventually(func() (string, error) {
+			return proxyServer.GetCache().Get(proxyServer.Context, key)
+		}).Should(Equal(testJSON))
+	})
 
-		_, err = cache.Get(proxyServer.Context, "<index_test>")
+	It("should 401 when warming without the purge token", func() {
 
-		Expect(err).ToNot(BeNil())
+		req, _ := http.NewRequest("POST", "http://localhost:8888/warm/test", nil)
 
-		val, err := cache.Get(proxyServer.Context, "<index_test2>")
+		resp, err := http.DefaultClient.Do(req)
 
 		Expect(err).To(BeNil())
-		Expect(val).To(Equal("value"))
+		Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
 	})
 
-	AfterAll(func() {
-		fakeMeilisearch.Close()
-		redis.Close()
+	It("should 413 when warming with a body above the limit", func() {
+		req, _ := http.NewRequest("POST", "http://localhost:8888/warm/test", strings.NewReader(strings.Repeat(`{"q":"x"}`+"\n", 2<<20)))
+		req.Header.Set("Authorization", "Bearer token")
+
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(http.StatusRequestEntityTooLarge))
 	})
 
+	It("should resolve aliases in searches and tag entries by both names", func() {
+		resp, err := http.Post("http://localhost:8888/indexes/products/search", "application/json", strings.NewReader(`{"q":"alias"}`))
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(resp.Header.Get("X-Cache")).To(Equal("MISS"))
+
+		resBody, err := io.ReadAll(resp.Body)
+		Expect(err).To(BeNil())
+		Expect(resBody).To(Equal([]byte(testJSON)))
+
+		req, _ := http.NewRequest("GET", "http://localhost:8888/cache/indexes/products", nil)
+		req.Header.Set("Authorization", "Bearer token")
+		resp, err = http.DefaultClient.Do(req)
+		Expect(err).To(BeNil())
+
+		var list struct {
+			Entries []map[string]interface{} `json:"entries"`
+		}
+		Expect(json.NewDecoder(resp.Body).Decode(&list)).To(Succeed())
+		Expect(list.Entries).To(HaveLen(1))
+		Expect(list.Entries[0]["index"]).To(Equal("test"))
+		Expect(list.Entries[0]["alias"]).To(Equal("products"))
+	})
+
+	It("should resolve aliases in multi-search queries", func() {
+		resp, err := http.Post("http://localhost:8888/multi-search", "application/json",
+			strings.NewReader(`{"queries":[{"indexUid":"products","q":"a"},{"indexUid":"other","q":"b"}]}`))
+		Expect(err).To(BeNil())
+
+		resBody, err := io.ReadAll(resp.Body)
+		Expect(err).To(BeNil())
+		Expect(resBody).To(MatchJSON(`{"queries":[{"indexUid":"test","q":"a"},{"indexUid":"other","q":"b"}]}`))
+	})
+
+	It("should apply the search rules to multi-search queries", func() {
+		resp, err := http.Post("http://localhost:8888/multi-search", "application/json",
+			strings.NewReader(`{"queries":[{"indexUid":"guarded","q":"a","limit":1000,"showRankingScoreDetails":true},{"indexUid":"other","q":"b","limit":1000}]}`))
+		Expect(err).To(BeNil())
+
+		resBody, err := io.ReadAll(resp.Body)
+		Expect(err).To(BeNil())
+		Expect(resBody).To(MatchJSON(`{"queries":[{"indexUid":"guarded","q":"a","limit":50,"filter":"public = true"},{"indexUid":"other","q":"b","limit":1000}]}`))
+
+		// federated searches are capped as a whole
+		resp, err = http.Post("http://localhost:8888/multi-search", "application/json",
+			strings.NewReader(`{"federation":{"limit":1000},"queries":[{"indexUid":"guarded","q":"a"}]}`))
+		Expect(err).To(BeNil())
+
+		resBody, err = io.ReadAll(resp.Body)
+		Expect(err).To(BeNil())
+		Expect(resBody).To(MatchJSON(`{"federation":{"limit":50},"queries":[{"indexUid":"guarded","q":"a","filter":"public = true"}]}`))
+
+		resp, err = http.Post("http://localhost:8888/multi-search", "application/json",
+			strings.NewReader(`{"queries":[{"indexUid":"guarded","q":"a very long query"}]}`))
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+
+		var meilisearchErr map[string]string
+		Expect(json.NewDecoder(resp.Body).Decode(&meilisearchErr)).To(Succeed())
+		Expect(meilisearchErr["code"]).To(Equal("invalid_search_q"))
+	})
+
+	It("should invalidate the entries of the previous index when an alias moves", func() {
+		req, _ := http.NewRequest("PUT", "http://localhost:8888/aliases/products", strings.NewReader(`{"index":"gzipped"}`))
+		req.Header.Set("Authorization", "Bearer token")
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+		req, _ = http.NewRequest("GET", "http://localhost:8888/cache/indexes/products", nil)
+		req.Header.Set("Authorization", "Bearer token")
+		resp, err = http.DefaultClient.Do(req)
+		Expect(err).To(BeNil())
+
+		var list struct {
+			Entries []map[string]interface{} `json:"entries"`
+		}
+		Expect(json.NewDecoder(resp.Body).Decode(&list)).To(Succeed())
+		Expect(list.Entries).To(BeEmpty())
+
+		// the same search now goes to the new index
+		resp, err = http.Post("http://localhost:8888/indexes/products/search", "application/json", strings.NewReader(`{"q":"alias"}`))
+		Expect(err).To(BeNil())
+		Expect(resp.Header.Get("X-Cache")).To(Equal("MISS"))
+		Expect(resp.Header.Get("X-Upstream")).To(Equal("meilisearch"))
+
+		req, _ = http.NewRequest("DELETE", "http://localhost:8888/aliases/products", nil)
+		req.Header.Set("Authorization", "Bearer token")
+		resp, err = http.DefaultClient.Do(req)
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(http.StatusNoContent))
+
+		req, _ = http.NewRequest("GET", "http://localhost:8888/aliases", nil)
+		req.Header.Set("Authorization", "Bearer token")
+		resp, err = http.DefaultClient.Do(req)
+		Expect(err).To(BeNil())
+
+		resBody, err := io.ReadAll(resp.Body)
+		Expect(err).To(BeNil())
+		Expect(resBody).To(MatchJSON(`[]`))
+	})
+
+	It("should report the top zero-result searches of an index", func() {
+		for i := 0; i < 2; i++ {
+			resp, err := http.Post("http://localhost:8888/indexes/empty/search", "application/json", strings.NewReader(`{"q":"Nothing  Here"}`))
+			Expect(err).To(BeNil())
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			io.ReadAll(resp.Body)
+		}
+
+		var report map[string]interface{}
+		Eventually(func() float64 {
+			req, _ := http.NewRequest("GET", "http://localhost:8888/analytics/indexes/empty", nil)
+			req.Header.Set("Authorization", "Bearer token")
+
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).To(BeNil())
+			if resp.StatusCode != http.StatusOK {
+				return 0
+			}
+
+			report = map[string]interface{}{}
+			Expect(json.NewDecoder(resp.Body).Decode(&report)).To(Succeed())
+			return report["searches"].(float64)
+		}).Should(Equal(2.0))
+
+		Expect(report["zeroResults"]).To(Equal(2.0))
+		Expect(report["cacheHits"]).To(Equal(1.0))
+		Expect(report["topZeroResultQueries"]).To(Equal([]interface{}{
+			map[string]interface{}{"q": "nothing here", "count": 2.0},
+		}))
+
+		// the analytics API is protected like the purge API
+		resp, err := http.Get("http://localhost:8888/analytics")
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("should keep serving after recycling the transport and cache engine", func() {
+
+		proxyServer.Recycle()
+
+		resp, err := http.Post("http://localhost:8888/indexes/test/search", "application/json", nil)
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+		resBody, err := io.ReadAll(resp.Body)
+		Expect(err).To(BeNil())
+		Expect(resBody).To(Equal([]byte(testJSON)))
+	})
+
+	It("should serve a stale copy when Meilisearch fails after the entry expired", func() {
+		resp, err := http.Post("http://localhost:8888/indexes/flaky/search", "application/json", nil)
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(resp.Header.Get("X-Cache")).To(Equal("MISS"))
+		io.ReadAll(resp.Body)
+
+		// expire the regular entries, the stale copies live longer
+		redis.FastForward(301 * time.Second)
+		flakyDown.Store(true)
+
+		resp, err = http.Post("http://localhost:8888/indexes/flaky/search", "application/json", nil)
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(resp.Header.Get("X-Cache")).To(Equal("STALE"))
+
+		resBody, err := io.ReadAll(resp.Body)
+		Expect(err).To(BeNil())
+		Expect(resBody).To(Equal([]byte(testJSON)))
+	})
+
+	It("should not serve the stale copy of a purged or deleted entry", func() {
+		flakyDown.Store(false)
+		defer flakyDown.Store(false)
+
+		search := func(q string) *http.Response {
+			resp, err := http.Post("http://localhost:8888/indexes/flaky/search", "application/json", strings.NewReader(`{"q":"`+q+`"}`))
+			Expect(err).To(BeNil())
+			io.ReadAll(resp.Body)
+			return resp
+		}
+
+		Expect(search("purged").StatusCode).To(Equal(http.StatusOK))
+		Expect(search("deleted").StatusCode).To(Equal(http.StatusOK))
+
+		Expect(purge("/purge/flaky", `{"q":"^purged"}`)["count"]).To(BeEquivalentTo(1))
+
+		req, _ := http.NewRequest("POST", "http://localhost:8888/purge/flaky", strings.NewReader(`{"q":"^deleted","dryRun":true}`))
+		req.Header.Set("Authorization", "Bearer token")
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).To(BeNil())
+		var result map[string]interface{}
+		Expect(json.NewDecoder(resp.Body).Decode(&result)).To(Succeed())
+
+		req, _ = http.NewRequest("DELETE", "http://localhost:8888/cache/keys/"+result["keys"].([]interface{})[0].(string), nil)
+		req.Header.Set("Authorization", "Bearer token")
+		resp, err = http.DefaultClient.Do(req)
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(http.StatusNoContent))
+
+		flakyDown.Store(true)
+
+		for _, q := range []string{"purged", "deleted"} {
+			resp := search(q)
+			Expect(resp.StatusCode).To(Equal(http.StatusServiceUnavailable))
+			Expect(resp.Header.Get("X-Cache")).ToNot(Equal("STALE"))
+		}
+	})
+
+	AfterAll(func() {
+		Expect(proxyServer.Shutdown(context.Background())).To(Succeed())
+		fakeMeilisearch.Close()
+		redis.Close()
+	})
+
+})
+
+var _ = Describe("Shutdown", func() {
+
+	It("should fail readiness and drain in-flight requests before stopping", func() {
+		release := make(chan struct{})
+
+		meilisearch := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/indexes/slow/search" {
+				<-release
+			}
+			w.Write([]byte(testJSON))
+		}))
+		defer meilisearch.Close()
+
+		proxyServer := proxy.NewProxy(&config.Config{
+			MeilisearchHost: meilisearch.URL,
+			Port:            "8889",
+			CacheConfig: &config.CacheConfig{
+				TTL:    300,
+				Engine: "memory",
+			},
+			ShutdownDelay:   500 * time.Millisecond,
+			ShutdownTimeout: 5 * time.Second,
+		})
+
+		stopped := make(chan error, 1)
+		go func() { stopped <- proxyServer.Listen() }()
+
+		Eventually(func() (int, error) {
+			resp, err := http.Get("http://localhost:8889/health/ready")
+			if err != nil {
+				return 0, err
+			}
+			return resp.StatusCode, nil
+		}).Should(Equal(http.StatusOK))
+
+		// a request still in flight when the shutdown starts
+		inFlight := make(chan int, 1)
+		go func() {
+			defer GinkgoRecover()
+			resp, err := http.Post("http://localhost:8889/indexes/slow/search", "application/json", nil)
+			Expect(err).To(BeNil())
+			inFlight <- resp.StatusCode
+		}()
+
+		shutdown := make(chan error, 1)
+		go func() { shutdown <- proxyServer.Shutdown(context.Background()) }()
+
+		Eventually(func() (int, error) {
+			resp, err := http.Get("http://localhost:8889/health/ready")
+			if err != nil {
+				return 0, err
+			}
+			return resp.StatusCode, nil
+		}).Should(Equal(http.StatusServiceUnavailable))
+
+		close(release)
+
+		Eventually(inFlight, 5*time.Second).Should(Receive(Equal(http.StatusOK)))
+		Eventually(shutdown, 5*time.Second).Should(Receive(BeNil()))
+		Eventually(stopped).Should(Receive(BeNil()))
+	})
+
+	It("should flush traces once the shutdown context is done", func() {
+		logs := gbytes.NewBuffer()
+		proxyServer := proxy.NewProxy(&config.Config{
+			MeilisearchHost: "http://localhost:7700",
+			CacheConfig: &config.CacheConfig{
+				TTL:    300,
+				Engine: "memory",
+			},
+			TracingConfig: &config.TracingConfig{
+				Exporter:    config.TracingExporterStdout,
+				ServiceName: "meilisearch-proxy",
+				SampleRatio: 1,
+			},
+		})
+		proxyServer.Logger = logger.New(logs, logger.FormatJSON, zerolog.DebugLevel)
+
+		// draining used up the context of the shutdown
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		Expect(proxyServer.Shutdown(ctx)).To(Succeed())
+		Expect(string(logs.Contents())).ToNot(ContainSubstring("Error flushing traces"))
+	})
+})
+
+var _ = Describe("RateLimit", Ordered, func() {
+
+	var redis *miniredis.Miniredis
+	var meilisearch *httptest.Server
+	var proxyServer *proxy.Proxy
+
+	searchFrom := func(ip string, key string, body string) *http.Response {
+		req, _ := http.NewRequest("POST", "http://localhost:8890/indexes/test/search", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+key)
+		if ip != "" {
+			req.Header.Set("X-Forwarded-For", ip)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).To(BeNil())
+		io.ReadAll(resp.Body)
+
+		return resp
+	}
+
+	BeforeAll(func() {
+		redis, _ = miniredis.Run()
+
+		meilisearch = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(testJSON))
+		}))
+
+		proxyServer = proxy.NewProxy(&config.Config{
+			MeilisearchHost: meilisearch.URL,
+			Port:            "8890",
+			CacheConfig: &config.CacheConfig{
+				TTL:    300,
+				Engine: "redis",
+				Url:    "redis://" + redis.Addr(),
+			},
+			RateLimitConfig: &config.RateLimitConfig{
+				By:        config.RateLimitByAPIKey,
+				Store:     "redis",
+				Url:       "redis://" + redis.Addr(),
+				Rate:      0.1,
+				Burst:     5,
+				MissRate:  0.1,
+				MissBurst: 1,
+				// lets the tests tell clients apart with X-Forwarded-For
+				TrustedProxies: []string{"127.0.0.1/32", "::1/128"},
+				Keys:           []string{"key-a", "key-b", "key-c", "parent-key"},
+			},
+		})
+		go proxyServer.Listen()
+
+		Eventually(func() error {
+			conn, err := net.Dial("tcp", "localhost:8890")
+			if err == nil {
+				conn.Close()
+			}
+			return err
+		}).Should(Succeed())
+	})
+
+	It("should limit the searches of a client reaching Meilisearch", func() {
+		resp := searchFrom("203.0.113.10", "key-a", `{"q":"one"}`)
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(resp.Header.Get("X-Cache")).To(Equal("MISS"))
+
+		resp = searchFrom("203.0.113.10", "key-a", `{"q":"two"}`)
+		Expect(resp.StatusCode).To(Equal(http.StatusTooManyRequests))
+		Expect(resp.Header.Get("Retry-After")).To(Equal("10"))
+
+		// cache hits are only subject to the request limit
+		resp = searchFrom("203.0.113.10", "key-a", `{"q":"one"}`)
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(resp.Header.Get("X-Cache")).To(Equal("HIT"))
+	})
+
+	It("should keep a bucket per configured API key, shared by its clients", func() {
+		// key-a is out of misses, from any IP
+		resp := searchFrom("203.0.113.11", "key-a", `{"q":"two"}`)
+		Expect(resp.StatusCode).To(Equal(http.StatusTooManyRequests))
+
+		resp = searchFrom("203.0.113.12", "key-b", `{"q":"two"}`)
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(resp.Header.Get("X-Cache")).To(Equal("MISS"))
+	})
+
+	It("should limit all the requests of a client", func() {
+		for i := 0; i < 5; i++ {
+			Expect(searchFrom("203.0.113.13", "key-c", `{"q":"one"}`).StatusCode).To(Equal(http.StatusOK))
+		}
+
+		resp := searchFrom("203.0.113.13", "key-c", `{"q":"one"}`)
+		Expect(resp.StatusCode).To(Equal(http.StatusTooManyRequests))
+		Expect(resp.Header.Get("Retry-After")).ToNot(BeEmpty())
+		Expect(resp.Header.Get("X-Request-Id")).ToNot(BeEmpty())
+
+		// health checks are never limited
+		resp, err := http.Get("http://localhost:8890/health")
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+	})
+
+	It("should limit the IP of a client sending random tokens", func() {
+		resp := searchFrom("203.0.113.14", "random-1", `{"q":"three"}`)
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+		resp = searchFrom("203.0.113.14", "random-2", `{"q":"four"}`)
+		Expect(resp.StatusCode).To(Equal(http.StatusTooManyRequests))
+
+		for i := 0; i < 5; i++ {
+			searchFrom("203.0.113.14", fmt.Sprintf("random-%d", i+3), `{"q":"three"}`)
+		}
+		resp = searchFrom("203.0.113.14", "random-9", `{"q":"three"}`)
+		Expect(resp.StatusCode).To(Equal(http.StatusTooManyRequests))
+	})
+
+	It("should only count tenant tokens against the key they are signed with", func() {
+		tenantToken := func(key string) string {
+			header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+			payload := base64.RawURLEncoding.EncodeToString([]byte(`{"apiKeyUid":"uid-parent","searchRules":{"*":{}}}`))
+			mac := hmac.New(sha256.New, []byte(key))
+			mac.Write([]byte(header + "." + payload))
+			return header + "." + payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+		}
+
+		Expect(searchFrom("203.0.113.15", tenantToken("parent-key"), `{"q":"five"}`).StatusCode).To(Equal(http.StatusOK))
+		Expect(searchFrom("203.0.113.16", tenantToken("parent-key"), `{"q":"six"}`).StatusCode).To(Equal(http.StatusTooManyRequests))
+
+		// a token claiming the same key without its signature only has the bucket of its IP
+		resp := searchFrom("203.0.113.17", tenantToken("made-up"), `{"q":"seven"}`)
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(resp.Header.Get("X-Cache")).To(Equal("MISS"))
+	})
+
+	AfterAll(func() {
+		Expect(proxyServer.Shutdown(context.Background())).To(Succeed())
+		meilisearch.Close()
+		redis.Close()
+	})
+})
+
+var _ = Describe("Mirror", Ordered, func() {
+
+	var meilisearch *httptest.Server
+	var shadow *httptest.Server
+	var proxyServer *proxy.Proxy
+	var shadowSearches atomic.Int32
+
+	metrics := func() string {
+		req, _ := http.NewRequest("GET", "http://localhost:8891/proxy/metrics", nil)
+		req.Header.Set("Authorization", "Bearer token")
+
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+		body, err := io.ReadAll(resp.Body)
+		Expect(err).To(BeNil())
+		return string(body)
+	}
+
+	BeforeAll(func() {
+		meilisearch = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"hits":[{"id":1},{"id":2}],"estimatedTotalHits":2}`))
+		}))
+
+		shadow = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			shadowSearches.Add(1)
+			w.Write([]byte(`{"hits":[{"id":2},{"id":1}],"estimatedTotalHits":2}`))
+		}))
+
+		proxyServer = proxy.NewProxy(&config.Config{
+			MeilisearchHost: meilisearch.URL,
+			ProxyPurgeToken: "token",
+			Port:            "8891",
+			CacheConfig: &config.CacheConfig{
+				TTL:    300,
+				Engine: "memory",
+			},
+			MirrorConfig: &config.MirrorConfig{
+				Host:        shadow.URL,
+				SampleRate:  100,
+				Timeout:     time.Second,
+				Concurrency: 10,
+				PrimaryKey:  "id",
+			},
+		})
+		go proxyServer.Listen()
+
+		Eventually(func() error {
+			conn, err := net.Dial("tcp", "localhost:8891")
+			if err == nil {
+				conn.Close()
+			}
+			return err
+		}).Should(Succeed())
+	})
+
+	It("should mirror searches to the shadow instance and record the differences", func() {
+		misses := int32(0)
+		search := func() string {
+			resp, err := http.Post("http://localhost:8891/indexes/products/search", "application/json", strings.NewReader(`{"q":"shoes"}`))
+			Expect(err).To(BeNil())
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			io.ReadAll(resp.Body)
+
+			if resp.Header.Get("X-Cache") == "MISS" {
+				misses++
+			}
+			return resp.Header.Get("X-Cache")
+		}
+
+		Expect(search()).To(Equal("MISS"))
+		Eventually(search).Should(Equal("HIT"))
+		Expect(search()).To(Equal("HIT"))
+
+		// cache hits aren't mirrored, the cached response may be older than the shadow documents
+		Eventually(shadowSearches.Load).Should(Equal(misses))
+		Consistently(shadowSearches.Load, 200*time.Millisecond).Should(Equal(misses))
+
+		Eventually(metrics).Should(ContainSubstring(fmt.Sprintf(`meilisearch_proxy_mirror_searches_total{index="products",result="mismatch"} %d`, misses)))
+		Expect(metrics()).To(ContainSubstring(fmt.Sprintf(`meilisearch_proxy_mirror_differences_total{index="products",kind="order"} %d`, misses)))
+	})
+
+	It("should protect the metrics like the purge API", func() {
+		resp, err := http.Get("http://localhost:8891/proxy/metrics")
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+	})
+
+	AfterAll(func() {
+		Expect(proxyServer.Shutdown(context.Background())).To(Succeed())
+		meilisearch.Close()
+		shadow.Close()
+	})
+})
+
+var _ = Describe("Experiments", Ordered, func() {
+
+	var redis *miniredis.Miniredis
+	var meilisearch *httptest.Server
+	var alternate *httptest.Server
+	var proxyServer *proxy.Proxy
+	var logs *gbytes.Buffer
+
+	// search returns the variant of the client and the response, which names the
+	// Meilisearch instance and the index the search reached
+	search := func(user string) (*http.Response, string) {
+		req, _ := http.NewRequest("POST", "http://localhost:8892/indexes/products/search", strings.NewReader(`{"q":"shoes"}`))
+		req.Header.Set("X-User-Id", user)
+
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+		body, err := io.ReadAll(resp.Body)
+		Expect(err).To(BeNil())
+		return resp, string(body)
+	}
+
+	// usersByVariant finds a user of each variant
+	usersByVariant := func() map[string]string {
+		users := map[string]string{}
+		for i := 0; len(users) < 3 && i < 100; i++ {
+			user := fmt.Sprintf("user-%d", i)
+			resp, _ := search(user)
+			if _, ok := users[resp.Header.Get("X-Experiment-Variant")]; !ok {
+				users[resp.Header.Get("X-Experiment-Variant")] = user
+			}
+		}
+		return users
+	}
+
+	setEnabled := func(enabled bool) {
+		req, _ := http.NewRequest("PUT", "http://localhost:8892/experiments/ranking", strings.NewReader(fmt.Sprintf(`{"enabled":%t}`, enabled)))
+		req.Header.Set("Authorization", "Bearer token")
+
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+		body, err := io.ReadAll(resp.Body)
+		Expect(err).To(BeNil())
+		Expect(string(body)).To(ContainSubstring(fmt.Sprintf(`"enabled":%t`, enabled)))
+	}
+
+	echo := func(name string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(fmt.Sprintf(`{"hits":[],"estimatedTotalHits":0,"server":%q,"path":%q}`, name, r.URL.Path)))
+		}
+	}
+
+	BeforeAll(func() {
+		redis, _ = miniredis.Run()
+		meilisearch = httptest.NewServer(echo("primary"))
+		alternate = httptest.NewServer(echo("alternate"))
+
+		proxyServer = proxy.NewProxy(&config.Config{
+			MeilisearchHost: meilisearch.URL,
+			ProxyPurgeToken: "token",
+			Port:            "8892",
+			CacheConfig: &config.CacheConfig{
+				TTL:    300,
+				Engine: "redis",
+				Url:    "redis://" + redis.Addr(),
+			},
+			Experiments: map[string]*config.Experiment{
+				"ranking": {
+					Index:   "products",
+					Header:  "X-User-Id",
+					Enabled: true,
+					Variants: []config.ExperimentVariant{
+						{Name: "control", Weight: 1},
+						{Name: "index", Weight: 1, Index: "products_exp"},
+						{Name: "host", Weight: 1, Host: alternate.URL},
+					},
+				},
+			},
+			AccessLogSampleRate: 1,
+		})
+		logs = gbytes.NewBuffer()
+		proxyServer.Logger = logger.New(logs, logger.FormatJSON, zerolog.DebugLevel)
+		go proxyServer.Listen()
+
+		Eventually(func() error {
+			conn, err := net.Dial("tcp", "localhost:8892")
+			if err == nil {
+				conn.Close()
+			}
+			return err
+		}).Should(Succeed())
+	})
+
+	It("should route the searches of each variant to its index or host", func() {
+		users := usersByVariant()
+		Expect(users).To(HaveLen(3))
+
+		resp, body := search(users["control"])
+		Expect(resp.Header.Get("X-Experiment")).To(Equal("ranking"))
+		Expect(body).To(ContainSubstring(`"server":"primary","path":"/indexes/products/search"`))
+
+		_, body = search(users["index"])
+		Expect(body).To(ContainSubstring(`"server":"primary","path":"/indexes/products_exp/search"`))
+
+		_, body = search(users["host"])
+		Expect(body).To(ContainSubstring(`"server":"alternate","path":"/indexes/products/search"`))
+	})
+
+	It("should cache searches per variant", func() {
+		users := usersByVariant()
+
+		// usersByVariant searched once per variant already
+		resp, body := search(users["index"])
+		Expect(resp.Header.Get("X-Cache")).To(Equal("HIT"))
+		Expect(body).To(ContainSubstring(`products_exp`))
+
+		resp, body = search(users["host"])
+		Expect(resp.Header.Get("X-Cache")).To(Equal("HIT"))
+		Expect(body).To(ContainSubstring(`alternate`))
+
+		// searches outside of the experiment have their own entry
+		resp, body = search("")
+		Expect(resp.Header.Get("X-Experiment")).To(BeEmpty())
+		Expect(resp.Header.Get("X-Cache")).To(Equal("MISS"))
+		Expect(body).To(ContainSubstring(`"server":"primary","path":"/indexes/products/search"`))
+	})
+
+	It("should log the index a search was made to", func() {
+		users := usersByVariant()
+
+		req, _ := http.NewRequest("POST", "http://localhost:8892/indexes/products/search", strings.NewReader(`{"q":"shoes"}`))
+		req.Header.Set("X-User-Id", users["index"])
+		req.Header.Set("X-Request-Id", "req-variant")
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).To(BeNil())
+		io.ReadAll(resp.Body)
+
+		accessLog := func() string {
+			for _, line := range strings.Split(string(logs.Contents()), "\n") {
+				if strings.Contains(line, `"type":"access"`) && strings.Contains(line, `"requestId":"req-variant"`) {
+					return line
+				}
+			}
+			return ""
+		}
+		Eventually(accessLog).Should(ContainSubstring(`"path":"/indexes/products/search"`))
+	})
+
+	It("should record metrics per variant", func() {
+		req, _ := http.NewRequest("GET", "http://localhost:8892/proxy/metrics", nil)
+		req.Header.Set("Authorization", "Bearer token")
+
+		Eventually(func() string {
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).To(BeNil())
+			body, _ := io.ReadAll(resp.Body)
+			return string(body)
+		}).Should(And(
+			ContainSubstring(`meilisearch_proxy_experiment_searches_total{cache="hit",experiment="ranking",variant="index"}`),
+			ContainSubstring(`meilisearch_proxy_experiment_zero_results_total{experiment="ranking",variant="host"}`),
+		))
+	})
+
+	It("should be turned off and on at runtime", func() {
+		setEnabled(false)
+
+		resp, body := search("user-1")
+		Expect(resp.Header.Get("X-Experiment-Variant")).To(BeEmpty())
+		Expect(body).To(ContainSubstring(`"server":"primary","path":"/indexes/products/search"`))
+
+		setEnabled(true)
+
+		resp, _ = search("user-1")
+		Expect(resp.Header.Get("X-Experiment-Variant")).ToNot(BeEmpty())
+	})
+
+	AfterAll(func() {
+		Expect(proxyServer.Shutdown(context.Background())).To(Succeed())
+		meilisearch.Close()
+		alternate.Close()
+		redis.Close()
+	})
+})
+
+var _ = Describe("Tracing", Ordered, func() {
+
+	var redis *miniredis.Miniredis
+	var meilisearch *httptest.Server
+	var proxyServer *proxy.Proxy
+	var spans *tracetest.SpanRecorder
+	var traceparents chan string
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	const parentID = "00f067aa0ba902b7"
+
+	// spanNamed returns the ended span with this name
+	spanNamed := func(name string) sdktrace.ReadOnlySpan {
+		for _, span := range spans.Ended() {
+			if span.Name() == name {
+				return span
+			}
+		}
+		Fail("no span named " + name)
+		return nil
+	}
+
+	attributes := func(span sdktrace.ReadOnlySpan) map[string]string {
+		attrs := map[string]string{}
+		for _, attr := range span.Attributes() {
+			attrs[string(attr.Key)] = attr.Value.Emit()
+		}
+		return attrs
+	}
+
+	BeforeAll(func() {
+		spans = tracetest.NewSpanRecorder()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)))
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+
+		traceparents = make(chan string, 10)
+		redis, _ = miniredis.Run()
+		meilisearch = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			traceparents <- r.Header.Get("traceparent")
+
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			gz.Write([]byte(testJSON))
+			gz.Close()
+		}))
+
+		proxyServer = proxy.NewProxy(&config.Config{
+			MeilisearchHost: meilisearch.URL,
+			Port:            "8893",
+			CacheConfig: &config.CacheConfig{
+				TTL:    300,
+				Engine: "redis",
+				Url:    "redis://" + redis.Addr(),
+			},
+		})
+		go proxyServer.Listen()
+
+		Eventually(func() error {
+			conn, err := net.Dial("tcp", "localhost:8893")
+			if err == nil {
+				conn.Close()
+			}
+			return err
+		}).Should(Succeed())
+	})
+
+	search := func() *http.Response {
+		req, _ := http.NewRequest("POST", "http://localhost:8893/indexes/products/search", strings.NewReader(`{"q":"shoes"}`))
+		req.Header.Set("traceparent", "00-"+traceID+"-"+parentID+"-01")
+
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		io.ReadAll(resp.Body)
+
+		return resp
+	}
+
+	It("should trace a cache miss from the caller into Meilisearch", func() {
+		resp := search()
+		Expect(resp.Header.Get("X-Cache")).To(Equal("MISS"))
+
+		Eventually(func() int { return len(spans.Ended()) }).Should(BeNumerically(">=", 5))
+
+		server := spanNamed("POST /indexes/{index}/search")
+		Expect(server.SpanKind()).To(Equal(trace.SpanKindServer))
+		Expect(server.SpanContext().TraceID().String()).To(Equal(traceID))
+		Expect(server.Parent().SpanID().String()).To(Equal(parentID))
+		Expect(server.Parent().IsRemote()).To(BeTrue())
+		Expect(attributes(server)).To(And(
+			HaveKeyWithValue("meilisearch.index", "products"),
+			HaveKeyWithValue("meilisearch_proxy.cache", "miss"),
+			HaveKeyWithValue("http.response.status_code", "200"),
+		))
+
+		lookup := spanNamed("cache.get")
+		Expect(lookup.Parent().SpanID()).To(Equal(server.SpanContext().SpanID()))
+		Expect(attributes(lookup)).To(HaveKeyWithValue("cache.hit", "false"))
+
+		upstream := spanNamed("meilisearch.search")
+		Expect(upstream.Parent().SpanID()).To(Equal(server.SpanContext().SpanID()))
+		Expect(upstream.SpanKind()).To(Equal(trace.SpanKindClient))
+
+		decompress := spanNamed("response.decompress")
+		Expect(decompress.Parent().SpanID()).To(Equal(upstream.SpanContext().SpanID()))
+		Expect(attributes(decompress)).To(HaveKeyWithValue("http.response.content_encoding", "gzip"))
+
+		Expect(spanNamed("cache.set").Parent().SpanID()).To(Equal(server.SpanContext().SpanID()))
+
+		// Meilisearch continues the trace under the upstream span
+		Expect(traceparents).To(Receive(Equal("00-" + traceID + "-" + upstream.SpanContext().SpanID().String() + "-01")))
+	})
+
+	It("should tag cache hits", func() {
+		before := len(spans.Ended())
+
+		resp := search()
+		Expect(resp.Header.Get("X-Cache")).To(Equal("HIT"))
+
+		Eventually(func() []sdktrace.ReadOnlySpan { return spans.Ended()[before:] }).Should(ContainElement(
+			WithTransform(func(span sdktrace.ReadOnlySpan) map[string]string {
+				if span.SpanKind() != trace.SpanKindServer {
+					return nil
+				}
+				return attributes(span)
+			}, HaveKeyWithValue("meilisearch_proxy.cache", "hit")),
+		))
+		Expect(traceparents).ToNot(Receive())
+	})
+
+	AfterAll(func() {
+		Expect(proxyServer.Shutdown(context.Background())).To(Succeed())
+		meilisearch.Close()
+		redis.Close()
+	})
+})
+
+var _ = Describe("AccessLog", Ordered, func() {
+
+	var redis *miniredis.Miniredis
+	var meilisearch *httptest.Server
+	var sampled, unsampled *proxy.Proxy
+	var sampledLogs, unsampledLogs *gbytes.Buffer
+	var upstreamRequestID atomic.Value
+
+	// accessLog returns the access log of the request with this id
+	accessLog := func(logs *gbytes.Buffer, requestID string) map[string]interface{} {
+		for _, line := range strings.Split(string(logs.Contents()), "\n") {
+			if !strings.Contains(line, `"type":"access"`) || !strings.Contains(line, `"requestId":"`+requestID+`"`) {
+				continue
+			}
+
+			var entry map[string]interface{}
+			Expect(json.Unmarshal([]byte(line), &entry)).To(Succeed())
+			return entry
+		}
+		return nil
+	}
+
+	search := func(port string, index string, requestID string) {
+		req, _ := http.NewRequest("POST", "http://localhost:"+port+"/indexes/"+index+"/search", strings.NewReader(`{"q":"shoes"}`))
+		req.Header.Set("X-Request-Id", requestID)
+
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).To(BeNil())
+		io.ReadAll(resp.Body)
+	}
+
+	start := func(port string, sampleRate float64, logs *gbytes.Buffer) *proxy.Proxy {
+		p := proxy.NewProxy(&config.Config{
+			MeilisearchHost: meilisearch.URL,
+			Port:            port,
+			CacheConfig: &config.CacheConfig{
+				TTL:    300,
+				Engine: "redis",
+				Url:    "redis://" + redis.Addr(),
+			},
+			IndexAliases:        map[string]string{"catalog": "products"},
+			AccessLogSampleRate: sampleRate,
+		})
+		p.Logger = logger.New(logs, logger.FormatJSON, zerolog.DebugLevel)
+		go p.Listen()
+
+		Eventually(func() error {
+			conn, err := net.Dial("tcp", "localhost:"+port)
+			if err == nil {
+				conn.Close()
+			}
+			return err
+		}).Should(Succeed())
+
+		return p
+	}
+
+	BeforeAll(func() {
+		redis, _ = miniredis.Run()
+		meilisearch = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			upstreamRequestID.Store(r.Header.Get("X-Request-Id"))
+			if r.URL.Path == "/indexes/broken/search" {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Write([]byte(testJSON))
+		}))
+
+		sampledLogs, unsampledLogs = gbytes.NewBuffer(), gbytes.NewBuffer()
+		sampled = start("8894", 1, sampledLogs)
+		unsampled = start("8895", 0, unsampledLogs)
+	})
+
+	It("should log requests with their index, cache status and upstream node", func() {
+		search("8894", "products", "req-1")
+
+		Eventually(func() map[string]interface{} { return accessLog(sampledLogs, "req-1") }).ShouldNot(BeNil())
+		entry := accessLog(sampledLogs, "req-1")
+
+		Expect(entry).To(HaveKeyWithValue("type", "access"))
+		Expect(entry).To(HaveKeyWithValue("method", "POST"))
+		Expect(entry).To(HaveKeyWithValue("path", "/indexes/products/search"))
+		Expect(entry).To(HaveKeyWithValue("index", "products"))
+		Expect(entry).To(HaveKeyWithValue("status", 200.0))
+		Expect(entry).To(HaveKeyWithValue("bytes", float64(len(testJSON))))
+		Expect(entry).To(HaveKeyWithValue("cache", "miss"))
+		Expect(entry).To(HaveKeyWithValue("upstream", strings.TrimPrefix(meilisearch.URL, "http://")))
+		Expect(entry).To(HaveKey("durationMs"))
+
+		search("8894", "products", "req-2")
+		Eventually(func() map[string]interface{} { return accessLog(sampledLogs, "req-2") }).Should(And(
+			HaveKeyWithValue("cache", "hit"),
+			Not(HaveKey("upstream")),
+		))
+	})
+
+	It("should log the alias a search was made to", func() {
+		search("8894", "catalog", "req-alias")
+
+		Eventually(func() map[string]interface{} { return accessLog(sampledLogs, "req-alias") }).Should(And(
+			HaveKeyWithValue("path", "/indexes/catalog/search"),
+			HaveKeyWithValue("index", "catalog"),
+		))
+	})
+
+	It("should always log server errors", func() {
+		search("8895", "products", "req-3")
+		search("8895", "broken", "req-4")
+
+		Eventually(func() map[string]interface{} { return accessLog(unsampledLogs, "req-4") }).Should(HaveKeyWithValue("status", 500.0))
+		Expect(accessLog(unsampledLogs, "req-3")).To(BeNil())
+	})
+
+	It("should log the requests answered before reaching Meilisearch, like preflight requests", func() {
+		req, _ := http.NewRequest("OPTIONS", "http://localhost:8894/indexes/products/search", nil)
+		req.Header.Set("Origin", "https://example.com")
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		req.Header.Set("X-Request-Id", "req-preflight")
+
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(http.StatusNoContent))
+
+		Eventually(func() map[string]interface{} { return accessLog(sampledLogs, "req-preflight") }).Should(And(
+			HaveKeyWithValue("method", "OPTIONS"),
+			HaveKeyWithValue("status", 204.0),
+		))
+	})
+
+	It("should keep the request id of the client", func() {
+		search("8894", "shirts", "req-5")
+
+		Expect(upstreamRequestID.Load()).To(Equal("req-5"))
+	})
+
+	It("should generate request ids and tag the logs of the request with them", func() {
+		req, _ := http.NewRequest("POST", "http://localhost:8894/indexes/uncached/search", strings.NewReader(`{"q":"boots"}`))
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).To(BeNil())
+		io.ReadAll(resp.Body)
+
+		requestID := resp.Header.Get("X-Request-Id")
+		Expect(requestID).To(MatchRegexp(`^[0-9a-f]{32}$`))
+		Expect(upstreamRequestID.Load()).To(Equal(requestID))
+
+		Eventually(func() map[string]interface{} { return accessLog(sampledLogs, requestID) }).Should(HaveKeyWithValue("type", "access"))
+		Expect(strings.Count(string(sampledLogs.Contents()), `"requestId":"`+requestID+`"`)).To(BeNumerically(">", 1))
+	})
+
+	It("should tag the logs of purge jobs with the id of their request", func() {
+		req, _ := http.NewRequest("POST", "http://localhost:8894/purge", nil)
+		req.Header.Set("X-Request-Id", "req-purge")
+
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(http.StatusAccepted))
+
+		Eventually(func() string { return string(sampledLogs.Contents()) }).
+			Should(MatchRegexp(`"requestId":"req-purge"[^\n]*"message":"Purging full cache for all indexes"`))
+	})
+
+	It("should replace invalid request ids", func() {
+		search("8894", "socks", strings.Repeat("x", 200))
+
+		Expect(upstreamRequestID.Load()).To(MatchRegexp(`^[0-9a-f]{32}$`))
+	})
+
+	AfterAll(func() {
+		Expect(sampled.Shutdown(context.Background())).To(Succeed())
+		Expect(unsampled.Shutdown(context.Background())).To(Succeed())
+		meilisearch.Close()
+		redis.Close()
+	})
+})
+
+var _ = Describe("Reload", Ordered, func() {
+
+	var redis *miniredis.Miniredis
+	var meilisearch *httptest.Server
+	var proxyServer *proxy.Proxy
+	var configFile, purgeTokenFile string
+	var logs *gbytes.Buffer
+
+	writeConfigWith := func(ttl string, extra string) {
+		Expect(os.WriteFile(configFile, []byte(`
+meilisearchHost: `+meilisearch.URL+`
+port: "8896"
+reloadInterval: 20ms
+shutdownDelay: 0s
+cache:
+  engine: redis
+  url: redis://`+redis.Addr()+`
+  ttl: `+ttl+`
+`+extra), 0o600)).To(Succeed())
+	}
+
+	writeConfig := func(ttl string) {
+		writeConfigWith(ttl, "")
+	}
+
+	aliases := func() string {
+		req, _ := http.NewRequest("GET", "http://localhost:8896/aliases", nil)
+		req.Header.Set("Authorization", "Bearer second")
+
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).To(BeNil())
+		body, _ := io.ReadAll(resp.Body)
+
+		return string(body)
+	}
+
+	writePurgeToken := func(token string) {
+		Expect(os.WriteFile(purgeTokenFile, []byte(token+"\n"), 0o600)).To(Succeed())
+	}
+
+	purgeStatus := func(token string) int {
+		req, _ := http.NewRequest("GET", "http://localhost:8896/aliases", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).To(BeNil())
+		io.ReadAll(resp.Body)
+
+		return resp.StatusCode
+	}
+
+	search := func(query string) string {
+		resp, err := http.Get("http://localhost:8896/indexes/products/search?q=" + query)
+		Expect(err).To(BeNil())
+		io.ReadAll(resp.Body)
+
+		return resp.Header.Get("X-Cache")
+	}
+
+	cacheTTL := func(query string) time.Duration {
+		return redis.TTL(fmt.Sprintf("%x", sha256.Sum256([]byte("/indexes/products/search?q="+query))))
+	}
+
+	BeforeAll(func() {
+		redis, _ = miniredis.Run()
+		meilisearch = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(testJSON))
+		}))
+
+		configFile = filepath.Join(GinkgoT().TempDir(), "config.yaml")
+		writeConfig("5m")
+
+		// the purge token is a secret mounted in a file
+		purgeTokenFile = filepath.Join(GinkgoT().TempDir(), "purge-token")
+		writePurgeToken("first")
+		os.Setenv("PROXY_PURGE_TOKEN_FILE", purgeTokenFile)
+
+		cfg, err := config.Load(configFile)
+		Expect(err).To(BeNil())
+
+		logs = gbytes.NewBuffer()
+		proxyServer = proxy.NewProxy(cfg)
+		proxyServer.Logger = logger.New(logs, logger.FormatJSON, zerolog.DebugLevel)
+		go proxyServer.Listen()
+
+		Eventually(func() error {
+			conn, err := net.Dial("tcp", "localhost:8896")
+			if err == nil {
+				conn.Close()
+			}
+			return err
+		}).Should(Succeed())
+	})
+
+	It("should apply the changes of the config file without dropping the cache", func() {
+		Expect(search("shoes")).To(Equal("MISS"))
+		Expect(cacheTTL("shoes")).To(Equal(5 * time.Minute))
+
+		writeConfig("1h")
+
+		Eventually(func() time.Duration { return proxyServer.GetConfig().CacheConfig.TTL }).Should(Equal(time.Duration(3600)))
+		Expect(search("shoes")).To(Equal("HIT"))
+		Expect(search("boots")).To(Equal("MISS"))
+		Expect(cacheTTL("boots")).To(Equal(time.Hour))
+	})
+
+	It("should rotate secrets when their file changes", func() {
+		Expect(purgeStatus("first")).To(Equal(http.StatusOK))
+
+		writePurgeToken("second")
+
+		Eventually(func() int { return purgeStatus("second") }).Should(Equal(http.StatusOK))
+		Expect(purgeStatus("first")).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("should log the secrets that only apply after a restart", func() {
+		os.Setenv("MIRROR_API_KEY", "rotatedMirrorKey")
+		defer os.Unsetenv("MIRROR_API_KEY")
+
+		Expect(proxyServer.Reload()).To(Succeed())
+
+		Eventually(logs).Should(gbytes.Say(`mirror.apiKey \(MIRROR_API_KEY\) changed, it only applies after a restart`))
+		Expect(string(logs.Contents())).ToNot(ContainSubstring("rotatedMirrorKey"))
+	})
+
+	It("should apply the changes of the index aliases", func() {
+		writeConfigWith("1h", "indexAliases:\n  products: products_v2\n")
+		Eventually(aliases).Should(MatchJSON(`[{"alias":"products","index":"products_v2"}]`))
+
+		writeConfigWith("1h", "indexAliases:\n  products: products_v3\n")
+		Eventually(aliases).Should(MatchJSON(`[{"alias":"products","index":"products_v3"}]`))
+		Eventually(logs).Should(gbytes.Say("Alias products moved from products_v2 to products_v3"))
+
+		writeConfig("1h")
+		Eventually(aliases).Should(MatchJSON(`[]`))
+	})
+
+	It("should keep the current config when the new one is invalid", func() {
+		Expect(os.WriteFile(configFile, []byte("cache:\n  engine: memcached\n"), 0o600)).To(Succeed())
+
+		Expect(proxyServer.Reload()).To(MatchError(ContainSubstring("cache.engine (CACHE_ENGINE) must be either memory or redis")))
+		Expect(purgeStatus("second")).To(Equal(http.StatusOK))
+		Expect(proxyServer.GetConfig().CacheConfig.TTL).To(Equal(time.Duration(3600)))
+	})
+
+	AfterAll(func() {
+		os.Unsetenv("PROXY_PURGE_TOKEN_FILE")
+		Expect(proxyServer.Shutdown(context.Background())).To(Succeed())
+		meilisearch.Close()
+		redis.Close()
+	})
+})
+
+var _ = Describe("CORS", Ordered, func() {
+
+	var redis *miniredis.Miniredis
+	var meilisearch *httptest.Server
+	var proxyServer *proxy.Proxy
+
+	request := func(method string, path string, origin string) *http.Response {
+		req, _ := http.NewRequest(method, "http://localhost:8897"+path, nil)
+		req.Header.Set("Origin", origin)
+		if method == http.MethodOptions {
+			req.Header.Set("Access-Control-Request-Method", "POST")
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).To(BeNil())
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+
+	BeforeAll(func() {
+		redis, _ = miniredis.Run()
+		meilisearch = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Meilisearch allows any origin, the proxy replaces its CORS headers
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			if r.URL.Path == "/version" {
+				w.Header().Set("Content-Type", "text/plain")
+				w.Write([]byte("1.0.0"))
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(testJSON))
+		}))
+
+		proxyServer = proxy.NewProxy(&config.Config{
+			MeilisearchHost: meilisearch.URL,
+			Port:            "8897",
+			ProxyPurgeToken: "secret",
+			CacheConfig: &config.CacheConfig{
+				TTL:    300,
+				Engine: "redis",
+				Url:    "redis://" + redis.Addr(),
+			},
+			CORSConfig: &config.CORSConfig{
+				Public: config.CORSPolicy{
+					AllowedOrigins:   []string{"https://example.com", "https://*.shop.com"},
+					AllowCredentials: true,
+					AllowedMethods:   []string{"GET", "POST"},
+					AllowedHeaders:   []string{"Content-Type", "Authorization"},
+					ExposedHeaders:   []string{"X-Cache"},
+					MaxAge:           10 * time.Minute,
+				},
+				Admin: config.CORSPolicy{
+					AllowedOrigins: []string{"https://admin.example.com"},
+					AllowedMethods: []string{"GET", "PUT", "DELETE"},
+					AllowedHeaders: []string{"Authorization"},
+				},
+			},
+		})
+		go proxyServer.Listen()
+
+		Eventually(func() error {
+			conn, err := net.Dial("tcp", "localhost:8897")
+			if err == nil {
+				conn.Close()
+			}
+			return err
+		}).Should(Succeed())
+	})
+
+	It("should allow the listed origins with credentials", func() {
+		resp := request("GET", "/indexes/products/search?q=shoes", "https://example.com")
+
+		Expect(resp.Header.Values("Access-Control-Allow-Origin")).To(Equal([]string{"https://example.com"}))
+		Expect(resp.Header.Get("Access-Control-Allow-Credentials")).To(Equal("true"))
+		Expect(resp.Header.Get("Access-Control-Expose-Headers")).To(Equal("X-Cache"))
+		Expect(resp.Header.Get("Vary")).To(ContainSubstring("Origin"))
+		Expect(resp.Header.Get("Content-Type")).To(Equal("application/json"))
+	})
+
+	It("should allow the subdomains of wildcard origins", func() {
+		resp := request("GET", "/indexes/products/search?q=shoes", "https://eu.shop.com")
+		Expect(resp.Header.Get("Access-Control-Allow-Origin")).To(Equal("https://eu.shop.com"))
+		Expect(resp.Header.Get("Content-Type")).To(Equal("application/json"))
+
+		resp = request("GET", "/indexes/products/search?q=shoes", "https://shop.com")
+		Expect(resp.Header.Get("Access-Control-Allow-Origin")).To(BeEmpty())
+	})
+
+	It("should not allow other origins", func() {
+		resp := request("GET", "/indexes/products/search?q=shoes", "https://evil.com")
+
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(resp.Header.Get("Access-Control-Allow-Origin")).To(BeEmpty())
+		Expect(resp.Header.Get("Access-Control-Allow-Credentials")).To(BeEmpty())
+	})
+
+	It("should answer preflight requests", func() {
+		resp := request("OPTIONS", "/indexes/products/search", "https://example.com")
+
+		Expect(resp.StatusCode).To(Equal(http.StatusNoContent))
+		Expect(resp.Header.Get("X-Request-Id")).ToNot(BeEmpty())
+		Expect(resp.Header.Get("Access-Control-Allow-Origin")).To(Equal("https://example.com"))
+		Expect(resp.Header.Get("Access-Control-Allow-Methods")).To(Equal("GET, POST"))
+		Expect(resp.Header.Get("Access-Control-Allow-Headers")).To(Equal("Content-Type, Authorization"))
+		Expect(resp.Header.Get("Access-Control-Max-Age")).To(Equal("600"))
+	})
+
+	It("should apply the admin policy to admin routes", func() {
+		resp := request("OPTIONS", "/aliases", "https://example.com")
+		Expect(resp.StatusCode).To(Equal(http.StatusNoContent))
+		Expect(resp.Header.Get("Access-Control-Allow-Origin")).To(BeEmpty())
+
+		resp = request("OPTIONS", "/aliases", "https://admin.example.com")
+		Expect(resp.Header.Get("Access-Control-Allow-Origin")).To(Equal("https://admin.example.com"))
+		Expect(resp.Header.Get("Access-Control-Allow-Methods")).To(Equal("GET, PUT, DELETE"))
+		Expect(resp.Header.Get("Access-Control-Allow-Credentials")).To(BeEmpty())
+
+		// errors are readable by the allowed origins
+		resp = request("GET", "/aliases", "https://admin.example.com")
+		Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+		Expect(resp.Header.Get("Access-Control-Allow-Origin")).To(Equal("https://admin.example.com"))
+	})
+
+	It("should keep the content type of other responses", func() {
+		resp := request("GET", "/version", "https://example.com")
+
+		Expect(resp.Header.Get("Content-Type")).To(Equal("text/plain"))
+		Expect(resp.Header.Values("Access-Control-Allow-Origin")).To(Equal([]string{"https://example.com"}))
+	})
+
+	AfterAll(func() {
+		Expect(proxyServer.Shutdown(context.Background())).To(Succeed())
+		meilisearch.Close()
+		redis.Close()
+	})
+})
+
+// testCA signs the certificates of the TLS tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string
+}
+
+func newTestCA(dir string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).To(BeNil())
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).To(BeNil())
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).To(BeNil())
+
+	file := filepath.Join(dir, "ca.pem")
+	Expect(os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)).To(Succeed())
+
+	return &testCA{cert: cert, key: key, file: file}
+}
+
+// issue writes a certificate of name signed by the CA to dir, for servers and clients
+func (ca *testCA) issue(dir string, name string, serial int64) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).To(BeNil())
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	Expect(err).To(BeNil())
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	Expect(err).To(BeNil())
+
+	certFile, keyFile := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")
+	Expect(os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)).To(Succeed())
+	Expect(os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)).To(Succeed())
+
+	return certFile, keyFile
+}
+
+var _ = Describe("TLS", Ordered, func() {
+
+	var redis *miniredis.Miniredis
+	var meilisearch *httptest.Server
+	var proxyServer *proxy.Proxy
+	var ca *testCA
+	var dir string
+	var clientName atomic.Value
+
+	// get requests the proxy over a new HTTP/2 connection
+	get := func(path string) *http.Response {
+		pool := x509.NewCertPool()
+		pool.AddCert(ca.cert)
+
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: pool},
+			ForceAttemptHTTP2: true,
+		}}
+		defer client.CloseIdleConnections()
+
+		resp, err := client.Get("https://localhost:8898" + path)
+		Expect(err).To(BeNil())
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+
+	BeforeAll(func() {
+		dir = GinkgoT().TempDir()
+		ca = newTestCA(dir)
+
+		// Meilisearch requires a client certificate signed by the CA
+		pool := x509.NewCertPool()
+		pool.AddCert(ca.cert)
+		certFile, keyFile := ca.issue(dir, "meilisearch.local", 2)
+		pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+		Expect(err).To(BeNil())
+
+		meilisearch = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			clientName.Store(r.TLS.PeerCertificates[0].Subject.CommonName)
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(testJSON))
+		}))
+		meilisearch.TLS = &tls.Config{
+			Certificates: []tls.Certificate{pair},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    pool,
+		}
+		meilisearch.StartTLS()
+
+		redis, _ = miniredis.Run()
+
+		upstreamConfig := config.DefaultUpstreamConfig()
+		upstreamConfig.CAFile = ca.file
+		upstreamConfig.CertFile, upstreamConfig.KeyFile = ca.issue(dir, "proxy-client", 3)
+		// Meilisearch is reached by IP, its certificate is for meilisearch.local
+		upstreamConfig.ServerName = "meilisearch.local"
+
+		tlsConfig := &config.TLSConfig{}
+		tlsConfig.CertFile, tlsConfig.KeyFile = ca.issue(dir, "localhost", 4)
+
+		proxyServer = proxy.NewProxy(&config.Config{
+			MeilisearchHost: meilisearch.URL,
+			Port:            "8898",
+			CacheConfig: &config.CacheConfig{
+				TTL:    300,
+				Engine: "redis",
+				Url:    "redis://" + redis.Addr(),
+			},
+			HealthConfig: &config.HealthConfig{
+				ReadinessPolicy: config.ReadinessStrict,
+				CheckTimeout:    2 * time.Second,
+			},
+			UpstreamConfig: upstreamConfig,
+			TLSConfig:      tlsConfig,
+		})
+		go proxyServer.Listen()
+
+		Eventually(func() error {
+			conn, err := net.Dial("tcp", "localhost:8898")
+			if err == nil {
+				conn.Close()
+			}
+			return err
+		}).Should(Succeed())
+	})
+
+	It("should serve HTTP/2 over TLS", func() {
+		resp := get("/indexes/products/search?q=shoes")
+
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(resp.ProtoMajor).To(Equal(2))
+		Expect(resp.TLS.PeerCertificates[0].SerialNumber.Int64()).To(Equal(int64(4)))
+	})
+
+	It("should present the client certificate to Meilisearch", func() {
+		Expect(get("/indexes/shirts/search?q=shoes").StatusCode).To(Equal(http.StatusOK))
+		Expect(clientName.Load()).To(Equal("proxy-client"))
+
+		// the health checks reach Meilisearch with the same settings
+		Expect(get("/health/ready").StatusCode).To(Equal(http.StatusOK))
+	})
+
+	It("should use the rotated certificate after a reload", func() {
+		ca.issue(dir, "localhost", 5)
+
+		// the config only comes from env vars
+		os.Setenv("MEILISEARCH_HOST", meilisearch.URL)
+		defer os.Unsetenv("MEILISEARCH_HOST")
+		Expect(proxyServer.Reload()).To(Succeed())
+
+		Expect(get("/health").TLS.PeerCertificates[0].SerialNumber.Int64()).To(Equal(int64(5)))
+	})
+
+	AfterAll(func() {
+		Expect(proxyServer.Shutdown(context.Background())).To(Succeed())
+		meilisearch.Close()
+		redis.Close()
+	})
+})
+
+var _ = Describe("Admin listener", Ordered, func() {
+
+	var redis *miniredis.Miniredis
+	var meilisearch *httptest.Server
+	var proxyServer *proxy.Proxy
+	var socket string
+	var admin *http.Client
+
+	get := func(client *http.Client, url string) *http.Response {
+		req, _ := http.NewRequest("GET", url, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+
+		resp, err := client.Do(req)
+		Expect(err).To(BeNil())
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+
+	BeforeAll(func() {
+		redis, _ = miniredis.Run()
+		meilisearch = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !strings.HasPrefix(r.URL.Path, "/indexes/") {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"code":"not_found"}`))
+				return
+			}
+			w.Write([]byte(testJSON))
+		}))
+
+		// unix socket paths are limited to about 100 characters
+		dir, err := os.MkdirTemp("", "admin")
+		Expect(err).To(BeNil())
+		DeferCleanup(os.RemoveAll, dir)
+		socket = filepath.Join(dir, "admin.sock")
+
+		admin = &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			},
+		}}
+
+		proxyServer = proxy.NewProxy(&config.Config{
+			MeilisearchHost: meilisearch.URL,
+			Port:            "8899",
+			ProxyPurgeToken: "secret",
+			CacheConfig: &config.CacheConfig{
+				TTL:    300,
+				Engine: "redis",
+				Url:    "redis://" + redis.Addr(),
+			},
+			AdminConfig: &config.AdminConfig{Listen: "unix:" + socket},
+		})
+		go proxyServer.Listen()
+
+		Eventually(func() error {
+			conn, err := net.Dial("unix", socket)
+			if err == nil {
+				conn.Close()
+			}
+			return err
+		}).Should(Succeed())
+	})
+
+	It("should only serve the routes of Meilisearch on the public port", func() {
+		Expect(get(http.DefaultClient, "http://localhost:8899/indexes/products/search?q=shoes").StatusCode).To(Equal(http.StatusOK))
+
+		// the routes of the proxy go to Meilisearch like any other route
+		Expect(get(http.DefaultClient, "http://localhost:8899/proxy/metrics").StatusCode).To(Equal(http.StatusNotFound))
+		Expect(get(http.DefaultClient, "http://localhost:8899/aliases").StatusCode).To(Equal(http.StatusNotFound))
+	})
+
+	It("should serve the admin routes on the admin listener", func() {
+		Expect(get(admin, "http://admin/proxy/metrics").StatusCode).To(Equal(http.StatusOK))
+		resp := get(admin, "http://admin/aliases")
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(resp.Header.Get("X-Request-Id")).ToNot(BeEmpty())
+		Expect(get(admin, "http://admin/health").StatusCode).To(Equal(http.StatusOK))
+
+		resp = get(admin, "http://admin/indexes/products/search?q=shoes")
+		Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+	})
+
+	It("should still require the purge token on the admin listener", func() {
+		req, _ := http.NewRequest("GET", "http://admin/proxy/metrics", nil)
+		resp, err := admin.Do(req)
+		Expect(err).To(BeNil())
+		resp.Body.Close()
+
+		Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+	})
+
+	AfterAll(func() {
+		Expect(proxyServer.Shutdown(context.Background())).To(Succeed())
+		meilisearch.Close()
+		redis.Close()
+	})
+})
+
+var _ = Describe("Route policy", Ordered, func() {
+
+	var redis *miniredis.Miniredis
+	var meilisearch *httptest.Server
+	var proxyServer *proxy.Proxy
+	var upstreamRequests atomic.Int32
+	var upstreamPath atomic.Value
+
+	request := func(method string, path string, body string) (*http.Response, map[string]interface{}) {
+		req, _ := http.NewRequest(method, "http://localhost:8900"+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer proxyKey")
+
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).To(BeNil())
+		defer resp.Body.Close()
+
+		var response map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&response)
+		return resp, response
+	}
+
+	BeforeAll(func() {
+		redis, _ = miniredis.Run()
+		meilisearch = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			upstreamRequests.Add(1)
+			upstreamPath.Store(r.URL.Path)
+			w.Write([]byte(testJSON))
+		}))
+
+		proxyServer = proxy.NewProxy(&config.Config{
+			MeilisearchHost:        meilisearch.URL,
+			MeilisearchMasterKey:   "masterKey",
+			ProxyMasterKey:         "proxyKey",
+			ProxyMasterKeyOverride: true,
+			Port:                   "8900",
+			IndexAliases: map[string]string{
+				"public": "private",
+				"hidden": "products",
+			},
+			CacheConfig: &config.CacheConfig{
+				TTL:    300,
+				Engine: "redis",
+				Url:    "redis://" + redis.Addr(),
+			},
+			RoutePolicyConfig: &config.RoutePolicyConfig{
+				Preset: "read-only",
+				Deny:   []string{"* /indexes/private/**", "* /indexes/hidden/**"},
+			},
+		})
+		go proxyServer.Listen()
+
+		Eventually(func() error {
+			conn, err := net.Dial("tcp", "localhost:8900")
+			if err == nil {
+				conn.Close()
+			}
+			return err
+		}).Should(Succeed())
+	})
+
+	It("should forward the allowed routes", func() {
+		resp, _ := request("POST", "/indexes/products/search", `{"q":"shoes"}`)
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+		resp, _ = request("GET", "/indexes/products/documents/1", "")
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+	})
+
+	It("should answer denied routes with a Meilisearch error without reaching Meilisearch", func() {
+		before := upstreamRequests.Load()
+
+		for _, route := range [][2]string{{"DELETE", "/indexes/products"}, {"GET", "/keys"}, {"POST", "/dumps"}, {"POST", "/snapshots"}, {"POST", "/indexes/products/documents"}} {
+			resp, response := request(route[0], route[1], "")
+
+			Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+			Expect(response).To(HaveKeyWithValue("code", "proxy_route_denied"))
+			Expect(response).To(HaveKeyWithValue("message", "The route `"+route[0]+" "+route[1]+"` is not allowed by the proxy."))
+			Expect(response).To(HaveKeyWithValue("type", "auth"))
+			Expect(response).To(HaveKeyWithValue("link", "https://docs.meilisearch.com/errors#proxy_route_denied"))
+		}
+
+		Expect(upstreamRequests.Load()).To(Equal(before))
+	})
+
+	It("should deny the searches of denied indexes", func() {
+		resp, response := request("POST", "/indexes/private/search", `{"q":"shoes"}`)
+
+		Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+		Expect(response).To(HaveKeyWithValue("code", "proxy_route_denied"))
+	})
+
+	It("should deny aliases of denied indexes and denied aliases of allowed indexes", func() {
+		before := upstreamRequests.Load()
+
+		for _, path := range []string{"/indexes/public/search", "/indexes/hidden/search"} {
+			resp, response := request("POST", path, `{"q":"shoes"}`)
+
+			Expect(resp.StatusCode).To(Equal(http.StatusForbidden))
+			Expect(response).To(HaveKeyWithValue("code", "proxy_route_denied"))
+		}
+
+		Expect(upstreamRequests.Load()).To(Equal(before))
+	})
+
+	It("should match and forward the cleaned path", func() {
+		before := upstreamRequests.Load()
+
+		for _, path := range []string{"//keys", "/keys/", "/indexes/x/../../keys", "/indexes/x/%2E%2E/%2E%2E/keys", "/indexes//private/documents"} {
+			w := httptest.NewRecorder()
+			proxyServer.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+
+			Expect(w.Code).To(Equal(http.StatusForbidden), path)
+		}
+
+		Expect(upstreamRequests.Load()).To(Equal(before))
+
+		w := httptest.NewRecorder()
+		proxyServer.ServeHTTP(w, httptest.NewRequest("GET", "//indexes//products/documents/1/", nil))
+
+		Expect(w.Code).To(Equal(http.StatusOK))
+		Expect(upstreamPath.Load()).To(Equal("/indexes/products/documents/1"))
+	})
+
+	AfterAll(func() {
+		Expect(proxyServer.Shutdown(context.Background())).To(Succeed())
+		meilisearch.Close()
+		redis.Close()
+	})
+})
+
+var _ = Describe("Health", Ordered, func() {
+
+	var redis *miniredis.Miniredis
+	var meilisearch *httptest.Server
+	var proxyServer *proxy.Proxy
+	var meilisearchHealthy atomic.Bool
+
+	BeforeAll(func() {
+		meilisearchHealthy.Store(true)
+		redis, _ = miniredis.Run()
+		meilisearch = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !meilisearchHealthy.Load() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte(`{"status":"available"}`))
+		}))
+
+		proxyServer = proxy.NewProxy(&config.Config{
+			MeilisearchHost:        meilisearch.URL,
+			MeilisearchMasterKey:   "masterKey",
+			ProxyMasterKey:         "proxyKey",
+			ProxyMasterKeyOverride: true,
+			Port:                   "8901",
+			CacheConfig: &config.CacheConfig{
+				TTL:    300,
+				Engine: "redis",
+				Url:    "redis://" + redis.Addr(),
+			},
+			HealthConfig: &config.HealthConfig{
+				ReadinessPolicy: config.ReadinessStale,
+				CheckTimeout:    2 * time.Second,
+			},
+		})
+		go proxyServer.Listen()
+
+		Eventually(func() error {
+			conn, err := net.Dial("tcp", "localhost:8901")
+			if err == nil {
+				conn.Close()
+			}
+			return err
+		}).Should(Succeed())
+	})
+
+	It("should answer the probes without the proxy key", func() {
+		for _, path := range []string{"/health", "/health/live", "/health/ready"} {
+			resp, err := http.Get("http://localhost:8901" + path)
+			Expect(err).To(BeNil())
+			Expect(resp.StatusCode).To(Equal(http.StatusOK), path)
+		}
+
+		resp, err := http.Get("http://localhost:8901/indexes")
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+		Expect(resp.Header.Get("X-Request-Id")).ToNot(BeEmpty())
+	})
+
+	It("should not stay ready while Meilisearch is down without stale copies", func() {
+		meilisearchHealthy.Store(false)
+		defer meilisearchHealthy.Store(true)
+
+		resp, err := http.Get("http://localhost:8901/health/ready")
+		Expect(err).To(BeNil())
+		Expect(resp.StatusCode).To(Equal(http.StatusServiceUnavailable))
+	})
+
+	AfterAll(func() {
+		Expect(proxyServer.Shutdown(context.Background())).To(Succeed())
+		meilisearch.Close()
+		redis.Close()
+	})
+})
+
+var _ = Describe("Warming", Ordered, func() {
+
+	var redis *miniredis.Miniredis
+	var meilisearch *httptest.Server
+	var proxyServer *proxy.Proxy
+	var logs *gbytes.Buffer
+
+	BeforeAll(func() {
+		redis, _ = miniredis.Run()
+		meilisearch = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/indexes/products/search" {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"message":"Index not found.","code":"index_not_found"}`))
+				return
+			}
+			w.Write([]byte(testJSON))
+		}))
+
+		proxyServer = proxy.NewProxy(&config.Config{
+			MeilisearchHost: meilisearch.URL,
+			Port:            "8902",
+			CacheConfig: &config.CacheConfig{
+				TTL:    300,
+				Engine: "redis",
+				Url:    "redis://" + redis.Addr(),
+			},
+			WarmConfig: &config.WarmConfig{
+				TopN:     10,
+				HalfLife: time.Hour,
+				Rate:     100,
+			},
+			SearchRules: map[string]*config.SearchRule{
+				"products": {KeyFilters: map[string]string{"filtered-key": "brand = acme"}},
+			},
+		})
+		logs = gbytes.NewBuffer()
+		proxyServer.Logger = logger.New(logs, logger.FormatJSON, zerolog.DebugLevel)
+		go proxyServer.Listen()
+
+		Eventually(func() error {
+			conn, err := net.Dial("tcp", "localhost:8902")
+			if err == nil {
+				conn.Close()
+			}
+			return err
+		}).Should(Succeed())
+	})
+
+	It("should only track the searches answered successfully", func() {
+		for _, index := range []string{"products", "missing-1", "missing-2"} {
+			resp, err := http.Post("http://localhost:8902/indexes/"+index+"/search", "application/json", strings.NewReader(`{"q":"shoes"}`))
+			Expect(err).To(BeNil())
+			io.ReadAll(resp.Body)
+		}
+
+		warmed, err := proxyServer.WarmCache(context.Background(), "")
+		Expect(err).To(BeNil())
+		Expect(warmed).To(Equal(1))
+
+		Expect(logs).To(gbytes.Say(`\[products\] Warming cache with 1 popular queries`))
+		Expect(string(logs.Contents())).ToNot(ContainSubstring("[missing-1] Warming"))
+	})
+
+	It("should not track the searches restricted by their key, as warming replays with the master key", func() {
+		payload := base64.RawURLEncoding.EncodeToString([]byte(`{"apiKeyUid":"uid-a","searchRules":{"products":{"filter":"tenant = 1"}}}`))
+		for _, key := range []string{"eyJhbGciOiJIUzI1NiJ9." + payload + ".signature", "filtered-key"} {
+			req, _ := http.NewRequest("POST", "http://localhost:8902/indexes/products/search", strings.NewReader(`{"q":"restricted"}`))
+			req.Header.Set("Authorization", "Bearer "+key)
+
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).To(BeNil())
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			io.ReadAll(resp.Body)
+		}
+
+		warmed, err := proxyServer.WarmCache(context.Background(), "products")
+		Expect(err).To(BeNil())
+		Expect(warmed).To(Equal(1))
+	})
+
+	AfterAll(func() {
+		Expect(proxyServer.Shutdown(context.Background())).To(Succeed())
+		meilisearch.Close()
+		redis.Close()
+	})
 })
@@ -0,0 +1,374 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/caching"
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/config"
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/util"
+)
+
+// purgeRequest is the optional JSON body of a purge request. Without q, filter
+// or olderThan the whole index (or the whole cache) is purged.
+type purgeRequest struct {
+	Index string `json:"index"`
+	// Query is a regular expression matched against the q of the cached search
+	Query string `json:"q"`
+	// Filter is a substring matched against the filter of the cached search
+	Filter    string     `json:"filter"`
+	OlderThan *time.Time `json:"olderThan"`
+	DryRun    bool       `json:"dryRun"`
+}
+
+func (pr purgeRequest) selective() bool {
+	return pr.Query != "" || pr.Filter != "" || pr.OlderThan != nil
+}
+
+type purgeResponse struct {
+	DryRun bool     `json:"dryRun"`
+	Count  int      `json:"count"`
+	Keys   []string `json:"keys"`
+}
+
+// PurgeMatching removes the cached entries matching the purge request and returns them.
+// Only entries stored by this proxy instance are known, see caching.Registry.
+func (p *Proxy) PurgeMatching(ctx context.Context, pr purgeRequest) ([]caching.Entry, error) {
+	var query *regexp.Regexp
+	if pr.Query != "" {
+		var err error
+		query, err = regexp.Compile(pr.Query)
+		if err != nil {
+			return nil, fmt.Errorf("invalid q pattern: %w", err)
+		}
+	}
+
+	var matched []caching.Entry
+	for _, entry := range p.registry.Entries(pr.Index) {
+		if pr.OlderThan != nil && !entry.CreatedAt.Before(*pr.OlderThan) {
+			continue
+		}
+
+		q, filter := searchParams(entry)
+
+		if query != nil && !query.MatchString(q) {
+			continue
+		}
+
+		if pr.Filter != "" && !strings.Contains(filter, pr.Filter) {
+			continue
+		}
+
+		matched = append(matched, entry)
+	}
+
+	if pr.DryRun {
+		return matched, nil
+	}
+
+	for _, entry := range matched {
+		if err := p.deleteCacheEntry(ctx, entry.Key); err != nil {
+			return nil, fmt.Errorf("error deleting cache key %s: %w", entry.Key, err)
+		}
+	}
+
+	p.log(ctx).Info().Msgf("[%s] Purged %d matching cache entries", pr.Index, len(matched))
+
+	return matched, nil
+}
+
+// deleteCacheEntry deletes a cache entry along with its stale copy, so that a purged
+// search isn't answered with the purged response while Meilisearch is failing
+func (p *Proxy) deleteCacheEntry(ctx context.Context, key string) error {
+	for _, k := range []string{key, staleKey(key)} {
+		if err := p.GetCache().Delete(ctx, k); err != nil {
+			return err
+		}
+	}
+	p.registry.Remove(key)
+
+	return nil
+}
+
+// searchParams extracts the query text and filter of a cached search request,
+// from the JSON body of POST searches or from the query string of GET searches
+func searchParams(entry caching.Entry) (string, string) {
+	if len(entry.Body) > 0 {
+		var body map[string]json.RawMessage
+		if err := json.Unmarshal(entry.Body, &body); err != nil {
+			return "", ""
+		}
+
+		var q string
+		json.Unmarshal(body["q"], &q)
+
+		// filters are either a string or an array of (arrays of) strings
+		var filter string
+		if err := json.Unmarshal(body["filter"], &filter); err != nil {
+			filter = string(body["filter"])
+		}
+
+		return q, filter
+	}
+
+	if _, rawQuery, ok := strings.Cut(entry.Path, "?"); ok {
+		values, err := url.ParseQuery(rawQuery)
+		if err != nil {
+			return "", ""
+		}
+
+		return values.Get("q"), values.Get("filter")
+	}
+
+	return "", ""
+}
+
+var purgeJobPath = regexp.MustCompile(`^/purge/jobs/([^/]+)$`)
+
+const (
+	purgeJobPending   = "pending"
+	purgeJobRunning   = "running"
+	purgeJobSucceeded = "succeeded"
+	purgeJobFailed    = "failed"
+
+	// finished jobs are kept around so their outcome can be queried
+	maxFinishedPurgeJobs = 100
+)
+
+type purgeJob struct {
+	ID         string       `json:"id"`
+	Status     string       `json:"status"`
+	Request    purgeRequest `json:"request"`
+	Count      int          `json:"count"`
+	Keys       []string     `json:"keys,omitempty"`
+	Error      string       `json:"error,omitempty"`
+	CreatedAt  time.Time    `json:"createdAt"`
+	FinishedAt *time.Time   `json:"finishedAt,omitempty"`
+
+	idempotencyKey string
+}
+
+func (j *purgeJob) finished() bool {
+	return j.Status == purgeJobSucceeded || j.Status == purgeJobFailed
+}
+
+// purgeJobs runs purges in the background and records their outcome. Submitting a
+// purge identical to one that is still pending or running returns the existing job,
+// as does retrying a request with the same Idempotency-Key header.
+type purgeJobs struct {
+	mu       sync.Mutex
+	jobs     map[string]*purgeJob
+	finished []string
+}
+
+func newPurgeJobs() *purgeJobs {
+	return &purgeJobs{
+		jobs: make(map[string]*purgeJob),
+	}
+}
+
+// Submit starts run for a purge request in the background and returns a copy of its job
+func (pj *purgeJobs) Submit(pr purgeRequest, idempotencyKey string, run func(*purgeJob) error) purgeJob {
+	pj.mu.Lock()
+	defer pj.mu.Unlock()
+
+	for _, job := range pj.jobs {
+		if idempotencyKey != "" && job.idempotencyKey == idempotencyKey {
+			return *job
+		}
+		if !job.finished() && job.Request.equal(pr) {
+			return *job
+		}
+	}
+
+	job := &purgeJob{
+		ID:             newPurgeJobID(),
+		Status:         purgeJobPending,
+		Request:        pr,
+		CreatedAt:      time.Now(),
+		idempotencyKey: idempotencyKey,
+	}
+	pj.jobs[job.ID] = job
+
+	go func() {
+		pj.update(job.ID, func(job *purgeJob) { job.Status = purgeJobRunning })
+
+		// run works on its own copy, the job is only touched under the lock
+		result := *job
+		err := run(&result)
+
+		pj.update(job.ID, func(job *purgeJob) {
+			now := time.Now()
+			job.FinishedAt = &now
+			job.Count = result.Count
+			job.Keys = result.Keys
+			job.Status = purgeJobSucceeded
+			if err != nil {
+				job.Status = purgeJobFailed
+				job.Error = err.Error()
+			}
+		})
+
+		pj.retire(job.ID)
+	}()
+
+	return *job
+}
+
+// Get returns a copy of a job
+func (pj *purgeJobs) Get(id string) (purgeJob, bool) {
+	pj.mu.Lock()
+	defer pj.mu.Unlock()
+
+	job, ok := pj.jobs[id]
+	if !ok {
+		return purgeJob{}, false
+	}
+
+	return *job, true
+}
+
+func (pj *purgeJobs) update(id string, update func(*purgeJob)) {
+	pj.mu.Lock()
+	defer pj.mu.Unlock()
+
+	update(pj.jobs[id])
+}
+
+func (pj *purgeJobs) retire(id string) {
+	pj.mu.Lock()
+	defer pj.mu.Unlock()
+
+	pj.finished = append(pj.finished, id)
+	if len(pj.finished) > maxFinishedPurgeJobs {
+		delete(pj.jobs, pj.finished[0])
+		pj.finished = pj.finished[1:]
+	}
+}
+
+func newPurgeJobID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		// crypto/rand never fails on supported platforms, fall back to the clock
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+
+	return hex.EncodeToString(id)
+}
+
+func (pr purgeRequest) equal(other purgeRequest) bool {
+	if (pr.OlderThan == nil) != (other.OlderThan == nil) {
+		return false
+	}
+	if pr.OlderThan != nil && !pr.OlderThan.Equal(*other.OlderThan) {
+		return false
+	}
+
+	return pr.Index == other.Index && pr.Query == other.Query && pr.Filter == other.Filter && pr.DryRun == other.DryRun
+}
+
+func (pr purgeRequest) validate() error {
+	if pr.Query != "" {
+		if _, err := regexp.Compile(pr.Query); err != nil {
+			return fmt.Errorf("invalid q pattern: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (p *Proxy) purgeConfig() *config.PurgeConfig {
+	if p.GetConfig().PurgeConfig == nil {
+		return config.DefaultPurgeConfig()
+	}
+
+	return p.GetConfig().PurgeConfig
+}
+
+// runPurgeJob executes a purge with a bounded timeout, logging with the id of the request
+// that submitted it. Unless disabled it refuses to purge while Meilisearch is unhealthy,
+// as the cache would then have nothing to serve.
+func (p *Proxy) runPurgeJob(requestCtx context.Context, job *purgeJob) error {
+	cfg := p.purgeConfig()
+
+	ctx, cancel := context.WithTimeout(withRequestOf(p.Context, requestCtx), cfg.Timeout)
+	defer cancel()
+
+	if cfg.RequireHealthyUpstream {
+		if err := p.checkUpstreamHealth(ctx, cfg.HealthTimeout); err != nil {
+			p.log(ctx).Error().Msgf("Purge job %s refused: %s", job.ID, err)
+			return fmt.Errorf("refusing to purge cache: %w", err)
+		}
+	}
+
+	if !job.Request.selective() {
+		return p.PurgeCache(ctx, job.Request.Index)
+	}
+
+	entries, err := p.PurgeMatching(ctx, job.Request)
+	if err != nil {
+		return err
+	}
+
+	job.Count = len(entries)
+	for _, entry := range entries {
+		job.Keys = append(job.Keys, entry.Key)
+	}
+
+	return nil
+}
+
+// checkUpstreamHealth calls Meilisearch's /health endpoint
+func (p *Proxy) checkUpstreamHealth(ctx context.Context, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	healthURL := *p.source
+	healthURL.Path = util.SingleJoiningSlash(p.source.Path, "/health")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, healthURL.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Transport: p.transport}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Meilisearch is unreachable: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Meilisearch health check returned status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+func (p *Proxy) handlePurgeJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := purgeJobPath.FindStringSubmatch(r.URL.Path)[1]
+
+	job, ok := p.purgeJobs.Get(id)
+	if !ok {
+		http.Error(w, "Purge job not found", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, job)
+}
@@ -0,0 +1,295 @@
+package proxy
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/config"
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/logger"
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/ratelimit"
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/util"
+	"github.com/redis/go-redis/v9"
+)
+
+type rateLimitClientKey struct{}
+
+// clientLimiter limits the requests of each client, see rateLimitMiddleware
+type clientLimiter struct {
+	limiter ratelimit.Limiter
+	config  *config.RateLimitConfig
+	trusted []*net.IPNet
+}
+
+func newClientLimiter(ctx context.Context, cfg *config.RateLimitConfig) *clientLimiter {
+	if cfg == nil || (cfg.Rate <= 0 && cfg.MissRate <= 0) {
+		return nil
+	}
+
+	l := &clientLimiter{config: cfg, limiter: ratelimit.NewMemoryLimiter()}
+
+	for _, cidr := range cfg.TrustedProxies {
+		if _, network, err := net.ParseCIDR(cidr); err == nil {
+			l.trusted = append(l.trusted, network)
+		}
+	}
+
+	if cfg.Store == "redis" {
+		logger := logger.GetLogger()
+
+		opts, err := redis.ParseURL(cfg.Url)
+		if err != nil {
+			logger.Fatal().Msgf("Error parsing rate limit Redis URL: %s", err)
+		}
+
+		client := redis.NewClient(opts)
+		if err := client.Ping(ctx).Err(); err != nil {
+			logger.Error().Msg("Redis not available, falling back to in-memory rate limits")
+			client.Close()
+			return l
+		}
+
+		l.limiter = ratelimit.NewRedisLimiter(client)
+	}
+
+	return l
+}
+
+func (l *clientLimiter) isTrusted(ip net.IP) bool {
+	for _, network := range l.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// clientIP is the address of the peer, or the last address in X-Forwarded-For that
+// wasn't added by a trusted proxy
+func (l *clientLimiter) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !l.isTrusted(ip) {
+		return host
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if hop == nil {
+			break
+		}
+
+		ip = hop
+		if !l.isTrusted(hop) {
+			break
+		}
+	}
+
+	return ip.String()
+}
+
+// tenantToken holds the claims of a Meilisearch tenant token that identify a tenant
+type tenantToken struct {
+	APIKeyUID   string          `json:"apiKeyUid"`
+	SearchRules json.RawMessage `json:"searchRules"`
+	ExpiresAt   int64           `json:"exp"`
+}
+
+// parseTenantToken reads, without verifying it, the payload of a tenant token
+func parseTenantToken(token string) (tenantToken, bool) {
+	var claims tenantToken
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, false
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(payload, &claims) != nil || claims.APIKeyUID == "" {
+		return claims, false
+	}
+
+	return claims, true
+}
+
+// tenantTokenHashes are the signing algorithms of tenant tokens
+var tenantTokenHashes = map[string]func() hash.Hash{
+	"HS256": sha256.New,
+	"HS384": sha512.New384,
+	"HS512": sha512.New,
+}
+
+// verifyTenantToken returns the claims of an unexpired tenant token signed with one of
+// keys, and the key it was signed with
+func verifyTenantToken(token string, keys []string) (tenantToken, string, bool) {
+	claims, ok := parseTenantToken(token)
+	if !ok || (claims.ExpiresAt != 0 && time.Now().Unix() >= claims.ExpiresAt) {
+		return claims, "", false
+	}
+
+	parts := strings.Split(token, ".")
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(data, &header) != nil {
+		return claims, "", false
+	}
+	newHash, ok := tenantTokenHashes[header.Alg]
+	if !ok {
+		return claims, "", false
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, "", false
+	}
+
+	for _, key := range keys {
+		mac := hmac.New(newHash, []byte(key))
+		mac.Write([]byte(parts[0] + "." + parts[1]))
+		if hmac.Equal(mac.Sum(nil), signature) {
+			return claims, key, true
+		}
+	}
+
+	return claims, "", false
+}
+
+// isKey tells whether token is one of keys
+func isKey(token string, keys []string) bool {
+	for _, key := range keys {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(key)) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func hashKey(parts ...[]byte) string {
+	hash := sha256.New()
+	for _, part := range parts {
+		hash.Write(part)
+		hash.Write([]byte{0})
+	}
+
+	return fmt.Sprintf("%x", hash.Sum(nil))
+}
+
+// clientKeys are the buckets a request takes a token from. Every request takes one from
+// the bucket of its client IP. With by api_key or tenant, requests made with one of the
+// configured keys, or with a tenant token signed by one, also take one from the bucket
+// of the key, or of the tenant (key and search rules). Keys and tokens the proxy can't
+// verify only have the IP bucket, so that made up tokens don't get buckets of their own.
+func (l *clientLimiter) clientKeys(r *http.Request, keys []string) []string {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	ipKey := "ip:" + l.clientIP(r)
+
+	if l.config.By == config.RateLimitByIP || token == "" {
+		return []string{ipKey}
+	}
+
+	if isKey(token, keys) {
+		return []string{ipKey, "key:" + hashKey([]byte(token))}
+	}
+
+	claims, parentKey, ok := verifyTenantToken(token, keys)
+	if !ok {
+		return []string{ipKey}
+	}
+
+	if l.config.By == config.RateLimitByAPIKey {
+		return []string{ipKey, "key:" + hashKey([]byte(parentKey))}
+	}
+
+	return []string{ipKey, "tenant:" + hashKey([]byte(parentKey), util.CanonicalJSON(claims.SearchRules))}
+}
+
+// allow takes a token from a bucket of the client, answering 429 when it is empty
+func (p *Proxy) allow(w http.ResponseWriter, r *http.Request, key string, limit ratelimit.Limit) bool {
+	allowed, wait, err := p.rateLimiter.limiter.Allow(r.Context(), key, limit)
+	if err != nil {
+		// don't turn a rate limit store outage into an outage of the search
+		p.log(r.Context()).Error().Msgf("Error checking rate limit of %s: %s", key, err)
+		return true
+	}
+
+	if allowed {
+		return true
+	}
+
+	p.log(r.Context()).Debug().Msgf("Rate limit of %s exceeded, retry in %s", key, wait)
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	writeMeilisearchError(w, http.StatusTooManyRequests, "too_many_requests",
+		fmt.Sprintf("Too many requests, retry in %s.", wait.Round(time.Second)))
+
+	return false
+}
+
+// rateLimitMiddleware limits all the requests of a client, cache hits included.
+// Requests that reach Meilisearch are further limited by allowMiss.
+func (p *Proxy) rateLimitMiddleware(next http.Handler) http.Handler {
+	if p.rateLimiter == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if healthPath.MatchString(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cfg := p.GetConfig().RateLimitConfig
+		keys := p.rateLimiter.clientKeys(r, cfg.Keys)
+		r = r.WithContext(context.WithValue(r.Context(), rateLimitClientKey{}, keys))
+
+		if cfg.Rate > 0 {
+			for _, key := range keys {
+				if !p.allow(w, r, key+":requests", ratelimit.Limit{Rate: cfg.Rate, Burst: cfg.Burst}) {
+					return
+				}
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allowMiss limits the requests of a client reaching Meilisearch. Requests that didn't
+// go through the middleware, like cache warming, are not limited.
+func (p *Proxy) allowMiss(w http.ResponseWriter, r *http.Request) bool {
+	cfg := p.GetConfig().RateLimitConfig
+	if p.rateLimiter == nil || cfg.MissRate <= 0 {
+		return true
+	}
+
+	keys, _ := r.Context().Value(rateLimitClientKey{}).([]string)
+	for _, key := range keys {
+		if !p.allow(w, r, key+":misses", ratelimit.Limit{Rate: cfg.MissRate, Burst: cfg.MissBurst}) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,205 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/config"
+)
+
+// Reload reads the certificates, the config file and env vars again and applies the
+// settings that can change at runtime: cache TTLs, keys, rate limits, search rules, index
+// aliases, CORS policies, the route policy and the access log sample rate. The cache is kept,
+// other settings only change after a restart.
+func (p *Proxy) Reload() error {
+	// certificates are rotated even when the config is invalid
+	p.lifecycleMu.Lock()
+	certificates := p.certificates
+	p.lifecycleMu.Unlock()
+
+	var errs []error
+	for _, certificate := range certificates {
+		if err := certificate.Reload(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	current := p.GetConfig()
+
+	next, err := config.Load(current.File)
+	if err != nil {
+		return errors.Join(append(errs, err)...)
+	}
+
+	updated := reloadable(current, next)
+
+	routePolicy, err := newRoutePolicy(updated.RoutePolicyConfig)
+	if err != nil {
+		return errors.Join(append(errs, err)...)
+	}
+	p.routePolicy.Store(routePolicy)
+	p.config.Store(updated)
+
+	if err := p.reloadAliases(current.IndexAliases, next.IndexAliases); err != nil {
+		errs = append(errs, err)
+	}
+
+	for _, name := range changedRestartSecrets(current, next) {
+		p.Logger.Warn().Msgf("%s changed, it only applies after a restart", name)
+	}
+	if !reflect.DeepEqual(updated, next) {
+		p.Logger.Warn().Msg("Some of the changed settings only apply after a restart")
+	}
+	if p.rateLimiter == nil && (next.RateLimitConfig.Rate > 0 || next.RateLimitConfig.MissRate > 0) {
+		p.Logger.Warn().Msg("Rate limiting was disabled at startup, it is only enabled after a restart")
+	}
+
+	return errors.Join(errs...)
+}
+
+// reloadable returns the current config with the runtime settings of the next one
+func reloadable(current *config.Config, next *config.Config) *config.Config {
+	updated := *current
+
+	updated.MeilisearchMasterKey = next.MeilisearchMasterKey
+	updated.ProxyMasterKey = next.ProxyMasterKey
+	updated.ProxyMasterKeyOverride = next.ProxyMasterKeyOverride
+	updated.ProxyPurgeToken = next.ProxyPurgeToken
+	updated.SearchRules = next.SearchRules
+	updated.IndexAliases = next.IndexAliases
+	updated.AccessLogSampleRate = next.AccessLogSampleRate
+	updated.CORSConfig = next.CORSConfig
+	updated.RoutePolicyConfig = next.RoutePolicyConfig
+
+	if current.CacheConfig != nil {
+		cache := *current.CacheConfig
+		cache.TTL = next.CacheConfig.TTL
+		cache.StaleTTL = next.CacheConfig.StaleTTL
+		updated.CacheConfig = &cache
+	}
+
+	if current.RateLimitConfig != nil {
+		rateLimit := *current.RateLimitConfig
+		rateLimit.Rate = next.RateLimitConfig.Rate
+		rateLimit.Burst = next.RateLimitConfig.Burst
+		rateLimit.MissRate = next.RateLimitConfig.MissRate
+		rateLimit.MissBurst = next.RateLimitConfig.MissBurst
+		rateLimit.Keys = next.RateLimitConfig.Keys
+		updated.RateLimitConfig = &rateLimit
+	}
+
+	return &updated
+}
+
+// reloadAliases applies the changes of the aliases of the config like the alias routes
+// do. Aliases set at runtime are kept unless the config changes them.
+func (p *Proxy) reloadAliases(current map[string]string, next map[string]string) error {
+	var errs []error
+
+	for alias, index := range next {
+		if current[alias] != index {
+			if err := p.SetAlias(p.Context, alias, index); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	for alias := range current {
+		if _, ok := next[alias]; !ok {
+			if _, err := p.RemoveAlias(p.Context, alias); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// reload reloads the config, keeping the current one when the new one is invalid
+func (p *Proxy) reload(reason string) {
+	if err := p.Reload(); err != nil {
+		p.Logger.Error().Msgf("Error reloading the config after %s, keeping the current one: %s", reason, err)
+		return
+	}
+
+	p.Logger.Info().Msgf("Reloaded the config after %s", reason)
+}
+
+// watchConfig reloads the config when the content of its file, or of the files of
+// secrets, changes. Secrets mounted by Kubernetes are rotated this way.
+func (p *Proxy) watchConfig(files []string, interval time.Duration) {
+	last := make(map[string][]byte, len(files))
+	for _, file := range files {
+		last[file], _ = os.ReadFile(file)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			var changed []string
+
+			for _, file := range files {
+				data, err := os.ReadFile(file)
+				if err != nil {
+					p.Logger.Warn().Msgf("Error reading %s: %s", file, err)
+					continue
+				}
+
+				if !bytes.Equal(data, last[file]) {
+					last[file] = data
+					changed = append(changed, file)
+				}
+			}
+
+			if len(changed) > 0 {
+				p.reload("a change of " + strings.Join(changed, ", "))
+			}
+		case <-p.Context.Done():
+			return
+		}
+	}
+}
+
+// restartSecrets are the secrets of the clients created on startup, by setting. Their
+// files are watched, but a new value only applies after a restart.
+func restartSecrets(c *config.Config) map[string]string {
+	secrets := map[string]string{}
+	if c.CacheConfig != nil {
+		secrets["cache.url (CACHE_URL)"] = c.CacheConfig.Url
+	}
+	if c.RateLimitConfig != nil {
+		secrets["rateLimit.url (RATE_LIMIT_URL)"] = c.RateLimitConfig.Url
+	}
+	if c.AnalyticsConfig != nil {
+		secrets["analytics.redisUrl (ANALYTICS_REDIS_URL)"] = c.AnalyticsConfig.RedisUrl
+		secrets["analytics.webhookUrl (ANALYTICS_WEBHOOK_URL)"] = c.AnalyticsConfig.WebhookUrl
+	}
+	if c.MirrorConfig != nil {
+		secrets["mirror.apiKey (MIRROR_API_KEY)"] = c.MirrorConfig.ApiKey
+	}
+
+	return secrets
+}
+
+// changedRestartSecrets returns the restart secrets whose value changed, sorted
+func changedRestartSecrets(current *config.Config, next *config.Config) []string {
+	nextSecrets := restartSecrets(next)
+
+	var changed []string
+	for name, value := range restartSecrets(current) {
+		if nextValue, ok := nextSecrets[name]; ok && nextValue != value {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+
+	return changed
+}
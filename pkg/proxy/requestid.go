@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const requestIDHeader = "X-Request-Id"
+
+// maxRequestIDLength bounds the ids accepted from clients, longer ones are replaced
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// requestIDMiddleware runs first, so that every response carries X-Request-Id and every
+// log line of a request its id, rejected and preflight requests included
+func (p *Proxy) requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, p.withRequestID(w, r))
+	})
+}
+
+// withRequestID keeps the X-Request-Id of a request, or generates one, and returns it
+// to the client. The logger of the request logs it with every line.
+func (p *Proxy) withRequestID(w http.ResponseWriter, r *http.Request) *http.Request {
+	if requestID(r.Context()) != "" {
+		return r
+	}
+
+	id := r.Header.Get(requestIDHeader)
+	if !validRequestID(id) {
+		id = newRequestID()
+		r.Header.Set(requestIDHeader, id)
+	}
+	w.Header().Set(requestIDHeader, id)
+
+	logger := p.Logger.With().Str("requestId", id).Logger()
+	ctx := logger.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+
+	return r.WithContext(ctx)
+}
+
+// requestID returns the id of the request of a context, empty outside of requests
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// withRequestOf returns ctx with the id and logger of the request of from, for work
+// outliving the request like purge jobs
+func withRequestOf(ctx context.Context, from context.Context) context.Context {
+	id := requestID(from)
+	if id == "" {
+		return ctx
+	}
+
+	return zerolog.Ctx(from).WithContext(context.WithValue(ctx, requestIDKey{}, id))
+}
+
+// forwardRequestID passes the id of a request on to Meilisearch
+func forwardRequestID(req *http.Request) {
+	if id := requestID(req.Context()); id != "" {
+		req.Header.Set(requestIDHeader, id)
+	}
+}
+
+// log returns the logger of the request of a context, the proxy logger outside of requests
+func (p *Proxy) log(ctx context.Context) *zerolog.Logger {
+	if _, ok := ctx.Value(requestIDKey{}).(string); ok {
+		return zerolog.Ctx(ctx)
+	}
+
+	return &p.Logger
+}
+
+// validRequestID accepts the printable ASCII ids of clients, they end up in logs and headers
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+
+	return true
+}
+
+func newRequestID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		// crypto/rand never fails on supported platforms, fall back to the clock
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/config"
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/routepolicy"
+)
+
+// newRoutePolicy compiles the route policy of the config, every route is allowed without one
+func newRoutePolicy(cfg *config.RoutePolicyConfig) (*routepolicy.Policy, error) {
+	if cfg == nil {
+		cfg = config.DefaultRoutePolicyConfig()
+	}
+
+	return routepolicy.New(cfg.Preset, cfg.Allow, cfg.Deny)
+}
+
+// allowRoute answers the requests to routes of Meilisearch denied by the route policy
+// with a 403, before they reach the cache or Meilisearch. Cache warming is not limited.
+// The path is cleaned first and forwarded as it was matched, requests to an alias must
+// be allowed for both the alias and the index it points to.
+func (p *Proxy) allowRoute(w http.ResponseWriter, r *http.Request) bool {
+	if isWarmRequest(r.Context()) {
+		return true
+	}
+
+	cleaned, ok := routePath(r.URL.Path)
+	if ok && cleaned != r.URL.Path {
+		r.URL.Path = cleaned
+		r.URL.RawPath = ""
+	}
+
+	policy := p.routePolicy.Load()
+	allowed := ok && policy.Allows(r.Method, r.URL.Path)
+
+	if aliased, isAliased := requestAlias(r); allowed && isAliased {
+		original, ok := routePath(aliased.path)
+		allowed = ok && policy.Allows(r.Method, original)
+	}
+
+	if allowed {
+		return true
+	}
+
+	p.log(r.Context()).Warn().Msgf("Route policy denied %s %s", r.Method, r.URL.Path)
+	writeMeilisearchError(w, http.StatusForbidden, "proxy_route_denied",
+		"The route `"+r.Method+" "+r.URL.Path+"` is not allowed by the proxy.")
+	return false
+}
+
+// routePath merges the duplicate slashes of a path and removes its trailing slash. Paths
+// with . or .. segments are not valid routes of Meilisearch.
+func routePath(p string) (string, bool) {
+	for _, segment := range strings.Split(p, "/") {
+		if segment == "." || segment == ".." {
+			return "", false
+		}
+	}
+
+	return path.Clean("/" + p), true
+}
@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/config"
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/guardrails"
+)
+
+// searchRule returns the rule of the first of the names (alias, index) that has one,
+// or the rule of all indexes ("*")
+func (p *Proxy) searchRule(names ...string) *config.SearchRule {
+	rules := p.GetConfig().SearchRules
+
+	for _, name := range names {
+		if rule, ok := rules[name]; ok {
+			return rule
+		}
+	}
+
+	return rules["*"]
+}
+
+// filterKey is the key of the key filters of rule that applies to a request: its API key,
+// or the API key a tenant token is signed with. The claims of a tenant token can't be
+// trusted before its signature is verified, tokens not signed by one of the keys get none.
+func filterKey(r *http.Request, rule *config.SearchRule) string {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if rule == nil || len(rule.KeyFilters) == 0 || token == "" {
+		return ""
+	}
+
+	if _, ok := rule.KeyFilters[token]; ok {
+		return token
+	}
+
+	keys := make([]string, 0, len(rule.KeyFilters))
+	for key := range rule.KeyFilters {
+		keys = append(keys, key)
+	}
+
+	if _, key, ok := verifyTenantToken(token, keys); ok {
+		return key
+	}
+
+	return ""
+}
+
+// restrictedSearch tells whether the results of a search depend on its key: searches made
+// with tenant tokens, whose search rules Meilisearch applies, or with a key that has a key filter
+func restrictedSearch(r *http.Request, rule *config.SearchRule) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if _, ok := parseTenantToken(token); ok {
+		return true
+	}
+
+	return filterKey(r, rule) != ""
+}
+
+func (p *Proxy) rejectSearch(w http.ResponseWriter, r *http.Request, err error) {
+	var ruleErr *guardrails.Error
+	if !errors.As(err, &ruleErr) {
+		ruleErr = &guardrails.Error{Code: "bad_request", Message: err.Error()}
+	}
+
+	p.log(r.Context()).Info().Msgf("Rejecting search on %s: %s", r.URL.Path, ruleErr.Message)
+	writeMeilisearchError(w, http.StatusBadRequest, ruleErr.Code, ruleErr.Message)
+}
@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type captureKey struct{}
+
+// responseCapture keeps a copy of an upstream response while it is streamed to
+// the client, so it can be cached once the whole body has been sent
+type responseCapture struct {
+	mu       sync.Mutex
+	cacheKey string
+	status   int
+	header   http.Header
+	body     bytes.Buffer
+	limit    int64
+	overflow bool
+	complete bool
+	err      error
+}
+
+func newResponseCapture(limit int64) *responseCapture {
+	return &responseCapture{limit: limit}
+}
+
+func (c *responseCapture) write(p []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.overflow {
+		return
+	}
+
+	// past the limit the response is still streamed to the client, just not cached
+	if c.limit > 0 && int64(c.body.Len()+len(p)) > c.limit {
+		c.overflow = true
+		c.body = bytes.Buffer{}
+		return
+	}
+
+	c.body.Write(p)
+}
+
+func (c *responseCapture) finish(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if errors.Is(err, io.EOF) {
+		c.complete = true
+		return
+	}
+
+	c.err = err
+}
+
+// cacheable reports whether the full body of a successful response was captured
+func (c *responseCapture) cacheable() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.status == http.StatusOK && c.complete && !c.overflow && c.body.Len() > 0
+}
+
+func (c *responseCapture) bytes() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.body.Bytes()
+}
+
+// teeBody copies everything the reverse proxy reads from upstream into the capture
+type teeBody struct {
+	io.Reader
+	closers []io.Closer
+	capture *responseCapture
+	// span times the decompression of the body, if any
+	span trace.Span
+}
+
+func (t *teeBody) Read(p []byte) (int, error) {
+	n, err := t.Reader.Read(p)
+	if n > 0 {
+		t.capture.write(p[:n])
+	}
+	if err != nil {
+		t.capture.finish(err)
+	}
+
+	return n, err
+}
+
+func (t *teeBody) Close() error {
+	if t.span != nil {
+		t.span.End()
+	}
+
+	var err error
+	for _, closer := range t.closers {
+		if closeErr := closer.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+
+	return err
+}
+
+// captureResponse is the ModifyResponse hook of the reverse proxies. For searches it
+// decompresses the upstream body on the fly and tees it into the request's capture.
+func (p *Proxy) captureResponse(resp *http.Response) error {
+	recordUpstream(resp)
+	for _, header := range corsHeaders {
+		resp.Header.Del(header)
+	}
+
+	capture, ok := resp.Request.Context().Value(captureKey{}).(*responseCapture)
+	if !ok {
+		return nil
+	}
+
+	// hand a failed search over to the error handler, which serves the stale copy
+	if resp.StatusCode >= http.StatusInternalServerError {
+		if _, ok := p.getStale(resp.Request.Context(), capture.cacheKey); ok {
+			resp.Body.Close()
+			return fmt.Errorf("meilisearch responded with status %d", resp.StatusCode)
+		}
+	}
+
+	var body io.Reader = resp.Body
+	closers := []io.Closer{resp.Body}
+	var span trace.Span
+
+	switch resp.Header.Get("Content-Encoding") {
+	case "gzip":
+		p.log(resp.Request.Context()).Debug().Msg("Decompressing gzip response body")
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return fmt.Errorf("failed to create gzip reader: %w", err)
+		}
+		body = gz
+		closers = append(closers, gz)
+		_, span = p.tracer.Start(resp.Request.Context(), "response.decompress", trace.WithAttributes(attribute.String("http.response.content_encoding", "gzip")))
+	case "deflate":
+		p.log(resp.Request.Context()).Debug().Msg("Decompressing deflate response body")
+		fl := flate.NewReader(resp.Body)
+		body = fl
+		closers = append(closers, fl)
+		_, span = p.tracer.Start(resp.Request.Context(), "response.decompress", trace.WithAttributes(attribute.String("http.response.content_encoding", "deflate")))
+	default:
+		p.log(resp.Request.Context()).Debug().Msg("Using response body as is")
+	}
+
+	if body != resp.Body {
+		resp.Header.Del("Content-Encoding")
+		resp.Header.Del("Content-Length")
+		resp.ContentLength = -1
+	}
+
+	capture.mu.Lock()
+	capture.status = resp.StatusCode
+	capture.header = resp.Header.Clone()
+	capture.mu.Unlock()
+
+	resp.Body = &teeBody{Reader: body, closers: closers, capture: capture, span: span}
+
+	return nil
+}
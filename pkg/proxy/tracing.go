@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/config"
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/logger"
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/maxroll-media-group/meilisearch-proxy/pkg/proxy"
+
+// newTracing sets up the exporter of spans, the returned function flushes them on shutdown
+func newTracing(ctx context.Context, cfg *config.TracingConfig) func(context.Context) error {
+	logger := logger.GetLogger()
+
+	shutdown, err := tracing.Setup(ctx, cfg)
+	if err != nil {
+		logger.Fatal().Msgf("Error setting up tracing: %s", err)
+	}
+
+	if cfg != nil && cfg.Exporter != config.TracingExporterNone {
+		logger.Info().Msgf("Exporting traces to %s, sample ratio: %g", cfg.Exporter, cfg.SampleRatio)
+	}
+
+	return shutdown
+}
+
+// spanName names the span of a request after its route, without index names or ids
+func spanName(r *http.Request) string {
+	if match := indexPath.FindStringSubmatch(r.URL.Path); match != nil {
+		if match[2] == "/search" {
+			return r.Method + " /indexes/{index}/search"
+		}
+		if match[2] != "" {
+			return r.Method + " /indexes/{index}/..."
+		}
+		return r.Method + " /indexes/{index}"
+	}
+
+	segment, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	return r.Method + " /" + segment
+}
+
+// startRequestSpan continues the trace of the caller, from its traceparent header
+func (p *Proxy) startRequestSpan(r *http.Request) (*http.Request, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+	ctx, span := p.tracer.Start(ctx, spanName(r),
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("url.path", r.URL.Path),
+		),
+	)
+
+	return r.WithContext(ctx), span
+}
+
+func endRequestSpan(span trace.Span, w *responseRecorder) {
+	if w.status != 0 {
+		span.SetAttributes(attribute.Int("http.response.status_code", w.status))
+	}
+	if w.status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(w.status))
+	}
+	if cache := w.Header().Get("X-Cache"); cache != "" {
+		span.SetAttributes(attribute.String("meilisearch_proxy.cache", strings.ToLower(cache)))
+	}
+
+	span.End()
+}
+
+// injectTraceContext passes the trace of a request on to Meilisearch
+func injectTraceContext(req *http.Request) {
+	otel.GetTextMapPropagator().Inject(req.Context(), propagation.HeaderCarrier(req.Header))
+}
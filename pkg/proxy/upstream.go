@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/config"
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/upstream"
+)
+
+func defaultUpstreamConfig() *config.UpstreamConfig {
+	return config.DefaultUpstreamConfig()
+}
+
+// staleKey is the cache key of the copy of an entry kept for CACHE_STALE_TTL
+func staleKey(key string) string {
+	return "stale:" + key
+}
+
+// getStale returns the stale copy of a search response, if stale copies are kept
+func (p *Proxy) getStale(ctx context.Context, key string) (string, bool) {
+	if p.GetConfig().CacheConfig.StaleTTL <= 0 {
+		return "", false
+	}
+
+	response, err := p.GetCache().Get(ctx, staleKey(key))
+	if err != nil {
+		return "", false
+	}
+
+	return response, true
+}
+
+// handleUpstreamError is the ErrorHandler of the reverse proxy. A failed search is
+// answered with the stale copy of its response when there is one.
+func (p *Proxy) handleUpstreamError(w http.ResponseWriter, r *http.Request, err error) {
+	if r.Context().Err() != nil {
+		p.log(r.Context()).Debug().Msgf("Client went away during %s %s", r.Method, r.URL.Path)
+		return
+	}
+
+	p.log(r.Context()).Error().Msgf("Error proxying %s %s: %s", r.Method, r.URL.Path, err)
+
+	if capture, ok := r.Context().Value(captureKey{}).(*responseCapture); ok {
+		if response, ok := p.getStale(r.Context(), capture.cacheKey); ok {
+			p.log(r.Context()).Warn().Msgf("Serving stale response for %s, key: %s", r.URL.Path, capture.cacheKey)
+
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("X-Cache", "STALE")
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(response))
+			return
+		}
+	}
+
+	if errors.Is(err, upstream.ErrCircuitOpen) {
+		writeMeilisearchError(w, http.StatusServiceUnavailable, "proxy_upstream_unavailable",
+			"Meilisearch is unavailable, try again later.")
+		return
+	}
+
+	writeMeilisearchError(w, http.StatusBadGateway, "proxy_upstream_error",
+		"Error reaching Meilisearch.")
+}
@@ -0,0 +1,389 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/util"
+)
+
+type warmRequestKey struct{}
+
+// maxWarmBodySize is the largest JSONL body POST /warm/{index} accepts
+const maxWarmBodySize = 10 << 20
+
+// trackedQuery is a search request that can be replayed to warm the cache
+type trackedQuery struct {
+	Index  string
+	Method string
+	Path   string
+	Body   []byte
+
+	score   float64
+	updated time.Time
+}
+
+// queryTracker keeps a bounded list of the most popular search requests per index.
+// Every hit adds one to the score of a query, and scores decay exponentially with
+// the configured half-life so that yesterday's popular queries make room for today's.
+type queryTracker struct {
+	mu       sync.Mutex
+	topN     int
+	halfLife time.Duration
+	indexes  map[string]map[string]*trackedQuery
+}
+
+func newQueryTracker(topN int, halfLife time.Duration) *queryTracker {
+	return &queryTracker{
+		topN:     topN,
+		halfLife: halfLife,
+		indexes:  make(map[string]map[string]*trackedQuery),
+	}
+}
+
+func (t *queryTracker) decayed(q *trackedQuery, now time.Time) float64 {
+	return q.score * math.Exp2(-float64(now.Sub(q.updated))/float64(t.halfLife))
+}
+
+// Record registers a search request under its cache key
+func (t *queryTracker) Record(index, key, method, path string, body []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+
+	queries, ok := t.indexes[index]
+	if !ok {
+		queries = make(map[string]*trackedQuery)
+		t.indexes[index] = queries
+	}
+
+	if q, ok := queries[key]; ok {
+		q.score = t.decayed(q, now) + 1
+		q.updated = now
+		return
+	}
+
+	// keep a few more candidates than topN so new queries get a chance to climb
+	if len(queries) >= t.topN*4 {
+		var lowestKey string
+		lowest := math.MaxFloat64
+		for k, q := range queries {
+			if score := t.decayed(q, now); score < lowest {
+				lowest = score
+				lowestKey = k
+			}
+		}
+		delete(queries, lowestKey)
+	}
+
+	queries[key] = &trackedQuery{
+		Index:   index,
+		Method:  method,
+		Path:    path,
+		Body:    body,
+		score:   1,
+		updated: now,
+	}
+}
+
+// Top returns the topN queries of an index, most popular first
+func (t *queryTracker) Top(index string) []trackedQuery {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	queries := make([]trackedQuery, 0, len(t.indexes[index]))
+	for _, q := range t.indexes[index] {
+		queries = append(queries, *q)
+	}
+
+	sort.Slice(queries, func(i, j int) bool {
+		return t.decayed(&queries[i], now) > t.decayed(&queries[j], now)
+	})
+
+	if len(queries) > t.topN {
+		queries = queries[:t.topN]
+	}
+
+	return queries
+}
+
+// Indexes returns the names of all indexes with tracked queries
+func (t *queryTracker) Indexes() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	indexes := make([]string, 0, len(t.indexes))
+	for index := range t.indexes {
+		indexes = append(indexes, index)
+	}
+
+	return indexes
+}
+
+// rateLimiter spaces out warming requests so warming never overloads Meilisearch.
+// It is shared by all warming runs, concurrent runs split the same budget.
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newRateLimiter(perSecond int) *rateLimiter {
+	return &rateLimiter{interval: time.Second / time.Duration(perSecond)}
+}
+
+func (l *rateLimiter) Wait(ctx context.Context) error {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	wait := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.mu.Unlock()
+
+	if wait == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func isWarmRequest(ctx context.Context) bool {
+	return ctx.Value(warmRequestKey{}) != nil
+}
+
+// WarmCache replays the most popular recorded queries of an index against Meilisearch,
+// an empty index warms every tracked index. It returns the number of warmed queries.
+func (p *Proxy) WarmCache(ctx context.Context, index string) (int, error) {
+	if p.queries == nil {
+		return 0, fmt.Errorf("query tracking is disabled, set WARM_TOP_N to enable it")
+	}
+
+	indexes := []string{index}
+	if index == "" {
+		indexes = p.queries.Indexes()
+	}
+
+	warmed := 0
+	for _, index := range indexes {
+		queries := p.queries.Top(index)
+		p.log(ctx).Info().Msgf("[%s] Warming cache with %d popular queries", index, len(queries))
+
+		n, err := p.replayQueries(ctx, queries)
+		warmed += n
+
+		if err != nil {
+			return warmed, err
+		}
+	}
+
+	return warmed, nil
+}
+
+// WarmFromReader warms the cache of an index from JSONL, one search body per line
+func (p *Proxy) WarmFromReader(ctx context.Context, index string, r io.Reader) (int, error) {
+	queries, err := parseWarmQueries(index, r)
+	if err != nil {
+		return 0, err
+	}
+
+	p.log(ctx).Info().Msgf("[%s] Warming cache with %d queries", index, len(queries))
+
+	return p.replayQueries(ctx, queries)
+}
+
+func parseWarmQueries(index string, r io.Reader) ([]trackedQuery, error) {
+	var queries []trackedQuery
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		body := bytes.TrimSpace(scanner.Bytes())
+		if len(body) == 0 {
+			continue
+		}
+
+		if !json.Valid(body) {
+			return nil, fmt.Errorf("line %d is not valid JSON", line)
+		}
+
+		queries = append(queries, trackedQuery{
+			Index:  index,
+			Method: http.MethodPost,
+			Path:   fmt.Sprintf("/indexes/%s/search", index),
+			Body:   util.CanonicalJSON(body),
+		})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading queries: %w", err)
+	}
+
+	return queries, nil
+}
+
+func (p *Proxy) replayQueries(ctx context.Context, queries []trackedQuery) (int, error) {
+	warmed := 0
+
+	for _, q := range queries {
+		if err := p.warmLimiter.Wait(ctx); err != nil {
+			return warmed, err
+		}
+
+		if err := p.replayQuery(ctx, q); err != nil {
+			p.log(ctx).Warn().Msgf("[%s] Error warming %s: %s", q.Index, q.Path, err)
+			continue
+		}
+
+		warmed++
+	}
+
+	return warmed, nil
+}
+
+func (p *Proxy) replayQuery(ctx context.Context, q trackedQuery) error {
+	req, err := http.NewRequestWithContext(context.WithValue(ctx, warmRequestKey{}, true), q.Method, q.Path, bytes.NewReader(q.Body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if masterKey := p.GetConfig().MeilisearchMasterKey; masterKey != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", masterKey))
+	}
+
+	response := &warmResponse{header: http.Header{}}
+	p.handleSearch(response, p.resolveAlias(req))
+
+	if response.status != http.StatusOK {
+		return fmt.Errorf("upstream responded with status %d", response.status)
+	}
+
+	return nil
+}
+
+// warmResponse discards the response of a replayed search, only its status is kept
+type warmResponse struct {
+	header http.Header
+	status int
+}
+
+func (wr *warmResponse) Header() http.Header {
+	return wr.header
+}
+
+func (wr *warmResponse) WriteHeader(status int) {
+	if wr.status == 0 {
+		wr.status = status
+	}
+}
+
+func (wr *warmResponse) Write(p []byte) (int, error) {
+	if wr.status == 0 {
+		wr.status = http.StatusOK
+	}
+
+	return len(p), nil
+}
+
+// Flush lets the reverse proxy stream into the response like into a client's
+func (wr *warmResponse) Flush() {}
+
+func (p *Proxy) warmPeriodically() {
+	ticker := time.NewTicker(p.GetConfig().WarmConfig.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			warmed, err := p.WarmCache(p.Context, "")
+			if err != nil {
+				p.Logger.Error().Msgf("Error during scheduled cache warming: %s", err)
+			}
+			p.Logger.Info().Msgf("Scheduled cache warming replayed %d queries", warmed)
+		case <-p.Context.Done():
+			return
+		}
+	}
+}
+
+func (p *Proxy) handleWarm(w http.ResponseWriter, r *http.Request) {
+	logger := p.log(r.Context())
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !p.authorizePurge(w, r) {
+		return
+	}
+
+	index := util.ExtractIndexName(r.URL.Path)
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWarmBodySize))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("Request body exceeds %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Error reading request body", http.StatusBadRequest)
+		return
+	}
+
+	var queries []trackedQuery
+	if len(bytes.TrimSpace(body)) == 0 {
+		if p.queries == nil {
+			http.Error(w, "Query tracking is disabled", http.StatusBadRequest)
+			return
+		}
+		queries = p.queries.Top(index)
+	} else {
+		queries, err = parseWarmQueries(index, bytes.NewReader(body))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	logger.Info().Msgf("[%s] Cache warming requested with %d queries", index, len(queries))
+
+	// warming is rate limited and may take a while, don't keep the client waiting
+	go func() {
+		warmed, err := p.replayQueries(p.Context, queries)
+		if err != nil {
+			logger.Error().Msgf("[%s] Error warming cache: %s", index, err)
+		}
+		logger.Info().Msgf("[%s] Warmed %d of %d queries", index, warmed, len(queries))
+	}()
+
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{
+		"index":   index,
+		"queries": len(queries),
+	})
+}
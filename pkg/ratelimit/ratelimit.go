@@ -0,0 +1,94 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// Limit is a token bucket refilled with Rate tokens per second, holding up to Burst tokens
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// burst defaults to one second worth of requests
+func (l Limit) burst() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+
+	return math.Max(1, math.Ceil(l.Rate))
+}
+
+// Limiter takes a token from the bucket of key. When the bucket is empty it returns
+// false and how long to wait for the next token.
+type Limiter interface {
+	Allow(ctx context.Context, key string, limit Limit) (bool, time.Duration, error)
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// take refills the bucket for the time elapsed since its last update and takes a token
+func (b *bucket) take(limit Limit, now time.Time) (bool, time.Duration) {
+	burst := limit.burst()
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.updated).Seconds()*limit.Rate)
+	b.updated = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	return false, time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+}
+
+// MemoryLimiter keeps the buckets of a single instance
+type MemoryLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastPrune time.Time
+}
+
+func NewMemoryLimiter() *MemoryLimiter {
+	return &MemoryLimiter{
+		buckets:   make(map[string]*bucket),
+		lastPrune: time.Now(),
+	}
+}
+
+func (m *MemoryLimiter) Allow(ctx context.Context, key string, limit Limit) (bool, time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	m.prune(now)
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &bucket{tokens: limit.burst(), updated: now}
+		m.buckets[key] = b
+	}
+
+	allowed, wait := b.take(limit, now)
+
+	return allowed, wait, nil
+}
+
+// prune drops the buckets of clients that have been idle for a while, they are full again anyway
+func (m *MemoryLimiter) prune(now time.Time) {
+	if now.Sub(m.lastPrune) < time.Minute {
+		return
+	}
+	m.lastPrune = now
+
+	for key, b := range m.buckets {
+		if now.Sub(b.updated) > 10*time.Minute {
+			delete(m.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package ratelimit_test
+
+import (
+	"context"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/redis/go-redis/v9"
+
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/ratelimit"
+)
+
+var _ = Describe("Ratelimit", func() {
+
+	ctx := context.Background()
+	limit := ratelimit.Limit{Rate: 10, Burst: 3}
+
+	// exhaust takes the whole burst of key and returns the wait for the next token
+	exhaust := func(limiter ratelimit.Limiter, key string) time.Duration {
+		for i := 0; i < limit.Burst; i++ {
+			allowed, _, err := limiter.Allow(ctx, key, limit)
+			Expect(err).To(BeNil())
+			Expect(allowed).To(BeTrue())
+		}
+
+		allowed, wait, err := limiter.Allow(ctx, key, limit)
+		Expect(err).To(BeNil())
+		Expect(allowed).To(BeFalse())
+
+		return wait
+	}
+
+	Context("in memory", func() {
+		It("should allow the burst and refill at the rate", func() {
+			limiter := ratelimit.NewMemoryLimiter()
+
+			wait := exhaust(limiter, "client")
+			Expect(wait).To(BeNumerically("~", 100*time.Millisecond, 20*time.Millisecond))
+
+			// another client has its own bucket
+			allowed, _, _ := limiter.Allow(ctx, "other", limit)
+			Expect(allowed).To(BeTrue())
+
+			time.Sleep(wait)
+			allowed, _, _ = limiter.Allow(ctx, "client", limit)
+			Expect(allowed).To(BeTrue())
+		})
+
+		It("should default the burst to a second worth of requests", func() {
+			limiter := ratelimit.NewMemoryLimiter()
+
+			for i := 0; i < 2; i++ {
+				allowed, _, _ := limiter.Allow(ctx, "client", ratelimit.Limit{Rate: 2})
+				Expect(allowed).To(BeTrue())
+			}
+
+			allowed, _, _ := limiter.Allow(ctx, "client", ratelimit.Limit{Rate: 2})
+			Expect(allowed).To(BeFalse())
+		})
+	})
+
+	Context("in Redis", func() {
+		var server *miniredis.Miniredis
+		var client *redis.Client
+
+		BeforeEach(func() {
+			server = miniredis.RunT(GinkgoT())
+			client = redis.NewClient(&redis.Options{Addr: server.Addr()})
+		})
+
+		AfterEach(func() {
+			client.Close()
+		})
+
+		It("should share the buckets between limiters", func() {
+			wait := exhaust(ratelimit.NewRedisLimiter(client), "client")
+			Expect(wait).To(BeNumerically("~", 100*time.Millisecond, 20*time.Millisecond))
+
+			allowed, _, err := ratelimit.NewRedisLimiter(client).Allow(ctx, "client", limit)
+			Expect(err).To(BeNil())
+			Expect(allowed).To(BeFalse())
+
+			time.Sleep(wait)
+			allowed, _, err = ratelimit.NewRedisLimiter(client).Allow(ctx, "client", limit)
+			Expect(err).To(BeNil())
+			Expect(allowed).To(BeTrue())
+		})
+
+		It("should let requests through when Redis is down", func() {
+			limiter := ratelimit.NewRedisLimiter(client)
+			server.Close()
+
+			allowed, _, err := limiter.Allow(ctx, "client", limit)
+			Expect(err).ToNot(BeNil())
+			Expect(allowed).To(BeTrue())
+		})
+	})
+})
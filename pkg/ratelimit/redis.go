@@ -0,0 +1,56 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// tokenBucket refills and takes a token from the bucket stored in a hash, atomically
+var tokenBucket = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "updated")
+local tokens = tonumber(bucket[1]) or burst
+local updated = tonumber(bucket[2]) or now
+
+tokens = math.min(burst, tokens + math.max(0, now - updated) / 1000 * rate)
+
+local allowed = 0
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	wait = math.ceil((1 - tokens) / rate * 1000)
+end
+
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "updated", tostring(now))
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+
+return {allowed, wait}
+`)
+
+// RedisLimiter keeps the buckets in Redis so they are shared by every instance of the proxy
+type RedisLimiter struct {
+	client redis.Scripter
+	prefix string
+}
+
+func NewRedisLimiter(client redis.Scripter) *RedisLimiter {
+	return &RedisLimiter{client: client, prefix: "meilisearch-proxy:ratelimit:"}
+}
+
+func (r *RedisLimiter) Allow(ctx context.Context, key string, limit Limit) (bool, time.Duration, error) {
+	result, err := tokenBucket.Run(ctx, r.client, []string{r.prefix + key},
+		limit.Rate, limit.burst(), time.Now().UnixMilli()).Int64Slice()
+	if err != nil {
+		return true, 0, err
+	}
+
+	return result[0] == 1, time.Duration(math.Max(0, float64(result[1]))) * time.Millisecond, nil
+}
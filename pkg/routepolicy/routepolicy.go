@@ -0,0 +1,134 @@
+package routepolicy
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Presets of routes of the Meilisearch API, the allow rules of a policy are added to them
+const (
+	PresetAll        = "all"
+	PresetReadOnly   = "read-only"
+	PresetSearchOnly = "search-only"
+)
+
+// searchOnly are the routes searching indexes
+var searchOnly = []string{
+	"GET /health",
+	"GET /indexes/*/search",
+	"POST /indexes/*/search",
+	"POST /indexes/*/facet-search",
+	"POST /multi-search",
+}
+
+// readOnly are the routes reading indexes, documents, settings and tasks, API keys,
+// dumps and snapshots are left out
+var readOnly = slices.Concat([]string{
+	"GET /version",
+	"GET /stats",
+	"GET /indexes",
+	"GET /indexes/*",
+	"GET /indexes/*/stats",
+	"GET /indexes/*/settings",
+	"GET /indexes/*/settings/*",
+	"GET /indexes/*/documents",
+	"GET /indexes/*/documents/*",
+	"POST /indexes/*/documents/fetch",
+	"GET /tasks",
+	"GET /tasks/*",
+}, searchOnly)
+
+// rule matches requests by method and path
+type rule struct {
+	method string
+	path   *regexp.Regexp
+}
+
+func (r rule) matches(method string, path string) bool {
+	if r.method != "*" && r.method != method && !(r.method == http.MethodGet && method == http.MethodHead) {
+		return false
+	}
+
+	return r.path.MatchString(path)
+}
+
+// Policy allows the requests matching its preset or allow rules, unless they match a deny rule
+type Policy struct {
+	all   bool
+	allow []rule
+	deny  []rule
+}
+
+// New compiles a policy. Rules are a method, or * for any method, followed by a path
+// where * matches one segment and /** the path and everything below it:
+// "DELETE /indexes/*/documents/**".
+func New(preset string, allow []string, deny []string) (*Policy, error) {
+	p := &Policy{}
+
+	switch preset {
+	case PresetAll, "":
+		p.all = true
+	case PresetReadOnly:
+		allow = slices.Concat(readOnly, allow)
+	case PresetSearchOnly:
+		allow = slices.Concat(searchOnly, allow)
+	default:
+		return nil, fmt.Errorf("unknown preset %q, must be all, read-only or search-only", preset)
+	}
+
+	var err error
+	if p.allow, err = parseRules(allow); err != nil {
+		return nil, err
+	}
+	if p.deny, err = parseRules(deny); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+var rulePattern = regexp.MustCompile(`^([A-Z]+|\*) (/\S*)$`)
+
+func parseRules(rules []string) ([]rule, error) {
+	parsed := make([]rule, 0, len(rules))
+
+	for _, r := range rules {
+		match := rulePattern.FindStringSubmatch(strings.TrimSpace(r))
+		if match == nil {
+			return nil, fmt.Errorf("invalid rule %q, must be a method and a path like GET /indexes/*/search", r)
+		}
+
+		path := regexp.QuoteMeta(strings.TrimSuffix(match[2], "/"))
+		path = strings.ReplaceAll(path, `/\*\*`, `(/.*)?`)
+		path = strings.ReplaceAll(path, `\*\*`, `.*`)
+		path = strings.ReplaceAll(path, `\*`, `[^/]+`)
+
+		parsed = append(parsed, rule{method: match[1], path: regexp.MustCompile("^" + path + "/?$")})
+	}
+
+	return parsed, nil
+}
+
+// Allows returns whether a request to the path with this method is allowed
+func (p *Policy) Allows(method string, path string) bool {
+	for _, r := range p.deny {
+		if r.matches(method, path) {
+			return false
+		}
+	}
+
+	if p.all {
+		return true
+	}
+
+	for _, r := range p.allow {
+		if r.matches(method, path) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,13 @@
+package routepolicy_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestRoutePolicy(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "RoutePolicy Suite")
+}
@@ -0,0 +1,59 @@
+package routepolicy_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/routepolicy"
+)
+
+var _ = Describe("RoutePolicy", func() {
+
+	It("should allow every route by default, except the denied ones", func() {
+		policy, err := routepolicy.New(routepolicy.PresetAll, nil, []string{"DELETE /indexes/**", "* /keys/**"})
+		Expect(err).To(BeNil())
+
+		Expect(policy.Allows("POST", "/indexes/products/documents")).To(BeTrue())
+		Expect(policy.Allows("DELETE", "/indexes/products/documents")).To(BeFalse())
+		Expect(policy.Allows("GET", "/keys")).To(BeFalse())
+		Expect(policy.Allows("PATCH", "/keys/abc")).To(BeFalse())
+	})
+
+	It("should only allow searches with the search-only preset", func() {
+		policy, err := routepolicy.New(routepolicy.PresetSearchOnly, nil, nil)
+		Expect(err).To(BeNil())
+
+		Expect(policy.Allows("POST", "/indexes/products/search")).To(BeTrue())
+		Expect(policy.Allows("GET", "/indexes/products/search")).To(BeTrue())
+		Expect(policy.Allows("HEAD", "/indexes/products/search")).To(BeTrue())
+		Expect(policy.Allows("POST", "/multi-search")).To(BeTrue())
+		Expect(policy.Allows("GET", "/indexes/products/documents")).To(BeFalse())
+		Expect(policy.Allows("DELETE", "/indexes/products/search")).To(BeFalse())
+	})
+
+	It("should allow reads but not API keys, dumps or writes with the read-only preset", func() {
+		policy, err := routepolicy.New(routepolicy.PresetReadOnly, []string{"POST /indexes/logs/documents"}, []string{"GET /tasks/**"})
+		Expect(err).To(BeNil())
+
+		Expect(policy.Allows("GET", "/indexes/products/documents/42")).To(BeTrue())
+		Expect(policy.Allows("GET", "/indexes/products/settings/")).To(BeTrue())
+		Expect(policy.Allows("POST", "/indexes/products/documents/fetch")).To(BeTrue())
+		Expect(policy.Allows("POST", "/indexes/products/search")).To(BeTrue())
+		Expect(policy.Allows("POST", "/indexes/logs/documents")).To(BeTrue())
+		Expect(policy.Allows("POST", "/indexes/products/documents")).To(BeFalse())
+		Expect(policy.Allows("DELETE", "/indexes/products")).To(BeFalse())
+		Expect(policy.Allows("GET", "/keys")).To(BeFalse())
+		Expect(policy.Allows("POST", "/dumps")).To(BeFalse())
+		Expect(policy.Allows("POST", "/snapshots")).To(BeFalse())
+		Expect(policy.Allows("GET", "/tasks/12")).To(BeFalse())
+		Expect(policy.Allows("GET", "/tasks")).To(BeFalse())
+	})
+
+	It("should refuse unknown presets and invalid rules", func() {
+		_, err := routepolicy.New("read-write", nil, nil)
+		Expect(err).To(MatchError(`unknown preset "read-write", must be all, read-only or search-only`))
+
+		_, err = routepolicy.New(routepolicy.PresetAll, nil, []string{"/keys"})
+		Expect(err).To(MatchError(`invalid rule "/keys", must be a method and a path like GET /indexes/*/search`))
+	})
+})
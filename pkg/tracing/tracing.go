@@ -0,0 +1,63 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/config"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// Setup installs the global tracer provider and the W3C trace context propagator.
+// The returned function flushes the spans left and stops the exporter. Nothing is
+// installed when tracing is disabled.
+func Setup(ctx context.Context, cfg *config.TracingConfig) (func(context.Context) error, error) {
+	noop := func(context.Context) error { return nil }
+
+	if cfg == nil || cfg.Exporter == "" || cfg.Exporter == config.TracingExporterNone {
+		return noop, nil
+	}
+
+	var exporter sdktrace.SpanExporter
+	var err error
+
+	switch cfg.Exporter {
+	case config.TracingExporterOTLP:
+		var opts []otlptracehttp.Option
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpointURL(cfg.Endpoint))
+		}
+		exporter, err = otlptracehttp.New(ctx, opts...)
+	case config.TracingExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	default:
+		err = fmt.Errorf("unknown exporter %q", cfg.Exporter)
+	}
+
+	if err != nil {
+		return noop, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", cfg.ServiceName)))
+	if err != nil {
+		return noop, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	return provider.Shutdown, nil
+}
@@ -0,0 +1,50 @@
+package tracing_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"go.opentelemetry.io/otel"
+
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/config"
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/tracing"
+)
+
+var _ = Describe("Tracing", func() {
+
+	It("should not install anything when tracing is disabled", func() {
+		provider := otel.GetTracerProvider()
+
+		shutdown, err := tracing.Setup(context.Background(), config.DefaultTracingConfig())
+		Expect(err).To(BeNil())
+		Expect(shutdown(context.Background())).To(Succeed())
+
+		Expect(otel.GetTracerProvider()).To(BeIdenticalTo(provider))
+	})
+
+	It("should export spans to an OTLP collector", func() {
+		exported := make(chan string, 10)
+		collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			exported <- r.URL.Path
+		}))
+		defer collector.Close()
+
+		shutdown, err := tracing.Setup(context.Background(), &config.TracingConfig{
+			Exporter:    config.TracingExporterOTLP,
+			Endpoint:    collector.URL + "/v1/traces",
+			ServiceName: "meilisearch-proxy",
+			SampleRatio: 1,
+		})
+		Expect(err).To(BeNil())
+
+		_, span := otel.Tracer("test").Start(context.Background(), "search")
+		span.End()
+
+		// spans are flushed on shutdown
+		Expect(shutdown(context.Background())).To(Succeed())
+		Expect(exported).To(Receive(Equal("/v1/traces")))
+	})
+})
@@ -0,0 +1,165 @@
+package upstream
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned without contacting Meilisearch while the breaker is open
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+const (
+	StateClosed   = "closed"
+	StateOpen     = "open"
+	StateHalfOpen = "half-open"
+)
+
+type circuit struct {
+	failures int
+	openedAt time.Time
+	// probing is set while a single request is let through to test a half-open circuit
+	probing bool
+}
+
+// Breaker keeps a circuit per upstream host. After threshold consecutive failures
+// (errors or 5xx responses) the circuit opens and searches fail fast with
+// ErrCircuitOpen. Once the cooldown has passed a single request is let through,
+// closing the circuit again if it succeeds.
+type Breaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	circuits  map[string]*circuit
+}
+
+func NewBreaker(threshold int, cooldown time.Duration) *Breaker {
+	return &Breaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		circuits:  make(map[string]*circuit),
+	}
+}
+
+func (b *Breaker) circuit(host string) *circuit {
+	c, ok := b.circuits[host]
+	if !ok {
+		c = &circuit{}
+		b.circuits[host] = c
+	}
+
+	return c
+}
+
+func (b *Breaker) state(c *circuit, now time.Time) string {
+	if b.threshold <= 0 || c.failures < b.threshold {
+		return StateClosed
+	}
+	if now.Sub(c.openedAt) < b.cooldown {
+		return StateOpen
+	}
+
+	return StateHalfOpen
+}
+
+// Allow reports whether a request to host may be sent
+func (b *Breaker) Allow(host string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c := b.circuit(host)
+
+	switch b.state(c, time.Now()) {
+	case StateClosed:
+		return true
+	case StateHalfOpen:
+		if c.probing {
+			return false
+		}
+		c.probing = true
+		return true
+	}
+
+	return false
+}
+
+// Record registers the outcome of a request to host
+func (b *Breaker) Record(host string, success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c := b.circuit(host)
+	c.probing = false
+
+	if success {
+		c.failures = 0
+		return
+	}
+
+	c.failures++
+	if c.failures >= b.threshold {
+		// (re)open the circuit, a failed probe restarts the cooldown
+		c.openedAt = time.Now()
+	}
+}
+
+// Release lets another request probe a half-open circuit without recording an outcome
+func (b *Breaker) Release(host string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.circuit(host).probing = false
+}
+
+// State returns the state of the circuit of host
+func (b *Breaker) State(host string) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state(b.circuit(host), time.Now())
+}
+
+// States returns the state of every known circuit
+func (b *Breaker) States() map[string]string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	states := make(map[string]string, len(b.circuits))
+	for host, c := range b.circuits {
+		states[host] = b.state(c, now)
+	}
+
+	return states
+}
+
+type breakerTransport struct {
+	next    http.RoundTripper
+	breaker *Breaker
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !isSearch(req) {
+		return t.next.RoundTrip(req)
+	}
+
+	host := req.URL.Host
+
+	if !t.breaker.Allow(host) {
+		return nil, fmt.Errorf("%s: %w", host, ErrCircuitOpen)
+	}
+
+	resp, err := t.next.RoundTrip(req)
+
+	// a client going away says nothing about the health of Meilisearch
+	if err != nil && req.Context().Err() != nil {
+		t.breaker.Release(host)
+		return resp, err
+	}
+
+	t.breaker.Record(host, err == nil && resp.StatusCode < http.StatusInternalServerError)
+
+	return resp, err
+}
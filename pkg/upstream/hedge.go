@@ -0,0 +1,274 @@
+package upstream
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// latencyWindow is the number of recent search latencies the hedging delay is derived from
+	latencyWindow = 512
+	// minLatencySamples is the number of latencies needed before searches are hedged on delay
+	minLatencySamples = 20
+	// maxHedgeTokens bounds the hedges that can be sent in a burst after a quiet period
+	maxHedgeTokens = 10
+)
+
+type hedgedKey struct{}
+
+// WithHedging marks a request as safe to send to several replicas at once
+func WithHedging(ctx context.Context) context.Context {
+	return context.WithValue(ctx, hedgedKey{}, true)
+}
+
+// latencies keeps a window of recent latencies
+type latencies struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+}
+
+func (l *latencies) add(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.samples) < latencyWindow {
+		l.samples = append(l.samples, d)
+		return
+	}
+
+	l.samples[l.next] = d
+	l.next = (l.next + 1) % latencyWindow
+}
+
+// percentile returns the p-th percentile latency, or false while there are too few samples
+func (l *latencies) percentile(p float64) (time.Duration, bool) {
+	l.mu.Lock()
+	sorted := append([]time.Duration(nil), l.samples...)
+	l.mu.Unlock()
+
+	if len(sorted) < minLatencySamples {
+		return 0, false
+	}
+
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	return sorted[int(float64(len(sorted)-1)*p/100)], true
+}
+
+// hedgeBudget lets through a fraction of hedges, each search earns ratio tokens and a hedge spends one
+type hedgeBudget struct {
+	mu     sync.Mutex
+	ratio  float64
+	tokens float64
+}
+
+func (b *hedgeBudget) earn() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.tokens = min(b.tokens+b.ratio, maxHedgeTokens)
+}
+
+func (b *hedgeBudget) spend() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+
+	return true
+}
+
+// hedgeTransport sends a second copy of a search to another replica when the first
+// hasn't answered within the hedging delay, or has failed. The first successful
+// response wins and the other request is cancelled.
+type hedgeTransport struct {
+	next       http.RoundTripper
+	replicas   []*url.URL
+	percentile float64
+	minDelay   time.Duration
+	latencies  *latencies
+	budget     *hedgeBudget
+	turn       atomic.Uint64
+}
+
+type hedgeAttempt struct {
+	index int
+	resp  *http.Response
+	err   error
+	start time.Time
+}
+
+func newHedgeTransport(next http.RoundTripper, replicas []*url.URL, percentile float64, minDelay time.Duration, budget float64) *hedgeTransport {
+	return &hedgeTransport{
+		next:       next,
+		replicas:   replicas,
+		percentile: percentile,
+		minDelay:   minDelay,
+		latencies:  &latencies{},
+		budget:     &hedgeBudget{ratio: budget},
+	}
+}
+
+// delay returns how long to wait for a search before hedging it
+func (t *hedgeTransport) delay() (time.Duration, bool) {
+	d, ok := t.latencies.percentile(t.percentile)
+	if !ok {
+		return 0, false
+	}
+
+	return max(d, t.minDelay), true
+}
+
+// replica picks, in turn, a replica other than the host of the original request
+func (t *hedgeTransport) replica(host string) *url.URL {
+	for range t.replicas {
+		replica := t.replicas[t.turn.Add(1)%uint64(len(t.replicas))]
+		if replica.Host != host {
+			return replica
+		}
+	}
+
+	return nil
+}
+
+func (t *hedgeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Context().Value(hedgedKey{}) == nil {
+		return t.next.RoundTrip(req)
+	}
+
+	t.budget.earn()
+
+	req, err := replayable(req)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make(chan hedgeAttempt, 2)
+	var cancels []context.CancelFunc
+
+	send := func(target *url.URL) error {
+		ctx, cancel := context.WithCancel(req.Context())
+		index := len(cancels)
+		cancels = append(cancels, cancel)
+
+		attemptReq := req.Clone(ctx)
+		if target != nil {
+			attemptReq.URL.Scheme = target.Scheme
+			attemptReq.URL.Host = target.Host
+			attemptReq.Host = target.Host
+		}
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				cancels = cancels[:index]
+				cancel()
+				return err
+			}
+			attemptReq.Body = body
+		}
+
+		go func() {
+			start := time.Now()
+			resp, err := t.next.RoundTrip(attemptReq)
+			results <- hedgeAttempt{index: index, resp: resp, err: err, start: start}
+		}()
+
+		return nil
+	}
+
+	if err := send(nil); err != nil {
+		return nil, err
+	}
+	inflight := 1
+
+	hedged := false
+	hedge := func() {
+		if hedged {
+			return
+		}
+		hedged = true
+
+		replica := t.replica(req.URL.Host)
+		if replica == nil || !t.budget.spend() {
+			return
+		}
+		if send(replica) == nil {
+			inflight++
+		}
+	}
+
+	var timeout <-chan time.Time
+	if delay, ok := t.delay(); ok {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var last hedgeAttempt
+	for inflight > 0 {
+		select {
+		case <-timeout:
+			hedge()
+		case attempt := <-results:
+			inflight--
+
+			if attempt.err == nil && attempt.resp.StatusCode < http.StatusInternalServerError {
+				t.latencies.add(time.Since(attempt.start))
+				discard(results, inflight)
+				return keep(attempt, cancels)
+			}
+
+			if last.resp != nil {
+				last.resp.Body.Close()
+			}
+			last = attempt
+
+			// fail over to a replica right away
+			hedge()
+		}
+	}
+
+	return keep(last, cancels)
+}
+
+// keep cancels every attempt but the given one, which is cancelled once its body is closed
+func keep(attempt hedgeAttempt, cancels []context.CancelFunc) (*http.Response, error) {
+	for i, cancel := range cancels {
+		if i != attempt.index {
+			cancel()
+		}
+	}
+
+	if attempt.resp == nil {
+		cancels[attempt.index]()
+		return nil, attempt.err
+	}
+
+	attempt.resp.Body = &cancelOnClose{ReadCloser: attempt.resp.Body, cancel: cancels[attempt.index]}
+
+	return attempt.resp, attempt.err
+}
+
+// discard closes the responses of the attempts that lost the race
+func discard(results <-chan hedgeAttempt, inflight int) {
+	if inflight == 0 {
+		return
+	}
+
+	go func() {
+		for i := 0; i < inflight; i++ {
+			if attempt := <-results; attempt.resp != nil {
+				attempt.resp.Body.Close()
+			}
+		}
+	}()
+}
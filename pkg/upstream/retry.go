@@ -0,0 +1,105 @@
+package upstream
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// retryTransport retries searches and GET requests that failed or got a 502, 503 or 504,
+// waiting a jittered exponential backoff between attempts
+type retryTransport struct {
+	next    http.RoundTripper
+	retries int
+	backoff time.Duration
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !isRetryable(req) {
+		return t.next.RoundTrip(req)
+	}
+
+	req, err := replayable(req)
+	if err != nil {
+		return nil, err
+	}
+
+	for attempt := 0; ; attempt++ {
+		resp, err := t.next.RoundTrip(req)
+
+		if attempt >= t.retries || !shouldRetry(req, resp, err) {
+			return resp, err
+		}
+
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		timer := time.NewTimer(jitter(t.backoff << attempt))
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+
+		if req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// replayable clones a request and makes sure its body can be sent again with GetBody
+func replayable(req *http.Request) (*http.Request, error) {
+	req = req.Clone(req.Context())
+	if req.Body == nil || req.Body == http.NoBody || req.GetBody != nil {
+		return req, nil
+	}
+
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	req.Body, _ = req.GetBody()
+
+	return req, nil
+}
+
+func shouldRetry(req *http.Request, resp *http.Response, err error) bool {
+	// don't retry what the client gave up on
+	if req.Context().Err() != nil {
+		return false
+	}
+
+	if err != nil {
+		// fail fast while the breaker is open
+		return !errors.Is(err, ErrCircuitOpen)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+
+	return false
+}
+
+// jitter spreads a backoff between 50% and 150% of its value
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+
+	return d/2 + time.Duration(rand.Int63n(int64(d)))
+}
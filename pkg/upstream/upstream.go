@@ -0,0 +1,141 @@
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/config"
+)
+
+type retryableKey struct{}
+
+// WithRetryable marks a request as a search, safe to retry even though its method is
+// not idempotent: searches are sent as POST but don't change anything. Only searches
+// are bounded by the response timeouts and go through the circuit breaker, so that
+// document uploads, dumps and settings updates are never cut short.
+func WithRetryable(ctx context.Context) context.Context {
+	return context.WithValue(ctx, retryableKey{}, true)
+}
+
+func isSearch(req *http.Request) bool {
+	return req.Context().Value(retryableKey{}) != nil
+}
+
+func isRetryable(req *http.Request) bool {
+	return req.Method == http.MethodGet || req.Method == http.MethodHead || isSearch(req)
+}
+
+// NewTransport creates the base transport to Meilisearch with the connection timeouts,
+// and tlsConfig for Meilisearch over https, see config.UpstreamConfig.TLS
+func NewTransport(cfg *config.UpstreamConfig, tlsConfig *tls.Config) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	transport.DialContext = (&net.Dialer{
+		Timeout:   cfg.DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.TLSHandshakeTimeout = cfg.TLSHandshakeTimeout
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig.Clone()
+	}
+
+	return transport
+}
+
+// NewRoundTripper wraps a base transport with the response timeouts of searches, the
+// circuit breaker, hedging to replicas and retries. Every attempt of a retried or hedged
+// search goes through the breaker, which keeps a circuit per replica.
+func NewRoundTripper(base http.RoundTripper, cfg *config.UpstreamConfig, breaker *Breaker) http.RoundTripper {
+	var rt http.RoundTripper = base
+
+	if cfg.Timeout > 0 || cfg.ResponseHeaderTimeout > 0 {
+		rt = &timeoutTransport{next: rt, timeout: cfg.Timeout, headerTimeout: cfg.ResponseHeaderTimeout}
+	}
+
+	if breaker != nil {
+		rt = &breakerTransport{next: rt, breaker: breaker}
+	}
+
+	if replicas := parseReplicas(cfg.Replicas); len(replicas) > 0 && cfg.HedgeBudget > 0 {
+		rt = newHedgeTransport(rt, replicas, cfg.HedgePercentile, cfg.HedgeMinDelay, cfg.HedgeBudget)
+	}
+
+	if cfg.Retries > 0 {
+		rt = &retryTransport{next: rt, retries: cfg.Retries, backoff: cfg.RetryBackoff}
+	}
+
+	return rt
+}
+
+func parseReplicas(replicas []string) []*url.URL {
+	var urls []*url.URL
+	for _, replica := range replicas {
+		if u, err := url.Parse(replica); err == nil && u.Host != "" {
+			urls = append(urls, u)
+		}
+	}
+
+	return urls
+}
+
+var errResponseHeaderTimeout = errors.New("timeout awaiting response headers")
+
+// timeoutTransport bounds the wait for the response headers of a search, and the whole
+// search including reading its response body
+type timeoutTransport struct {
+	next          http.RoundTripper
+	timeout       time.Duration
+	headerTimeout time.Duration
+}
+
+func (t *timeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !isSearch(req) {
+		return t.next.RoundTrip(req)
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	if t.timeout > 0 {
+		cancel()
+		ctx, cancel = context.WithTimeout(req.Context(), t.timeout)
+	}
+
+	var headerTimer *time.Timer
+	if t.headerTimeout > 0 {
+		headerTimer = time.AfterFunc(t.headerTimeout, cancel)
+	}
+
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if headerTimer != nil && !headerTimer.Stop() {
+		if err == nil {
+			resp.Body.Close()
+		}
+		cancel()
+		return nil, errResponseHeaderTimeout
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+
+	return resp, nil
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+
+	return err
+}
@@ -0,0 +1,256 @@
+package upstream_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/config"
+	"github.com/maxroll-media-group/meilisearch-proxy/pkg/upstream"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Upstream", func() {
+	var cfg *config.UpstreamConfig
+
+	BeforeEach(func() {
+		cfg = config.DefaultUpstreamConfig()
+		cfg.RetryBackoff = time.Millisecond
+	})
+
+	search := func(rt http.RoundTripper, url string) (*http.Response, error) {
+		req, err := http.NewRequestWithContext(upstream.WithHedging(upstream.WithRetryable(context.Background())),
+			http.MethodPost, url+"/indexes/test/search", strings.NewReader(`{"q":"test"}`))
+		Expect(err).ToNot(HaveOccurred())
+
+		return rt.RoundTrip(req)
+	}
+
+	It("should time out waiting for a slow upstream", func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(500 * time.Millisecond)
+		}))
+		defer server.Close()
+
+		cfg.ResponseHeaderTimeout = 50 * time.Millisecond
+		cfg.Retries = 0
+
+		start := time.Now()
+		_, err := search(upstream.NewRoundTripper(upstream.NewTransport(cfg, nil), cfg, nil), server.URL)
+		Expect(err).To(HaveOccurred())
+		Expect(time.Since(start)).To(BeNumerically("<", 400*time.Millisecond))
+	})
+
+	It("should not bound other requests than searches", func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(200 * time.Millisecond)
+			w.WriteHeader(http.StatusAccepted)
+		}))
+		defer server.Close()
+
+		cfg.ResponseHeaderTimeout = 50 * time.Millisecond
+		cfg.Timeout = 100 * time.Millisecond
+
+		req, err := http.NewRequest(http.MethodPost, server.URL+"/indexes/test/documents", strings.NewReader(`[]`))
+		Expect(err).ToNot(HaveOccurred())
+
+		resp, err := upstream.NewRoundTripper(upstream.NewTransport(cfg, nil), cfg, nil).RoundTrip(req)
+		Expect(err).ToNot(HaveOccurred())
+		resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusAccepted))
+	})
+
+	It("should retry transient failures with the same body", func() {
+		var calls atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			Expect(string(body)).To(Equal(`{"q":"test"}`))
+
+			if calls.Add(1) < 3 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte(`{"hits":[]}`))
+		}))
+		defer server.Close()
+
+		resp, err := search(upstream.NewRoundTripper(upstream.NewTransport(cfg, nil), cfg, nil), server.URL)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(calls.Load()).To(Equal(int32(3)))
+	})
+
+	It("should not retry writes", func() {
+		var calls atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer server.Close()
+
+		req, err := http.NewRequest(http.MethodPost, server.URL+"/indexes/test/documents", strings.NewReader(`[]`))
+		Expect(err).ToNot(HaveOccurred())
+
+		resp, err := upstream.NewRoundTripper(upstream.NewTransport(cfg, nil), cfg, nil).RoundTrip(req)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(resp.StatusCode).To(Equal(http.StatusServiceUnavailable))
+		Expect(calls.Load()).To(Equal(int32(1)))
+	})
+
+	Context("with replicas", func() {
+		var primary, replica *httptest.Server
+		var primaryDelay atomic.Int64
+		var primaryCancelled, replicaCalls atomic.Int32
+
+		BeforeEach(func() {
+			primaryDelay.Store(0)
+			primaryCancelled.Store(0)
+			replicaCalls.Store(0)
+
+			primary = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// the server only notices a client going away once the body is read
+				io.ReadAll(r.Body)
+
+				select {
+				case <-time.After(time.Duration(primaryDelay.Load())):
+					w.Write([]byte(`{"from":"primary"}`))
+				case <-r.Context().Done():
+					primaryCancelled.Add(1)
+				}
+			}))
+			replica = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				replicaCalls.Add(1)
+				body, _ := io.ReadAll(r.Body)
+				Expect(string(body)).To(Equal(`{"q":"test"}`))
+				w.Write([]byte(`{"from":"replica"}`))
+			}))
+
+			cfg.Retries = 0
+			cfg.Replicas = []string{primary.URL, replica.URL}
+			cfg.HedgeMinDelay = 20 * time.Millisecond
+		})
+
+		AfterEach(func() {
+			primary.Close()
+			replica.Close()
+		})
+
+		// searches answers n fast searches so the hedging delay can be derived from their latency
+		searches := func(rt http.RoundTripper, n int) {
+			for i := 0; i < n; i++ {
+				resp, err := search(rt, primary.URL)
+				Expect(err).ToNot(HaveOccurred())
+				io.ReadAll(resp.Body)
+				resp.Body.Close()
+			}
+		}
+
+		It("should hedge a slow search to another replica and cancel the first request", func() {
+			cfg.HedgeBudget = 0.5
+			rt := upstream.NewRoundTripper(upstream.NewTransport(cfg, nil), cfg, nil)
+			searches(rt, 20)
+			Expect(replicaCalls.Load()).To(BeZero())
+
+			primaryDelay.Store(int64(time.Second))
+
+			start := time.Now()
+			resp, err := search(rt, primary.URL)
+			Expect(err).ToNot(HaveOccurred())
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			Expect(string(body)).To(Equal(`{"from":"replica"}`))
+			Expect(time.Since(start)).To(BeNumerically("<", 500*time.Millisecond))
+			Expect(replicaCalls.Load()).To(Equal(int32(1)))
+			Eventually(primaryCancelled.Load).Should(Equal(int32(1)))
+		})
+
+		It("should not hedge more searches than the budget allows", func() {
+			cfg.HedgeBudget = 0.05
+			rt := upstream.NewRoundTripper(upstream.NewTransport(cfg, nil), cfg, nil)
+			searches(rt, 20)
+
+			primaryDelay.Store(int64(200 * time.Millisecond))
+
+			// the 20 searches earned a single hedge
+			for i := 0; i < 2; i++ {
+				resp, err := search(rt, primary.URL)
+				Expect(err).ToNot(HaveOccurred())
+				io.ReadAll(resp.Body)
+				resp.Body.Close()
+			}
+
+			Expect(replicaCalls.Load()).To(Equal(int32(1)))
+		})
+
+		It("should not hedge writes", func() {
+			cfg.HedgeBudget = 1
+			rt := upstream.NewRoundTripper(upstream.NewTransport(cfg, nil), cfg, nil)
+			searches(rt, 20)
+
+			primaryDelay.Store(int64(200 * time.Millisecond))
+
+			req, err := http.NewRequest(http.MethodPost, primary.URL+"/indexes/test/documents", strings.NewReader(`[]`))
+			Expect(err).ToNot(HaveOccurred())
+			resp, err := rt.RoundTrip(req)
+			Expect(err).ToNot(HaveOccurred())
+			resp.Body.Close()
+
+			Expect(replicaCalls.Load()).To(BeZero())
+		})
+	})
+
+	It("should open the circuit and half-open it after the cooldown", func() {
+		var healthy atomic.Bool
+		var calls atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			if !healthy.Load() {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Write([]byte(`{"hits":[]}`))
+		}))
+		defer server.Close()
+
+		cfg.Retries = 0
+		breaker := upstream.NewBreaker(3, 100*time.Millisecond)
+		rt := upstream.NewRoundTripper(upstream.NewTransport(cfg, nil), cfg, breaker)
+		host := strings.TrimPrefix(server.URL, "http://")
+
+		for i := 0; i < 3; i++ {
+			resp, err := search(rt, server.URL)
+			Expect(err).ToNot(HaveOccurred())
+			resp.Body.Close()
+		}
+		Expect(breaker.State(host)).To(Equal(upstream.StateOpen))
+
+		// fails fast without reaching Meilisearch
+		_, err := search(rt, server.URL)
+		Expect(errors.Is(err, upstream.ErrCircuitOpen)).To(BeTrue())
+		Expect(calls.Load()).To(Equal(int32(3)))
+
+		// writes neither fail fast nor count as failures
+		req, err := http.NewRequest(http.MethodPost, server.URL+"/indexes/test/documents", strings.NewReader(`[]`))
+		Expect(err).ToNot(HaveOccurred())
+		resp, err := rt.RoundTrip(req)
+		Expect(err).ToNot(HaveOccurred())
+		resp.Body.Close()
+		Expect(calls.Load()).To(Equal(int32(4)))
+
+		Eventually(func() string { return breaker.State(host) }).
+			WithTimeout(time.Second).Should(Equal(upstream.StateHalfOpen))
+
+		healthy.Store(true)
+		resp, err = search(rt, server.URL)
+		Expect(err).ToNot(HaveOccurred())
+		resp.Body.Close()
+		Expect(breaker.State(host)).To(Equal(upstream.StateClosed))
+	})
+})
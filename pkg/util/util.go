@@ -1,6 +1,11 @@
 package util
 
-import "strings"
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+)
 
 func SingleJoiningSlash(a, b string) string {
 	aslash := strings.HasSuffix(a, "/")
@@ -25,3 +30,32 @@ func ExtractIndexName(url string) string {
 	// return the index name
 	return split[2]
 }
+
+// CanonicalJSON re-encodes a JSON document with sorted keys and no insignificant
+// whitespace, so that semantically equal search bodies produce the same bytes.
+// Bodies that are not a single valid JSON document are returned unchanged.
+func CanonicalJSON(body []byte) []byte {
+	if len(body) == 0 {
+		return body
+	}
+
+	// UseNumber keeps large integers (ids in filters) from losing precision
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+
+	var decoded interface{}
+	if err := decoder.Decode(&decoded); err != nil {
+		return body
+	}
+	// trailing bytes would be dropped, making different bodies look equal
+	if _, err := decoder.Token(); err != io.EOF {
+		return body
+	}
+
+	canonical, err := json.Marshal(decoded)
+	if err != nil {
+		return body
+	}
+
+	return canonical
+}